@@ -0,0 +1,138 @@
+package analysis
+
+import (
+	"mailer/models"
+	"strconv"
+	"strings"
+)
+
+// Finding severities
+const (
+	SeverityInfo    = "info"
+	SeverityWarning = "warning"
+)
+
+// Finding is a single issue reported by Analyze
+type Finding struct {
+	Check    string            `json:"check"`
+	Severity string            `json:"severity"`
+	Message  string            `json:"message"`
+	Details  map[string]string `json:"details,omitempty"`
+}
+
+// Analyze runs all checks against an email and returns their findings
+func Analyze(email *models.Email) []Finding {
+	findings := make([]Finding, 0)
+	findings = append(findings, checkListHeaders(email)...)
+	findings = append(findings, checkLinkMismatches(email)...)
+	findings = append(findings, checkRecipientCount(email)...)
+	findings = append(findings, checkCrypto(email)...)
+	return findings
+}
+
+// checkCrypto reports signed and encrypted messages, whose signatures
+// mailer can't verify and whose content it can't decrypt
+func checkCrypto(email *models.Email) []Finding {
+	if email.Crypto == nil {
+		return nil
+	}
+
+	details := map[string]string{"format": email.Crypto.Format}
+	if email.Crypto.Protocol != "" {
+		details["protocol"] = email.Crypto.Protocol
+	}
+	if email.Crypto.Micalg != "" {
+		details["micalg"] = email.Crypto.Micalg
+	}
+	if email.Crypto.SMIMEType != "" {
+		details["smimeType"] = email.Crypto.SMIMEType
+	}
+
+	var findings []Finding
+	if email.Signed {
+		findings = append(findings, Finding{
+			Check:    "signature",
+			Severity: SeverityInfo,
+			Message:  "Message is signed; the signature was not verified",
+			Details:  details,
+		})
+	}
+	if email.Encrypted {
+		findings = append(findings, Finding{
+			Check:    "encryption",
+			Severity: SeverityInfo,
+			Message:  "Message is encrypted; its content could not be read",
+			Details:  details,
+		})
+	}
+	return findings
+}
+
+// checkRecipientCount reports messages tagged for exceeding the
+// -warn-recipients threshold
+func checkRecipientCount(email *models.Email) []Finding {
+	if !email.HighRecipientCount {
+		return nil
+	}
+
+	return []Finding{{
+		Check:    "recipient-count",
+		Severity: SeverityWarning,
+		Message:  "Message fans out to an unusually high number of recipients",
+		Details:  map[string]string{"recipients": strconv.Itoa(len(email.To))},
+	}}
+}
+
+// checkListHeaders reports missing or inconsistent List-Unsubscribe,
+// List-Unsubscribe-Post (RFC 8058) and List-Id headers
+func checkListHeaders(email *models.Email) []Finding {
+	var findings []Finding
+
+	if len(email.ListUnsubscribe) == 0 {
+		findings = append(findings, Finding{
+			Check:    "list-unsubscribe",
+			Severity: SeverityWarning,
+			Message:  "List-Unsubscribe header is missing",
+		})
+	}
+
+	if email.ListUnsubscribePost != "" {
+		hasHTTPS := false
+		for _, uri := range email.ListUnsubscribe {
+			if strings.HasPrefix(strings.ToLower(uri), "https://") {
+				hasHTTPS = true
+			}
+		}
+		if !hasHTTPS {
+			findings = append(findings, Finding{
+				Check:    "list-unsubscribe-post",
+				Severity: SeverityWarning,
+				Message:  "List-Unsubscribe-Post requires an https List-Unsubscribe URI",
+			})
+		}
+		if !strings.EqualFold(email.ListUnsubscribePost, "List-Unsubscribe=One-Click") {
+			findings = append(findings, Finding{
+				Check:    "list-unsubscribe-post",
+				Severity: SeverityWarning,
+				Message:  "List-Unsubscribe-Post must be List-Unsubscribe=One-Click",
+				Details:  map[string]string{"value": email.ListUnsubscribePost},
+			})
+		}
+	} else if len(email.ListUnsubscribe) > 0 {
+		findings = append(findings, Finding{
+			Check:    "list-unsubscribe-post",
+			Severity: SeverityInfo,
+			Message:  "List-Unsubscribe-Post header is missing, so one-click unsubscribe is not offered",
+		})
+	}
+
+	if email.ListID == "" {
+		findings = append(findings, Finding{
+			Check:    "list-id",
+			Severity: SeverityInfo,
+			Message:  "List-Id header is missing",
+		})
+	}
+
+	return findings
+}
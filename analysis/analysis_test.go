@@ -0,0 +1,32 @@
+package analysis
+
+import (
+	"mailer/models"
+	"testing"
+)
+
+func TestCryptoFindings(t *testing.T) {
+	email := &models.Email{
+		Signed: true,
+		Crypto: &models.CryptoInfo{Format: "pgp", Protocol: "application/pgp-signature", Micalg: "pgp-sha256"},
+	}
+	var found *Finding
+	for _, f := range Analyze(email) {
+		if f.Check == "encryption" {
+			t.Errorf("encryption finding for a signed-only email: %+v", f)
+		}
+		if f.Check == "signature" {
+			found = &f
+		}
+	}
+	if found == nil {
+		t.Fatal("no signature finding")
+	}
+	if found.Severity != SeverityInfo || found.Details["format"] != "pgp" || found.Details["micalg"] != "pgp-sha256" {
+		t.Errorf("signature finding = %+v", found)
+	}
+
+	if findings := checkCrypto(&models.Email{}); len(findings) != 0 {
+		t.Errorf("findings for an unsigned email: %+v", findings)
+	}
+}
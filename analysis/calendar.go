@@ -0,0 +1,242 @@
+package analysis
+
+import (
+	"strings"
+	"time"
+)
+
+// Calendar is the parsed content of an email's text/calendar part
+type Calendar struct {
+	Method string          `json:"method,omitempty"` // iTIP method such as REQUEST, CANCEL or REPLY
+	Events []CalendarEvent `json:"events"`
+}
+
+// CalendarEvent holds the commonly asserted properties of a VEVENT
+type CalendarEvent struct {
+	UID         string             `json:"uid,omitempty"`
+	Summary     string             `json:"summary,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Location    string             `json:"location,omitempty"`
+	Start       *CalendarTime      `json:"start,omitempty"`
+	End         *CalendarTime      `json:"end,omitempty"`
+	Status      string             `json:"status,omitempty"`
+	Sequence    string             `json:"sequence,omitempty"`
+	RRule       string             `json:"rrule,omitempty"`
+	Organizer   *CalendarAttendee  `json:"organizer,omitempty"`
+	Attendees   []CalendarAttendee `json:"attendees,omitempty"`
+}
+
+// CalendarTime is a DTSTART or DTEND value. Time is set when the value
+// could be resolved to an instant: UTC values, values with a known TZID and
+// all-day dates (midnight UTC). Floating times are left unresolved.
+type CalendarTime struct {
+	Value  string     `json:"value"`
+	TZID   string     `json:"tzid,omitempty"`
+	AllDay bool       `json:"allDay,omitempty"`
+	Time   *time.Time `json:"time,omitempty"`
+}
+
+// CalendarAttendee is an ORGANIZER or ATTENDEE with its main parameters
+type CalendarAttendee struct {
+	Address  string `json:"address"`
+	Name     string `json:"name,omitempty"`
+	Role     string `json:"role,omitempty"`
+	PartStat string `json:"partstat,omitempty"`
+}
+
+// ParseCalendar parses iCalendar text (RFC 5545) into its method and
+// events. contentTypeMethod is the method= parameter of the part's
+// Content-Type, used when the text has no METHOD property. Properties of
+// nested components such as VALARM are ignored.
+func ParseCalendar(text string, contentTypeMethod string) *Calendar {
+	calendar := &Calendar{Events: []CalendarEvent{}}
+
+	var event *CalendarEvent
+	nested := 0 // Depth of components inside the current VEVENT
+	for _, line := range unfoldCalendar(text) {
+		name, params, value := parseCalendarLine(line)
+		switch {
+		case name == "BEGIN" && event == nil && strings.EqualFold(value, "VEVENT"):
+			event = &CalendarEvent{}
+		case name == "BEGIN" && event != nil:
+			nested++
+		case name == "END" && event != nil && nested > 0:
+			nested--
+		case name == "END" && event != nil:
+			calendar.Events = append(calendar.Events, *event)
+			event = nil
+		case name == "METHOD" && event == nil:
+			calendar.Method = strings.ToUpper(value)
+		case event != nil && nested == 0:
+			event.set(name, params, value)
+		}
+	}
+
+	if calendar.Method == "" {
+		calendar.Method = strings.ToUpper(contentTypeMethod)
+	}
+	return calendar
+}
+
+// set records one property of the event
+func (e *CalendarEvent) set(name string, params map[string]string, value string) {
+	switch name {
+	case "UID":
+		e.UID = value
+	case "SUMMARY":
+		e.Summary = unescapeCalendarText(value)
+	case "DESCRIPTION":
+		e.Description = unescapeCalendarText(value)
+	case "LOCATION":
+		e.Location = unescapeCalendarText(value)
+	case "DTSTART":
+		e.Start = parseCalendarTime(params, value)
+	case "DTEND":
+		e.End = parseCalendarTime(params, value)
+	case "STATUS":
+		e.Status = value
+	case "SEQUENCE":
+		e.Sequence = value
+	case "RRULE":
+		e.RRule = value
+	case "ORGANIZER":
+		organizer := parseCalendarAttendee(params, value)
+		e.Organizer = &organizer
+	case "ATTENDEE":
+		e.Attendees = append(e.Attendees, parseCalendarAttendee(params, value))
+	}
+}
+
+// unfoldCalendar splits iCalendar text into logical lines, joining folded
+// continuation lines that start with a space or tab
+func unfoldCalendar(text string) []string {
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// parseCalendarLine splits a content line such as
+// "DTSTART;TZID=Europe/Berlin:20240102T150000" into its upper-cased name,
+// parameters and value. Quoted parameter values may contain ';' and ':'.
+func parseCalendarLine(line string) (string, map[string]string, string) {
+	params := make(map[string]string)
+
+	// Find the colon that ends the name and parameters
+	end, quoted := -1, false
+	for i := 0; i < len(line) && end < 0; i++ {
+		switch line[i] {
+		case '"':
+			quoted = !quoted
+		case ':':
+			if !quoted {
+				end = i
+			}
+		}
+	}
+	if end < 0 {
+		return strings.ToUpper(line), params, ""
+	}
+
+	fields := splitCalendarParams(line[:end])
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		params[strings.ToUpper(key)] = strings.Trim(value, `"`)
+	}
+	return strings.ToUpper(fields[0]), params, line[end+1:]
+}
+
+// splitCalendarParams splits a name and its parameters at semicolons
+// outside quoted values
+func splitCalendarParams(s string) []string {
+	var fields []string
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case ';':
+			if !quoted {
+				fields = append(fields, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(fields, s[start:])
+}
+
+// unescapeCalendarText resolves the backslash escapes of TEXT values
+func unescapeCalendarText(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			sb.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n', 'N':
+			sb.WriteByte('\n')
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+	return sb.String()
+}
+
+// parseCalendarTime parses a DATE or DATE-TIME value, resolving it to an
+// instant where possible
+func parseCalendarTime(params map[string]string, value string) *CalendarTime {
+	ct := &CalendarTime{Value: value, TZID: params["TZID"]}
+
+	if params["VALUE"] == "DATE" || len(value) == len("20060102") {
+		ct.AllDay = true
+		if t, err := time.Parse("20060102", value); err == nil {
+			ct.Time = &t
+		}
+		return ct
+	}
+
+	if strings.HasSuffix(value, "Z") {
+		if t, err := time.Parse("20060102T150405Z", value); err == nil {
+			ct.Time = &t
+		}
+		return ct
+	}
+
+	if ct.TZID != "" {
+		if loc, err := time.LoadLocation(ct.TZID); err == nil {
+			if t, err := time.ParseInLocation("20060102T150405", value, loc); err == nil {
+				ct.Time = &t
+			}
+		}
+	}
+	return ct
+}
+
+// parseCalendarAttendee parses an ORGANIZER or ATTENDEE value such as
+// "mailto:jane@example.com" with its CN, ROLE and PARTSTAT parameters
+func parseCalendarAttendee(params map[string]string, value string) CalendarAttendee {
+	address := value
+	if len(address) >= len("mailto:") && strings.EqualFold(address[:len("mailto:")], "mailto:") {
+		address = address[len("mailto:"):]
+	}
+
+	return CalendarAttendee{
+		Address:  address,
+		Name:     params["CN"],
+		Role:     params["ROLE"],
+		PartStat: params["PARTSTAT"],
+	}
+}
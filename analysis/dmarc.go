@@ -0,0 +1,162 @@
+package analysis
+
+import (
+	"bufio"
+	"mailer/models"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// DMARCReport is a diagnostic evaluation of DMARC alignment for an email
+type DMARCReport struct {
+	FromDomain    string     `json:"fromDomain"`
+	AlignmentMode string     `json:"alignmentMode"`
+	DKIM          AuthResult `json:"dkim"`
+	SPF           AuthResult `json:"spf"`
+	Result        string     `json:"result"` // pass, fail or insufficient-data
+	Reason        string     `json:"reason"`
+}
+
+// AuthResult is the outcome of a single authentication mechanism
+type AuthResult struct {
+	Domain  string `json:"domain,omitempty"`
+	Result  string `json:"result"`           // none, unverified, or the reported result (pass, fail, ...)
+	Source  string `json:"source,omitempty"` // Where the domain and result were read from
+	Aligned bool   `json:"aligned"`
+}
+
+// EvaluateDMARC checks whether the email's DKIM or SPF identity aligns with
+// its From domain. Results come from Authentication-Results headers when an
+// upstream server added them; otherwise the DKIM-Signature d= tag and the
+// envelope sender are used as unverified identities, since mailer itself
+// does not verify signatures or query SPF records. Alignment is relaxed,
+// with the organizational domain approximated as the last two labels.
+func EvaluateDMARC(email *models.Email) *DMARCReport {
+	header := ParseRawHeaders(email.RawHeaders)
+
+	report := &DMARCReport{
+		FromDomain:    domainOf(email.From),
+		AlignmentMode: "relaxed",
+		DKIM:          AuthResult{Result: "none"},
+		SPF:           AuthResult{Result: "none"},
+	}
+
+	// Prefer results reported by an upstream verifier
+	for _, value := range header.Values("Authentication-Results") {
+		for _, clause := range strings.Split(value, ";") {
+			method, result, props := parseResultClause(clause)
+			switch {
+			case method == "dkim" && report.DKIM.Source == "":
+				report.DKIM = AuthResult{Domain: props["header.d"], Result: result, Source: "authentication-results"}
+			case method == "spf" && report.SPF.Source == "":
+				report.SPF = AuthResult{Domain: domainOf(props["smtp.mailfrom"]), Result: result, Source: "authentication-results"}
+			}
+		}
+	}
+
+	// Fall back to unverified identities
+	if report.DKIM.Source == "" {
+		if signature := header.Get("DKIM-Signature"); signature != "" {
+			report.DKIM = AuthResult{Domain: dkimTag(signature, "d"), Result: "unverified", Source: "dkim-signature"}
+		}
+	}
+	if report.SPF.Source == "" && email.EnvelopeFrom != "" {
+		report.SPF = AuthResult{Domain: domainOf(email.EnvelopeFrom), Result: "unverified", Source: "envelope"}
+	}
+
+	report.DKIM.Aligned = aligned(report.DKIM.Domain, report.FromDomain)
+	report.SPF.Aligned = aligned(report.SPF.Domain, report.FromDomain)
+
+	switch {
+	case report.FromDomain == "":
+		report.Result = "insufficient-data"
+		report.Reason = "From header has no parseable domain"
+	case (report.DKIM.Result == "pass" && report.DKIM.Aligned) || (report.SPF.Result == "pass" && report.SPF.Aligned):
+		report.Result = "pass"
+		report.Reason = "a passing identity aligns with the From domain"
+	case isVerified(report.DKIM.Result) || isVerified(report.SPF.Result):
+		report.Result = "fail"
+		report.Reason = "no passing DKIM or SPF identity aligns with the From domain"
+	case report.DKIM.Result == "none" && report.SPF.Result == "none":
+		report.Result = "insufficient-data"
+		report.Reason = "no DKIM signature, envelope sender or Authentication-Results header"
+	default:
+		report.Result = "insufficient-data"
+		report.Reason = "identities are present but unverified; alignment shows whether DMARC would pass once they verify"
+	}
+
+	return report
+}
+
+// ParseRawHeaders parses the stored "Key: value" header lines
+func ParseRawHeaders(raw string) textproto.MIMEHeader {
+	r := textproto.NewReader(bufio.NewReader(strings.NewReader(raw + "\r\n")))
+	header, _ := r.ReadMIMEHeader()
+	return header
+}
+
+// parseResultClause splits an Authentication-Results clause such as
+// "dkim=pass header.d=example.com" into method, result and properties
+func parseResultClause(clause string) (string, string, map[string]string) {
+	fields := strings.Fields(clause)
+	if len(fields) == 0 {
+		return "", "", nil
+	}
+
+	method, result, ok := strings.Cut(fields[0], "=")
+	if !ok {
+		return "", "", nil
+	}
+
+	props := make(map[string]string)
+	for _, field := range fields[1:] {
+		if key, value, ok := strings.Cut(field, "="); ok {
+			props[strings.ToLower(key)] = strings.Trim(value, `"`)
+		}
+	}
+
+	return strings.ToLower(method), strings.ToLower(result), props
+}
+
+// dkimTag returns the value of a tag in a DKIM-Signature header
+func dkimTag(signature, name string) string {
+	for _, tag := range strings.Split(signature, ";") {
+		key, value, ok := strings.Cut(tag, "=")
+		if ok && strings.TrimSpace(key) == name {
+			return strings.ToLower(strings.TrimSpace(value))
+		}
+	}
+	return ""
+}
+
+// domainOf returns the lowercased domain of an address or bare domain
+func domainOf(addr string) string {
+	if parsed, err := mail.ParseAddress(addr); err == nil {
+		addr = parsed.Address
+	}
+	if at := strings.LastIndex(addr, "@"); at >= 0 {
+		addr = addr[at+1:]
+	}
+	return strings.ToLower(strings.Trim(strings.TrimSpace(addr), "<>"))
+}
+
+// aligned reports relaxed alignment between two domains
+func aligned(domain, fromDomain string) bool {
+	return domain != "" && fromDomain != "" && organizationalDomain(domain) == organizationalDomain(fromDomain)
+}
+
+// organizationalDomain approximates the organizational domain as the last
+// two labels
+func organizationalDomain(domain string) string {
+	labels := strings.Split(domain, ".")
+	if len(labels) <= 2 {
+		return domain
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
+
+// isVerified reports whether a result came from an actual verification
+func isVerified(result string) bool {
+	return result != "none" && result != "unverified"
+}
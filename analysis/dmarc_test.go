@@ -0,0 +1,74 @@
+package analysis
+
+import (
+	"mailer/models"
+	"testing"
+)
+
+func TestEvaluateDMARC(t *testing.T) {
+	tests := []struct {
+		name         string
+		from         string
+		envelopeFrom string
+		headers      string // Stored as RawHeaders, one "Key: value" per line
+		result       string
+		dkimAligned  bool
+		spfAligned   bool
+	}{
+		{
+			name:    "aligned DKIM pass",
+			from:    "Jane <jane@example.com>",
+			headers: "Authentication-Results: mx.test; dkim=pass header.d=mail.example.com; spf=fail smtp.mailfrom=bounce@other.test\n",
+			result:  "pass", dkimAligned: true,
+		},
+		{
+			name:    "aligned SPF pass",
+			from:    "jane@example.com",
+			headers: "Authentication-Results: mx.test; dkim=fail header.d=other.test; spf=pass smtp.mailfrom=bounce@example.com\n",
+			result:  "pass", spfAligned: true,
+		},
+		{
+			name:    "passing but misaligned",
+			from:    "jane@example.com",
+			headers: "Authentication-Results: mx.test; dkim=pass header.d=esp.test; spf=pass smtp.mailfrom=bounce@esp.test\n",
+			result:  "fail",
+		},
+		{
+			name:    "aligned but failing",
+			from:    "jane@example.com",
+			headers: "Authentication-Results: mx.test; dkim=fail header.d=example.com\n",
+			result:  "fail", dkimAligned: true,
+		},
+		{
+			name:         "unverified identities",
+			from:         "jane@example.com",
+			envelopeFrom: "bounce@example.com",
+			headers:      "DKIM-Signature: v=1; a=rsa-sha256; d=Example.com; s=sel; b=abc\n",
+			result:       "insufficient-data", dkimAligned: true, spfAligned: true,
+		},
+		{
+			name:   "no identities",
+			from:   "jane@example.com",
+			result: "insufficient-data",
+		},
+		{
+			name:         "no From domain",
+			from:         "",
+			envelopeFrom: "bounce@example.com",
+			result:       "insufficient-data",
+		},
+	}
+
+	for _, tt := range tests {
+		report := EvaluateDMARC(&models.Email{From: tt.from, EnvelopeFrom: tt.envelopeFrom, RawHeaders: tt.headers})
+		if report.Result != tt.result {
+			t.Errorf("%s: result = %q (%s), want %q", tt.name, report.Result, report.Reason, tt.result)
+		}
+		if report.DKIM.Aligned != tt.dkimAligned || report.SPF.Aligned != tt.spfAligned {
+			t.Errorf("%s: aligned DKIM %v SPF %v, want %v and %v", tt.name, report.DKIM.Aligned, report.SPF.Aligned, tt.dkimAligned, tt.spfAligned)
+		}
+		if report.AlignmentMode != "relaxed" {
+			t.Errorf("%s: alignment mode = %q, want relaxed", tt.name, report.AlignmentMode)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package analysis
+
+import (
+	"mailer/models"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	// scriptTagPattern matches an opening <script> tag
+	scriptTagPattern = regexp.MustCompile(`(?i)<script\b`)
+
+	// eventHandlerPattern matches an inline on* event handler attribute inside a tag
+	eventHandlerPattern = regexp.MustCompile(`(?i)<[a-z][^>]*?\s(on[a-z]+)\s*=`)
+
+	// javascriptURLPattern matches a javascript: URL in an attribute value,
+	// allowing the embedded whitespace browsers tolerate
+	javascriptURLPattern = regexp.MustCompile(`(?i)=\s*["']?\s*j\s*a\s*v\s*a\s*s\s*c\s*r\s*i\s*p\s*t\s*:`)
+)
+
+// ScanHTML records dangerous constructs found in the email's HTML body in
+// SecurityFlags, leaving the body itself untouched. Flags are "script-tag",
+// "javascript-url" and "event-handler:<name>" for each distinct handler.
+func ScanHTML(email *models.Email) {
+	if email.HTMLBody == "" {
+		return
+	}
+
+	var flags []string
+	if scriptTagPattern.MatchString(email.HTMLBody) {
+		flags = append(flags, "script-tag")
+	}
+	if javascriptURLPattern.MatchString(email.HTMLBody) {
+		flags = append(flags, "javascript-url")
+	}
+
+	handlers := make(map[string]bool)
+	for _, match := range eventHandlerPattern.FindAllStringSubmatch(email.HTMLBody, -1) {
+		handlers[strings.ToLower(match[1])] = true
+	}
+	names := make([]string, 0, len(handlers))
+	for name := range handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		flags = append(flags, "event-handler:"+name)
+	}
+
+	email.SecurityFlags = flags
+}
@@ -0,0 +1,83 @@
+package analysis
+
+import (
+	"html"
+	"mailer/models"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	// anchorPattern matches an anchor, capturing its double- or single-quoted
+	// href and its inner HTML
+	anchorPattern = regexp.MustCompile(`(?is)<a\b[^>]*?\bhref\s*=\s*(?:"([^"]*)"|'([^']*)')[^>]*>(.*?)</a\s*>`)
+
+	// tagPattern matches any HTML tag, for reducing anchor content to text
+	tagPattern = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+// checkLinkMismatches reports anchors whose visible text is a URL on a
+// different host than the href points to
+func checkLinkMismatches(email *models.Email) []Finding {
+	var findings []Finding
+
+	for _, match := range anchorPattern.FindAllStringSubmatch(email.HTMLBody, -1) {
+		href := untrackedURL(html.UnescapeString(match[1] + match[2]))
+		text := strings.TrimSpace(html.UnescapeString(tagPattern.ReplaceAllString(match[3], "")))
+
+		textHost := displayedHost(text)
+		if textHost == "" {
+			continue
+		}
+		hrefURL, err := url.Parse(href)
+		if err != nil || (hrefURL.Scheme != "http" && hrefURL.Scheme != "https") {
+			continue
+		}
+
+		if hrefHost := normalizeHost(hrefURL.Hostname()); hrefHost != textHost {
+			findings = append(findings, Finding{
+				Check:    "link-mismatch",
+				Severity: SeverityWarning,
+				Message:  "Link text shows " + textHost + " but points to " + hrefHost,
+				Details:  map[string]string{"text": text, "href": href},
+			})
+		}
+	}
+
+	return findings
+}
+
+// displayedHost returns the host of link text that looks like a URL, or ""
+func displayedHost(text string) string {
+	lower := strings.ToLower(text)
+	if strings.HasPrefix(lower, "www.") {
+		text = "http://" + text
+	} else if !strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "https://") {
+		return ""
+	}
+
+	u, err := url.Parse(text)
+	if err != nil {
+		return ""
+	}
+	return normalizeHost(u.Hostname())
+}
+
+// untrackedURL returns the original target of a link rewritten through
+// mailer's /api/click endpoint, or href unchanged
+func untrackedURL(href string) string {
+	u, err := url.Parse(href)
+	if err != nil || !strings.HasSuffix(u.Path, "/api/click") {
+		return href
+	}
+	if target := u.Query().Get("url"); target != "" {
+		return target
+	}
+	return href
+}
+
+// normalizeHost lowercases a host and drops a leading "www."
+func normalizeHost(host string) string {
+	return strings.TrimPrefix(strings.ToLower(host), "www.")
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"mailer/models"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// emlBoundary separates the text and HTML parts of a reconstructed message
+const emlBoundary = "mailer-alternative"
+
+// writeEML writes a reconstructed RFC 5322 message for email. Only the
+// decoded bodies are stored, so the original MIME layout and transfer
+// encodings can't be restored: the text and HTML bodies are written as a
+// quoted-printable multipart/alternative, or a single part if only one exists.
+func writeEML(w io.Writer, email *models.Email) error {
+	var sb strings.Builder
+	if email.MessageID != "" {
+		fmt.Fprintf(&sb, "Message-ID: <%s>\r\n", strings.Trim(email.MessageID, "<>"))
+	}
+	fmt.Fprintf(&sb, "From: %s\r\n", email.From)
+	fmt.Fprintf(&sb, "To: %s\r\n", models.FormatAddressList(email.To))
+	fmt.Fprintf(&sb, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", email.Subject))
+	fmt.Fprintf(&sb, "Date: %s\r\n", email.Date.Format(time.RFC1123Z))
+	sb.WriteString("MIME-Version: 1.0\r\n")
+
+	// HTML generated by -wrap-text was never part of the message
+	html := email.HTMLBody
+	if email.GeneratedHTML {
+		html = ""
+	}
+
+	if email.Body != "" && html != "" {
+		fmt.Fprintf(&sb, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", emlBoundary)
+		writeEMLPart(&sb, "text/plain", email.Body)
+		writeEMLPart(&sb, "text/html", html)
+		fmt.Fprintf(&sb, "--%s--\r\n", emlBoundary)
+	} else {
+		contentType, body := "text/plain", email.Body
+		if html != "" {
+			contentType, body = "text/html", html
+		}
+		fmt.Fprintf(&sb, "Content-Type: %s; charset=utf-8\r\n", contentType)
+		sb.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		writeQuotedPrintable(&sb, body)
+	}
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// writeEMLPart writes one part of a multipart/alternative message
+func writeEMLPart(sb *strings.Builder, contentType string, body string) {
+	fmt.Fprintf(sb, "--%s\r\n", emlBoundary)
+	fmt.Fprintf(sb, "Content-Type: %s; charset=utf-8\r\n", contentType)
+	sb.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	writeQuotedPrintable(sb, body)
+	sb.WriteString("\r\n")
+}
+
+// writeQuotedPrintable writes body quoted-printable encoded with CRLF line
+// endings
+func writeQuotedPrintable(sb *strings.Builder, body string) {
+	body = strings.ReplaceAll(body, "\r\n", "\n")
+	qp := quotedprintable.NewWriter(sb)
+	qp.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n")))
+	qp.Close()
+}
+
+// maxSlugLength caps the subject part of a downloaded file name
+const maxSlugLength = 50
+
+// subjectSlug turns a subject into a lowercase, hyphen-separated file name
+// fragment such as "welcome-to-mailer", or "no-subject" if nothing is left
+func subjectSlug(subject string) string {
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(subject); err == nil {
+		subject = decoded
+	}
+
+	var sb strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(subject) {
+		if r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			hyphen = sb.Len() > 0
+			continue
+		}
+		if hyphen {
+			sb.WriteByte('-')
+			hyphen = false
+		}
+		if sb.Len() >= maxSlugLength {
+			break
+		}
+		sb.WriteRune(r)
+	}
+
+	slug := strings.TrimRight(sb.String(), "-")
+	if slug == "" {
+		return "no-subject"
+	}
+	return slug
+}
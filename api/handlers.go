@@ -1,34 +1,77 @@
 package api
 
 import (
+	"archive/zip"
+	"crypto/subtle"
 	"embed"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/fs"
 	"log"
+	"mailer/analysis"
+	"mailer/hooks"
+	"mailer/models"
 	"mailer/storage"
+	"maps"
+	"math/rand/v2"
 	"net/http"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 //go:embed web/*
 var webFS embed.FS
 
+// Options configures optional API behavior
+type Options struct {
+	Latency time.Duration // Artificial delay added before handling each request
+	Jitter  time.Duration // Random extra delay of up to this much on top of Latency
+	Keys    []string      // API keys accepted in the X-Mailer-Key header, each with its own partition
+
+	// AdminKey is required in the X-Mailer-Admin-Key header by
+	// /api/admin/config, which is disabled without one
+	AdminKey string
+
+	// BasePath mounts the UI and API under a path prefix such as "/mailer"
+	// ("" = root). It must start with a slash and not end with one.
+	BasePath string
+
+	// Audit records deletions for /api/audit (nil = disabled)
+	Audit *storage.AuditLog
+
+	// Extensions advertised by the SMTP and IMAP servers, served by
+	// /api/capabilities
+	SMTPCapabilities []string
+	IMAPCapabilities []string
+}
+
 // Handler provides HTTP handlers for the API
 type Handler struct {
-	store    *storage.Store
-	smtpAddr string
-	imapAddr string
-	httpAddr string
+	store       *storage.Store
+	connections *storage.ConnectionRegistry
+	smtpAddr    string
+	imapAddr    string
+	httpAddr    string
+	opts        Options
 }
 
 // NewHandler creates a new API handler
-func NewHandler(store *storage.Store, smtpAddr string, imapAddr string, httpAddr string) *Handler {
+func NewHandler(store *storage.Store, connections *storage.ConnectionRegistry, smtpAddr string, imapAddr string, httpAddr string, opts Options) *Handler {
 	return &Handler{
-		store:    store,
-		smtpAddr: smtpAddr,
-		imapAddr: imapAddr,
-		httpAddr: httpAddr,
+		store:       store,
+		connections: connections,
+		smtpAddr:    smtpAddr,
+		imapAddr:    imapAddr,
+		httpAddr:    httpAddr,
+		opts:        opts,
 	}
 }
 
@@ -38,14 +81,68 @@ func (h *Handler) SetupRoutes() http.Handler {
 
 	// API routes
 	mux.HandleFunc("/api/config", h.handleConfig)
+	mux.HandleFunc("/api/capabilities", h.handleCapabilities)
+	mux.HandleFunc("/api/connections", h.handleConnections)
+	mux.HandleFunc("/api/audit", h.handleAudit)
+	mux.HandleFunc("/api/admin/config", h.handleAdminConfig)
+	mux.HandleFunc("/api/click", h.handleClick)
+	mux.HandleFunc("/api/open", h.handleOpen)
+	mux.HandleFunc("/api/senders", h.handleSenders)
+	mux.HandleFunc("/api/recipients", h.handleRecipients)
 	mux.HandleFunc("/api/emails", h.handleEmails)
-	mux.HandleFunc("/api/emails/", h.handleEmailByID)
+	mux.HandleFunc("/api/emails/count", h.handleCount)
+	mux.HandleFunc("/api/emails/latest", h.handleLatest)
+	mux.HandleFunc("/api/emails/bulk", h.handleBulk)
+	mux.HandleFunc("/api/emails/grouped", h.handleGrouped)
+	mux.HandleFunc("/api/emails/download", h.handleDownload)
+	mux.HandleFunc("/api/emails/{id}", withEmailID("", h.handleEmailByID))
+	mux.HandleFunc("/api/emails/{id}/structure", withEmailID(http.MethodGet, h.getEmailStructure))
+	mux.HandleFunc("/api/emails/{id}/analysis", withEmailID(http.MethodGet, h.getEmailAnalysis))
+	mux.HandleFunc("/api/emails/{id}/dmarc", withEmailID(http.MethodGet, h.getEmailDMARC))
+	mux.HandleFunc("/api/emails/{id}/calendar", withEmailID(http.MethodGet, h.getEmailCalendar))
+	mux.HandleFunc("/api/emails/{id}/headers", withEmailID(http.MethodGet, h.getEmailHeaders))
+	mux.HandleFunc("/api/emails/{id}/replay", withEmailID(http.MethodPost, h.replayEmail))
+	mux.HandleFunc("/api/emails/{id}/clicks", withEmailID(http.MethodGet, h.getEmailClicks))
+	mux.HandleFunc("/api/emails/{id}/opens", withEmailID(http.MethodGet, h.getEmailOpens))
+
+	// Static files from embedded filesystem, or an explanation for builds
+	// whose web assets were trimmed
+	webContent, err := fs.Sub(webFS, "web")
+	if err == nil {
+		_, err = fs.Stat(webContent, "index.html")
+	}
+	if err != nil {
+		log.Printf("Web interface assets not found (%v), serving the API only", err)
+		mux.HandleFunc("/", handleMissingUI)
+	} else {
+		mux.Handle("/", http.FileServer(http.FS(webContent)))
+	}
+
+	var handler http.Handler = mux
+	if base := h.opts.BasePath; base != "" {
+		// Routes are registered at the root and mounted under the base path;
+		// the web UI uses relative URLs so it works either way
+		mounted := http.NewServeMux()
+		mounted.Handle(base+"/", http.StripPrefix(base, mux))
+		mounted.Handle(base, http.RedirectHandler(base+"/", http.StatusMovedPermanently))
+		handler = mounted
+	}
+
+	return h.clientCertLogMiddleware(h.corsMiddleware(h.latencyMiddleware(handler)))
+}
 
-	// Static files from embedded filesystem
-	webContent, _ := fs.Sub(webFS, "web")
-	mux.Handle("/", http.FileServer(http.FS(webContent)))
+// handleMissingUI answers requests for the web interface in builds without
+// its assets
+func handleMissingUI(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
 
-	return h.corsMiddleware(mux)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintln(w, "The web interface is not included in this build of mailer.")
+	fmt.Fprintln(w, "The REST API is available under api/, e.g. GET api/emails to list captured emails.")
 }
 
 // handleConfig returns server configuration
@@ -61,8 +158,154 @@ func (h *Handler) handleConfig(w http.ResponseWriter, r *http.Request) {
 		"httpAddr": h.httpAddr,
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(config)
+	writeJSON(w, r, config)
+}
+
+// restartSettings are settings that bind or wrap listeners or load
+// certificates at startup and so can't be changed through /api/admin/config
+var restartSettings = []string{
+	"smtp-addr", "imap-addr", "http-addr", "base-path",
+	"http-tls-cert", "http-tls-key", "http-client-ca",
+	"disable-vrfy", "valid-recipients",
+}
+
+// runtimeConfig holds the settings that can be changed while running
+type runtimeConfig struct {
+	Retention string `json:"retention"`
+}
+
+// handleAdminConfig returns (GET) or updates (POST) the settings that can
+// be changed without a restart. A POST body such as {"retention": "30m"}
+// is validated as a whole before anything is applied, so a request naming
+// an unknown or restart-only setting changes nothing.
+func (h *Handler) handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	// Server-wide settings are never open to anyone who can reach the port
+	if h.opts.AdminKey == "" {
+		http.Error(w, "Admin endpoint disabled, start mailer with -admin-key", http.StatusNotFound)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Mailer-Admin-Key")), []byte(h.opts.AdminKey)) != 1 {
+		http.Error(w, "Invalid admin key", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var settings map[string]json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			http.Error(w, "Request body must be a JSON object of settings", http.StatusBadRequest)
+			return
+		}
+
+		var retention *time.Duration
+		for name, value := range settings {
+			switch {
+			case name == "retention":
+				var s string
+				if err := json.Unmarshal(value, &s); err != nil {
+					http.Error(w, "Invalid retention, expected a duration such as \"1h\"", http.StatusBadRequest)
+					return
+				}
+				d, err := time.ParseDuration(s)
+				if err != nil || d < 0 {
+					http.Error(w, "Invalid retention, expected a duration such as \"1h\"", http.StatusBadRequest)
+					return
+				}
+				retention = &d
+			case slices.Contains(restartSettings, name):
+				http.Error(w, fmt.Sprintf("Setting %s can't be changed without a restart", name), http.StatusConflict)
+				return
+			default:
+				http.Error(w, fmt.Sprintf("Unknown setting %s", name), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if retention != nil {
+			h.store.SetRetention(*retention)
+			log.Printf("Retention changed to %s", *retention)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, r, runtimeConfig{Retention: h.store.Retention().String()})
+}
+
+// handleCapabilities returns the extensions advertised by the SMTP and IMAP
+// servers with the active configuration
+func (h *Handler) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, r, map[string][]string{
+		"smtp": h.opts.SMTPCapabilities,
+		"imap": h.opts.IMAPCapabilities,
+	})
+}
+
+// handleConnections returns the currently open SMTP and IMAP sessions
+func (h *Handler) handleConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, r, h.connections.GetAll())
+}
+
+// handleAudit returns the audit log entries of the caller's partition,
+// oldest first
+func (h *Handler) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.opts.Audit == nil {
+		http.Error(w, "Audit log is disabled, start mailer with -audit", http.StatusNotFound)
+		return
+	}
+
+	partition, ok := h.partition(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, r, h.opts.Audit.GetAll(partition.Key()))
+}
+
+// handleSenders returns the distinct senders with their message counts
+func (h *Handler) handleSenders(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	partition, ok := h.partition(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, r, partition.Senders())
+}
+
+// handleRecipients returns the distinct recipients with their message counts
+func (h *Handler) handleRecipients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	partition, ok := h.partition(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, r, partition.Recipients())
 }
 
 // handleEmails handles GET (list all) and DELETE (delete all)
@@ -77,16 +320,8 @@ func (h *Handler) handleEmails(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// handleEmailByID handles GET (single email) and DELETE (single email)
-func (h *Handler) handleEmailByID(w http.ResponseWriter, r *http.Request) {
-	// Extract ID from path
-	path := strings.TrimPrefix(r.URL.Path, "/api/emails/")
-	id, err := strconv.Atoi(path)
-	if err != nil {
-		http.Error(w, "Invalid email ID", http.StatusBadRequest)
-		return
-	}
-
+// handleEmailByID gets or deletes a specific email
+func (h *Handler) handleEmailByID(w http.ResponseWriter, r *http.Request, id int) {
 	switch r.Method {
 	case http.MethodGet:
 		h.getEmail(w, r, id)
@@ -97,40 +332,1104 @@ func (h *Handler) handleEmailByID(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// listEmails returns all emails
+// withEmailID adapts a handler taking an email ID to the {id} wildcard of
+// its route, allowing only method ("" = any, checked by next). Methods
+// aren't part of the route patterns since the web UI's catch-all route
+// would answer them with 404 instead of 405.
+func withEmailID(method string, next func(http.ResponseWriter, *http.Request, int)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if method != "" && r.Method != method {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid email ID", http.StatusBadRequest)
+			return
+		}
+		next(w, r, id)
+	}
+}
+
+// listEmails returns all emails matching the filter query parameters
 func (h *Handler) listEmails(w http.ResponseWriter, r *http.Request) {
-	emails := h.store.GetAll()
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(emails)
+	filter, err := h.parseEmailFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	partition, ok := h.partition(w, r)
+	if !ok {
+		return
+	}
+
+	if notModified(w, r, h.store.LastModified(), h.store.Now()) {
+		return
+	}
+
+	sortKey := r.URL.Query().Get("sort")
+	if sortKey == "" {
+		sortKey = defaultSort
+	}
+	compare, ok := models.EmailComparator(sortKey)
+	if !ok {
+		http.Error(w, "Invalid sort key, expected date, from or subject with an optional - prefix", http.StatusBadRequest)
+		return
+	}
+
+	emails := partition.Filter(filter.matches)
+	slices.SortFunc(emails, compare)
+	writeEmailsJSON(w, r, http.StatusOK, h.withReadState(emails))
 }
 
-// getEmail returns a specific email by ID
-func (h *Handler) getEmail(w http.ResponseWriter, r *http.Request, id int) {
-	email, exists := h.store.GetByID(id)
-	if !exists {
-		http.Error(w, "Email not found", http.StatusNotFound)
+// withReadState returns copies of emails with Read filled in from the
+// store's \Seen flags, leaving the stored emails untouched
+func (h *Handler) withReadState(emails []*models.Email) []*models.Email {
+	seen := h.store.EmailIDsWithFlag(storage.SeenFlag)
+	copies := make([]*models.Email, len(emails))
+	for i, email := range emails {
+		email := *email
+		email.Read = seen[email.ID]
+		copies[i] = &email
+	}
+	return copies
+}
+
+// notModified sets the Last-Modified header for a response reflecting the
+// store as of modified, and answers 304 if the request's If-Modified-Since
+// shows the client already has it. HTTP dates have one-second resolution,
+// so no Last-Modified is sent during the second of the last change: a later
+// change in that same second would otherwise go unnoticed.
+func notModified(w http.ResponseWriter, r *http.Request, modified time.Time, now time.Time) bool {
+	modified = modified.Truncate(time.Second)
+	if !now.Truncate(time.Second).After(modified) {
+		return false
+	}
+
+	w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.After(since) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// defaultSort is the email list order when no sort parameter is given
+const defaultSort = "-date"
+
+// handleCount returns the number of emails matching the filter query
+// parameters without transferring them
+func (h *Handler) handleCount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(email)
+	filter, err := h.parseEmailFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	partition, ok := h.partition(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, r, map[string]int{"count": partition.CountWhere(filter.matches)})
 }
 
-// deleteEmail deletes a specific email
-func (h *Handler) deleteEmail(w http.ResponseWriter, r *http.Request, id int) {
-	if h.store.Delete(id) {
-		w.WriteHeader(http.StatusNoContent)
-		log.Printf("Email %d deleted", id)
+// handleLatest returns the most recent email matching the filter query
+// parameters, or with ?n=N the Nth most recent, in the list's default order
+func (h *Handler) handleLatest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	n := 1
+	if value := r.URL.Query().Get("n"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			http.Error(w, "Invalid n, expected a positive integer", http.StatusBadRequest)
+			return
+		}
+		n = parsed
+	}
+
+	filter, err := h.parseEmailFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	partition, ok := h.partition(w, r)
+	if !ok {
+		return
+	}
+
+	email, found := partition.Latest(n, filter.matches)
+	if !found {
+		http.Error(w, "No matching email found", http.StatusNotFound)
+		return
+	}
+
+	writeEmailsJSON(w, r, http.StatusOK, h.withReadState([]*models.Email{email})[0])
+}
+
+// emailGroup is a set of emails sharing a normalized subject
+type emailGroup struct {
+	Subject string `json:"subject"`
+	Count   int    `json:"count"`
+	IDs     []int  `json:"ids"` // Oldest first
+
+	latest *models.Email // Most recently received member
+}
+
+// handleGrouped returns the emails matching the filter query parameters
+// grouped by normalized subject (?by=subject, the only and default
+// grouping), which approximates threads for senders that don't set
+// References headers. Groups with the most recent activity come first.
+func (h *Handler) handleGrouped(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if by := r.URL.Query().Get("by"); by != "" && by != "subject" {
+		http.Error(w, "Invalid by parameter, expected subject", http.StatusBadRequest)
+		return
+	}
+
+	filter, err := h.parseEmailFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	partition, ok := h.partition(w, r)
+	if !ok {
+		return
+	}
+
+	byDate, _ := models.EmailComparator("date")
+	emails := partition.Filter(filter.matches)
+	slices.SortFunc(emails, byDate)
+
+	// Subjects differing only in case share a group named after the oldest
+	groups := []*emailGroup{}
+	index := make(map[string]*emailGroup)
+	for _, email := range emails {
+		subject := normalizeSubject(email.Subject)
+		key := strings.ToLower(subject)
+		group, exists := index[key]
+		if !exists {
+			group = &emailGroup{Subject: subject}
+			index[key] = group
+			groups = append(groups, group)
+		}
+		group.Count++
+		group.IDs = append(group.IDs, email.ID)
+		group.latest = email
+	}
+
+	slices.SortStableFunc(groups, func(a, b *emailGroup) int {
+		return byDate(b.latest, a.latest)
+	})
+
+	writeJSON(w, r, groups)
+}
+
+// replyPrefixPattern matches one leading reply or forward marker such as
+// "Re:", "RE[2]:", "Fwd:" or "Fw:"
+var replyPrefixPattern = regexp.MustCompile(`(?i)^(re|fwd?)(\[\d+\])?\s*:\s*`)
+
+// normalizeSubject strips any number of reply and forward prefixes and
+// collapses whitespace, so "Re: Fwd:  Re: Hi" becomes "Hi"
+func normalizeSubject(subject string) string {
+	subject = strings.Join(strings.Fields(subject), " ")
+	for {
+		stripped := replyPrefixPattern.ReplaceAllString(subject, "")
+		if stripped == subject {
+			return subject
+		}
+		subject = stripped
+	}
+}
+
+// handleDownload streams a ZIP archive with one reconstructed .eml file per
+// email, named email-<id>-<subject-slug>.eml. ?ids=1,2,3 selects the emails
+// (all when omitted); ?format=zip is the only and default format. Entries
+// are written straight to the response, so the archive is never held in
+// memory.
+func (h *Handler) handleDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	if format := query.Get("format"); format != "" && format != "zip" {
+		http.Error(w, "Invalid format parameter, expected zip", http.StatusBadRequest)
+		return
+	}
+
+	partition, ok := h.partition(w, r)
+	if !ok {
+		return
+	}
+
+	var emails []*models.Email
+	if idsParam := query.Get("ids"); idsParam != "" {
+		for _, field := range strings.Split(idsParam, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil {
+				http.Error(w, "Invalid ids parameter, expected comma-separated email IDs", http.StatusBadRequest)
+				return
+			}
+			email, exists := partition.GetByID(id)
+			if !exists {
+				http.Error(w, fmt.Sprintf("Email %d not found", id), http.StatusNotFound)
+				return
+			}
+			emails = append(emails, email)
+		}
 	} else {
-		http.Error(w, "Email not found", http.StatusNotFound)
+		emails = partition.GetAll()
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="emails.zip"`)
+
+	// Headers are sent with the first entry, so errors after this point can
+	// only cut the archive short
+	archive := zip.NewWriter(w)
+	for _, email := range emails {
+		entry, err := archive.CreateHeader(&zip.FileHeader{
+			Name:     fmt.Sprintf("email-%d-%s.eml", email.ID, subjectSlug(email.Subject)),
+			Method:   zip.Deflate,
+			Modified: email.ReceivedAt,
+		})
+		if err != nil {
+			log.Printf("Error writing download archive: %v", err)
+			return
+		}
+		if err := writeEML(entry, email); err != nil {
+			log.Printf("Error writing download archive: %v", err)
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		log.Printf("Error writing download archive: %v", err)
 	}
 }
 
-// deleteAllEmails deletes all emails
-func (h *Handler) deleteAllEmails(w http.ResponseWriter, r *http.Request) {
-	h.store.DeleteAll()
-	w.WriteHeader(http.StatusNoContent)
-	log.Printf("All emails deleted")
+// maxBulkEmails caps the number of emails accepted by one bulk request
+const maxBulkEmails = 1000
+
+// maxBulkBytes caps the body size of one bulk request
+const maxBulkBytes = 64 << 20 // 64MB
+
+// bulkResult reports the outcome for one item of a bulk request
+type bulkResult struct {
+	ID    int    `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// handleBulk saves a JSON array of emails in one store call. Items are
+// decoded one at a time; invalid items are reported in their result slot
+// while the valid ones are saved.
+func (h *Handler) handleBulk(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	partition, ok := h.partition(w, r)
+	if !ok {
+		return
+	}
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBulkBytes))
+	if token, err := dec.Token(); err != nil || token != json.Delim('[') {
+		http.Error(w, "Request body must be a JSON array of emails", http.StatusBadRequest)
+		return
+	}
+
+	var emails []*models.Email
+	var slots []int // Result index of each email in emails
+	results := make([]bulkResult, 0)
+	now := h.store.Now()
+	for dec.More() {
+		if len(results) == maxBulkEmails {
+			http.Error(w, fmt.Sprintf("Batch exceeds %d emails", maxBulkEmails), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		var email models.Email
+		if err := dec.Decode(&email); err != nil {
+			var typeErr *json.UnmarshalTypeError
+			if !errors.As(err, &typeErr) {
+				http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			results = append(results, bulkResult{Error: err.Error()})
+			continue
+		}
+
+		if err := validateBulkEmail(&email); err != nil {
+			results = append(results, bulkResult{Error: err.Error()})
+			continue
+		}
+
+		email.ID = 0
+		email.Key = partition.Key()
+		for i, to := range email.To {
+			email.To[i] = models.NormalizeAddress(to)
+		}
+		if email.ReceivedAt.IsZero() {
+			email.ReceivedAt = now
+		}
+		if email.Date.IsZero() {
+			email.Date = email.ReceivedAt
+		}
+		emails = append(emails, &email)
+		slots = append(slots, len(results))
+		results = append(results, bulkResult{})
+	}
+	if _, err := dec.Token(); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ids := h.store.SaveAll(emails)
+	for i, id := range ids {
+		results[slots[i]].ID = id
+	}
+	log.Printf("Bulk import saved %d of %d email(s)", len(ids), len(results))
+
+	writeJSON(w, r, map[string]interface{}{
+		"saved":   len(ids),
+		"results": results,
+	})
+}
+
+// validateBulkEmail checks that an imported email has a sender and recipients
+func validateBulkEmail(email *models.Email) error {
+	if strings.TrimSpace(email.From) == "" {
+		return errors.New("from is required")
+	}
+	if len(email.To) == 0 {
+		return errors.New("to is required")
+	}
+	return nil
+}
+
+// emailFilter selects emails by receive time and case-insensitive sender,
+// recipient and subject substrings. Zero values match everything.
+type emailFilter struct {
+	start   time.Time
+	end     time.Time
+	sender  string
+	to      string
+	subject string
+	ids     map[int]bool // When non-nil, only these IDs match (from header.* conditions)
+	read    *bool        // When non-nil, only read (true) or unread (false) emails match
+	seen    map[int]bool // IDs of the read emails, resolved when read is set
+}
+
+// parseEmailFilter reads the RFC3339 "from" and "until" bounds, the
+// "sender", "to" and "subject" substrings and the exact "header.X-Name"
+// values from the query. Header conditions are resolved through the store's
+// custom header index.
+func (h *Handler) parseEmailFilter(r *http.Request) (emailFilter, error) {
+	start, err := parseTimeParam(r, "from")
+	if err != nil {
+		return emailFilter{}, err
+	}
+	end, err := parseTimeParam(r, "until")
+	if err != nil {
+		return emailFilter{}, err
+	}
+
+	query := r.URL.Query()
+	filter := emailFilter{
+		start:   start,
+		end:     end,
+		sender:  strings.ToLower(query.Get("sender")),
+		to:      strings.ToLower(query.Get("to")),
+		subject: strings.ToLower(query.Get("subject")),
+	}
+
+	if value := query.Get("read"); value != "" {
+		read, err := strconv.ParseBool(value)
+		if err != nil {
+			return emailFilter{}, fmt.Errorf("Invalid read parameter, expected true or false")
+		}
+		filter.read = &read
+		filter.seen = h.store.EmailIDsWithFlag(storage.SeenFlag)
+	}
+
+	for param, values := range query {
+		name, ok := strings.CutPrefix(param, "header.")
+		if !ok {
+			continue
+		}
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if !strings.HasPrefix(name, "X-") {
+			return emailFilter{}, fmt.Errorf("Invalid %s parameter, only X- headers are indexed", param)
+		}
+		for _, value := range values {
+			ids := h.store.EmailIDsWithHeader(name, value)
+			if filter.ids == nil {
+				filter.ids = ids
+				continue
+			}
+			// Several conditions must all hold
+			maps.DeleteFunc(filter.ids, func(id int, _ bool) bool { return !ids[id] })
+		}
+	}
+
+	return filter, nil
+}
+
+// matches reports whether an email passes the filter
+func (f emailFilter) matches(email *models.Email) bool {
+	if f.ids != nil && !f.ids[email.ID] {
+		return false
+	}
+	if f.read != nil && f.seen[email.ID] != *f.read {
+		return false
+	}
+	if !f.start.IsZero() && email.ReceivedAt.Before(f.start) {
+		return false
+	}
+	if !f.end.IsZero() && email.ReceivedAt.After(f.end) {
+		return false
+	}
+	if f.sender != "" && !strings.Contains(strings.ToLower(email.From), f.sender) {
+		return false
+	}
+	if f.to != "" && !f.matchesRecipient(email) {
+		return false
+	}
+	if f.subject != "" && !strings.Contains(strings.ToLower(email.Subject), f.subject) {
+		return false
+	}
+	return true
+}
+
+// matchesRecipient reports whether any single recipient contains the "to"
+// substring, so each recipient of a shared message matches on its own
+func (f emailFilter) matchesRecipient(email *models.Email) bool {
+	for _, to := range email.To {
+		if strings.Contains(strings.ToLower(to), f.to) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTimeParam parses an optional RFC3339 query parameter, returning the
+// zero time when it is absent
+func parseTimeParam(r *http.Request, name string) (time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid %s timestamp, expected RFC3339", name)
+	}
+	return t, nil
+}
+
+// getEmail returns a specific email by ID. With ?markRead=true the email
+// is marked read first, which IMAP clients see as \Seen.
+func (h *Handler) getEmail(w http.ResponseWriter, r *http.Request, id int) {
+	partition, ok := h.partition(w, r)
+	if !ok {
+		return
+	}
+
+	email, exists := partition.GetByID(id)
+	if !exists {
+		http.Error(w, "Email not found", http.StatusNotFound)
+		return
+	}
+
+	if markRead, _ := strconv.ParseBool(r.URL.Query().Get("markRead")); markRead {
+		h.store.SetFlag(id, storage.SeenFlag, true)
+	}
+
+	writeEmailsJSON(w, r, http.StatusOK, h.withReadState([]*models.Email{email})[0])
+}
+
+// getEmailStructure returns the MIME tree of a specific email
+func (h *Handler) getEmailStructure(w http.ResponseWriter, r *http.Request, id int) {
+	partition, ok := h.partition(w, r)
+	if !ok {
+		return
+	}
+
+	email, exists := partition.GetByID(id)
+	if !exists {
+		http.Error(w, "Email not found", http.StatusNotFound)
+		return
+	}
+
+	if email.Structure == nil {
+		http.Error(w, "Email structure not available", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, r, email.Structure)
+}
+
+// headerField is an entry of the structured header list. Collapsed lists
+// group repeated headers, keeping each value in order of appearance.
+type headerField struct {
+	Name   string   `json:"name"`
+	Count  int      `json:"count"`
+	Values []string `json:"values"`
+}
+
+// getEmailHeaders returns the headers of a specific email in the order they
+// were received, one entry per header line. With ?collapseHeaders=true,
+// repeated headers such as Received share a single entry.
+func (h *Handler) getEmailHeaders(w http.ResponseWriter, r *http.Request, id int) {
+	partition, ok := h.partition(w, r)
+	if !ok {
+		return
+	}
+
+	email, exists := partition.GetByID(id)
+	if !exists {
+		http.Error(w, "Email not found", http.StatusNotFound)
+		return
+	}
+
+	// Copies with overridden headers only keep the (sorted) parsed headers
+	block := email.RawHeaderBlock
+	if block == "" {
+		block = email.RawHeaders
+	}
+	fields := parseHeaderFields(block)
+
+	if collapse, _ := strconv.ParseBool(r.URL.Query().Get("collapseHeaders")); collapse {
+		fields = collapseHeaderFields(fields)
+	}
+
+	writeJSON(w, r, fields)
+}
+
+// parseHeaderFields splits a header block into one field per header,
+// unfolding continuation lines
+func parseHeaderFields(block string) []headerField {
+	fields := []headerField{}
+	for _, line := range strings.Split(block, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(fields) > 0 {
+				last := &fields[len(fields)-1]
+				last.Values[0] += " " + strings.TrimSpace(line)
+			}
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fields = append(fields, headerField{
+			Name:   strings.TrimSpace(name),
+			Count:  1,
+			Values: []string{strings.TrimSpace(value)},
+		})
+	}
+	return fields
+}
+
+// collapseHeaderFields merges fields with the same (case-insensitive) name
+// into the position of their first occurrence
+func collapseHeaderFields(fields []headerField) []headerField {
+	collapsed := []headerField{}
+	index := make(map[string]int)
+	for _, field := range fields {
+		key := textproto.CanonicalMIMEHeaderKey(field.Name)
+		if i, ok := index[key]; ok {
+			collapsed[i].Count += field.Count
+			collapsed[i].Values = append(collapsed[i].Values, field.Values...)
+			continue
+		}
+		index[key] = len(collapsed)
+		collapsed = append(collapsed, field)
+	}
+	return collapsed
+}
+
+// getEmailAnalysis returns the findings of all analysis checks for a specific email
+func (h *Handler) getEmailAnalysis(w http.ResponseWriter, r *http.Request, id int) {
+	partition, ok := h.partition(w, r)
+	if !ok {
+		return
+	}
+
+	email, exists := partition.GetByID(id)
+	if !exists {
+		http.Error(w, "Email not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, r, map[string]interface{}{
+		"emailId":  id,
+		"findings": analysis.Analyze(email),
+	})
+}
+
+// getEmailDMARC returns a diagnostic DMARC alignment evaluation of a specific email
+func (h *Handler) getEmailDMARC(w http.ResponseWriter, r *http.Request, id int) {
+	partition, ok := h.partition(w, r)
+	if !ok {
+		return
+	}
+
+	email, exists := partition.GetByID(id)
+	if !exists {
+		http.Error(w, "Email not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, r, analysis.EvaluateDMARC(email))
+}
+
+// getEmailCalendar returns the events of a specific email's iCalendar part
+func (h *Handler) getEmailCalendar(w http.ResponseWriter, r *http.Request, id int) {
+	partition, ok := h.partition(w, r)
+	if !ok {
+		return
+	}
+
+	email, exists := partition.GetByID(id)
+	if !exists {
+		http.Error(w, "Email not found", http.StatusNotFound)
+		return
+	}
+
+	if email.Calendar == "" {
+		http.Error(w, "Email has no calendar part", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, r, analysis.ParseCalendar(email.Calendar, calendarMethod(email.Structure)))
+}
+
+// calendarMethod returns the method= Content-Type parameter of the first
+// text/calendar part in the MIME tree
+func calendarMethod(part *models.MIMEPart) string {
+	if part == nil {
+		return ""
+	}
+	if part.ContentType == "text/calendar" {
+		return part.Params["method"]
+	}
+	for _, child := range part.Parts {
+		if method := calendarMethod(child); method != "" {
+			return method
+		}
+	}
+	return ""
+}
+
+// getEmailClicks returns the tracked link clicks of a specific email
+func (h *Handler) getEmailClicks(w http.ResponseWriter, r *http.Request, id int) {
+	partition, ok := h.partition(w, r)
+	if !ok {
+		return
+	}
+
+	if _, exists := partition.GetByID(id); !exists {
+		http.Error(w, "Email not found", http.StatusNotFound)
+		return
+	}
+
+	clicks := h.store.GetClicks(id)
+	total := 0
+	for _, count := range clicks {
+		total += count
+	}
+
+	writeJSON(w, r, map[string]interface{}{
+		"emailId": id,
+		"total":   total,
+		"urls":    clicks,
+	})
+}
+
+// getEmailOpens returns the tracked opens of a specific email
+func (h *Handler) getEmailOpens(w http.ResponseWriter, r *http.Request, id int) {
+	partition, ok := h.partition(w, r)
+	if !ok {
+		return
+	}
+
+	if _, exists := partition.GetByID(id); !exists {
+		http.Error(w, "Email not found", http.StatusNotFound)
+		return
+	}
+
+	opens := h.store.GetOpens(id)
+	writeJSON(w, r, map[string]interface{}{
+		"emailId":       id,
+		"count":         opens.Count,
+		"firstOpenedAt": opens.FirstOpenedAt,
+		"lastOpenedAt":  opens.LastOpenedAt,
+	})
+}
+
+// replayEmail saves a copy of a stored email as a new capture with a fresh
+// ID and receive time. The optional JSON body {"headers": {...}} overrides
+// individual headers of the copy.
+func (h *Handler) replayEmail(w http.ResponseWriter, r *http.Request, id int) {
+	partition, ok := h.partition(w, r)
+	if !ok {
+		return
+	}
+
+	original, exists := partition.GetByID(id)
+	if !exists {
+		http.Error(w, "Email not found", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Headers map[string]string `json:"headers"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	email := original.Clone()
+	email.ReceivedAt = h.store.Now()
+	if original.ExpiresAt != nil {
+		// Keep the same time to live relative to the new receive time
+		expiresAt := email.ReceivedAt.Add(original.ExpiresAt.Sub(original.ReceivedAt))
+		email.ExpiresAt = &expiresAt
+	}
+	if len(req.Headers) > 0 {
+		overrideHeaders(email, req.Headers)
+	}
+
+	// The original already went through link rewriting, redaction and the
+	// other save hooks, which must not be applied twice
+	newID := h.store.SaveCopy(email)
+	log.Printf("Email %d replayed as %d", id, newID)
+
+	writeEmailsJSON(w, r, http.StatusCreated, email)
+}
+
+// overrideHeaders replaces headers in the email's raw headers and updates
+// the parsed fields derived from them
+func overrideHeaders(email *models.Email, overrides map[string]string) {
+	header := analysis.ParseRawHeaders(email.RawHeaders)
+	for key, value := range overrides {
+		header.Set(key, value)
+
+		switch textproto.CanonicalMIMEHeaderKey(key) {
+		case "Subject":
+			email.Subject = value
+		case "From":
+			email.From = value
+		case "To":
+			email.To = models.ParseAddressList(value)
+		case "Date":
+			if date, err := mail.ParseDate(value); err == nil {
+				email.Date = date
+			}
+		default:
+			if name := textproto.CanonicalMIMEHeaderKey(key); strings.HasPrefix(name, "X-") {
+				if email.CustomHeaders == nil {
+					email.CustomHeaders = make(map[string][]string)
+				}
+				email.CustomHeaders[name] = []string{value}
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for _, key := range keys {
+		for _, value := range header[key] {
+			fmt.Fprintf(&sb, "%s: %s\n", key, value)
+		}
+	}
+	email.RawHeaders = sb.String()
+
+	// The received header block and message no longer describe the copy
+	email.RawHeaderBlock = ""
+	email.Raw = nil
+}
+
+// handleClick records a click on a rewritten link and redirects to the
+// original URL, provided the request carries the email's tracking token and
+// the email contains a tracked link to the URL
+func (h *Handler) handleClick(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	target := r.URL.Query().Get("url")
+	lower := strings.ToLower(target)
+	if !strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "https://") {
+		http.Error(w, "Invalid url", http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(r.URL.Query().Get("emailId"))
+	if err != nil {
+		http.Error(w, "Invalid email ID", http.StatusBadRequest)
+		return
+	}
+
+	email, ok := h.trackedEmail(w, r, id)
+	if !ok {
+		return
+	}
+
+	// Only follow links the email contained, so this isn't an open redirect
+	if !hooks.IsTrackedLink(email, target) {
+		http.Error(w, "Link not found in email", http.StatusNotFound)
+		return
+	}
+
+	if h.store.RecordClick(id, target) {
+		log.Printf("Email %d link clicked: %s", id, target)
+	}
+
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// trackedEmail returns the email whose tracking URL the request carries.
+// Browsers following a link or loading the pixel send no API key, so the
+// URL's token authorizes the request in any partition instead. A missing
+// or wrong token answers 404, as for an unknown email.
+func (h *Handler) trackedEmail(w http.ResponseWriter, r *http.Request, id int) (*models.Email, bool) {
+	email, exists := h.store.GetByID(id)
+	token := r.URL.Query().Get("token")
+	if !exists || email.TrackingToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(email.TrackingToken)) != 1 {
+		http.Error(w, "Email not found", http.StatusNotFound)
+		return nil, false
+	}
+	return email, true
+}
+
+// trackingPixel is a transparent 1x1 GIF served by handleOpen
+var trackingPixel = []byte("GIF89a\x01\x00\x01\x00\x80\x00\x00\x00\x00\x00\x00\x00\x00!\xf9\x04\x01\x00\x00\x00\x00,\x00\x00\x00\x00\x01\x00\x01\x00\x00\x02\x02D\x01\x00;")
+
+// handleOpen records an open of an email's tracking pixel and serves the
+// pixel, provided the request carries the email's tracking token
+func (h *Handler) handleOpen(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.URL.Query().Get("emailId"))
+	if err != nil {
+		http.Error(w, "Invalid email ID", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := h.trackedEmail(w, r, id); !ok {
+		return
+	}
+
+	if h.store.RecordOpen(id) {
+		log.Printf("Email %d opened", id)
+	}
+
+	// Every view must reach the server to be counted
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "image/gif")
+	w.Write(trackingPixel)
+}
+
+// deleteEmail deletes a specific email
+func (h *Handler) deleteEmail(w http.ResponseWriter, r *http.Request, id int) {
+	partition, ok := h.partition(w, r)
+	if !ok {
+		return
+	}
+
+	if partition.Delete(id) {
+		w.WriteHeader(http.StatusNoContent)
+		log.Printf("Email %d deleted", id)
+	} else {
+		http.Error(w, "Email not found", http.StatusNotFound)
+	}
+}
+
+// deleteAllEmails deletes all emails and reports how many were removed.
+// Clients that don't want a body can pass ?quiet=true to get a 204 instead.
+// When API keys are configured only the caller's partition is cleared.
+func (h *Handler) deleteAllEmails(w http.ResponseWriter, r *http.Request) {
+	partition, ok := h.partition(w, r)
+	if !ok {
+		return
+	}
+
+	var count int
+	if len(h.opts.Keys) == 0 {
+		count = h.store.DeleteAll()
+	} else {
+		count = partition.DeleteAll()
+	}
+	log.Printf("All emails deleted (%d)", count)
+
+	if quiet, _ := strconv.ParseBool(r.URL.Query().Get("quiet")); quiet {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	writeJSON(w, r, map[string]int{"deleted": count})
+}
+
+// partition returns the store partition selected by the X-Mailer-Key header,
+// writing a 401 and returning false for an unknown key. Without configured
+// keys the header is ignored and everyone shares one partition.
+func (h *Handler) partition(w http.ResponseWriter, r *http.Request) (*storage.Partition, bool) {
+	key := r.Header.Get("X-Mailer-Key")
+	if len(h.opts.Keys) == 0 || key == "" {
+		return h.store.Partition(""), true
+	}
+
+	if !slices.Contains(h.opts.Keys, key) {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return nil, false
+	}
+	return h.store.Partition(key), true
+}
+
+// writeJSON writes v as JSON, indented when the request has ?pretty=true
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	writeJSONStatus(w, r, http.StatusOK, v)
+}
+
+// writeJSONStatus is writeJSON with a status other than 200 OK, sent after
+// the Content-Type header has been set
+func writeJSONStatus(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(w)
+	if pretty, _ := strconv.ParseBool(r.URL.Query().Get("pretty")); pretty {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(v)
+}
+
+// writeEmailsJSON writes an email or list of emails as JSON with the given
+// status, limited to the comma-separated JSON field names in ?fields= when
+// given
+func writeEmailsJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	fields := r.URL.Query().Get("fields")
+	if fields == "" {
+		writeJSONStatus(w, r, status, v)
+		return
+	}
+
+	// Round-trip through generic JSON so fields are selected by their JSON names
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	var generic interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+
+	selected := make(map[string]bool)
+	for _, field := range strings.Split(fields, ",") {
+		selected[strings.TrimSpace(field)] = true
+	}
+
+	switch value := generic.(type) {
+	case []interface{}:
+		for i, item := range value {
+			value[i] = selectFields(item, selected)
+		}
+	default:
+		generic = selectFields(value, selected)
+	}
+
+	writeJSONStatus(w, r, status, generic)
+}
+
+// selectFields keeps only the selected keys of a JSON object
+func selectFields(v interface{}, selected map[string]bool) interface{} {
+	object, ok := v.(map[string]interface{})
+	if !ok {
+		return v
+	}
+
+	filtered := make(map[string]interface{}, len(selected))
+	for key, value := range object {
+		if selected[key] {
+			filtered[key] = value
+		}
+	}
+	return filtered
+}
+
+// latencyMiddleware delays each request by the configured latency plus jitter.
+// Streaming requests (SSE and WebSocket upgrades) are exempt.
+func (h *Handler) latencyMiddleware(next http.Handler) http.Handler {
+	if h.opts.Latency <= 0 && h.opts.Jitter <= 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		streaming := r.Header.Get("Upgrade") != "" ||
+			strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+
+		if !streaming {
+			delay := h.opts.Latency
+			if h.opts.Jitter > 0 {
+				delay += time.Duration(rand.Int64N(int64(h.opts.Jitter) + 1))
+			}
+			time.Sleep(delay)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientCertLogMiddleware logs each request made with a TLS client
+// certificate together with the certificate's subject
+func (h *Handler) clientCertLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			log.Printf("HTTP %s %s from %s (client cert: %s)", r.Method, r.URL.Path, r.RemoteAddr, r.TLS.PeerCertificates[0].Subject)
+		}
+
+		next.ServeHTTP(w, r)
+	})
 }
 
 // corsMiddleware adds CORS headers
@@ -138,7 +1437,7 @@ func (h *Handler) corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Mailer-Key")
 
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusOK)
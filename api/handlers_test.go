@@ -0,0 +1,235 @@
+package api
+
+import (
+	"encoding/json"
+	"mailer/hooks"
+	"mailer/models"
+	"mailer/storage"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeSubject(t *testing.T) {
+	tests := []struct {
+		subject string
+		want    string
+	}{
+		{"Hi", "Hi"},
+		{"Re: Hi", "Hi"},
+		{"Re: Re: Hi", "Hi"},
+		{"Re: Fwd:  Re: Hi", "Hi"},
+		{"RE: fw: FWD: Hi", "Hi"},
+		{"re:Hi", "Hi"},
+		{"Re[2]: Hi", "Hi"},
+		{"Re : Hi", "Hi"},
+		{"  Re:   Hello \t there  ", "Hello there"},
+		{"Fwd: Re: Meeting: agenda", "Meeting: agenda"},
+		{"Hi Re: there", "Hi Re: there"},
+		{"Reply: Hi", "Reply: Hi"},
+		{"Re:", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeSubject(tt.subject); got != tt.want {
+			t.Errorf("normalizeSubject(%q) = %q, want %q", tt.subject, got, tt.want)
+		}
+	}
+}
+
+// TestReplaySkipsSaveHooks checks a replayed copy isn't transformed again
+// and is answered with 201 and a JSON content type
+func TestReplaySkipsSaveHooks(t *testing.T) {
+	store := storage.NewStore()
+	store.BeforeSave(func(email *models.Email) {
+		email.Body += " [seen]"
+	})
+	id := store.Save(&models.Email{From: "jane@example.com", To: []string{"bob@example.com"}, Subject: "Hi", Body: "Hello"})
+
+	handler := NewHandler(store, storage.NewConnectionRegistry(), "", "", "", Options{})
+	rec := httptest.NewRecorder()
+	handler.SetupRoutes().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/emails/1/replay", nil))
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusCreated, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var replayed models.Email
+	if err := json.Unmarshal(rec.Body.Bytes(), &replayed); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if replayed.ID == id {
+		t.Errorf("replayed copy kept ID %d", id)
+	}
+	if stored, _ := store.GetByID(replayed.ID); stored == nil || stored.Body != "Hello [seen]" {
+		t.Errorf("replayed body = %v, want the original's %q", stored, "Hello [seen]")
+	}
+}
+
+// trackedStore returns a store whose save hooks rewrite links and add the
+// open pixel, with keys configured, holding a shared email (ID 1) and one in
+// the "team" partition (ID 2)
+func trackedStore(t *testing.T) (*storage.Store, http.Handler) {
+	t.Helper()
+	store := storage.NewStore()
+	store.BeforeSave(hooks.NewLinkRewriter("http://localhost:8080").Rewrite)
+	store.BeforeSave(hooks.NewOpenTracker("http://localhost:8080").Inject)
+	store.Save(&models.Email{HTMLBody: `<a href="https://example.com/welcome?a=1&amp;b=2">Welcome</a>`})
+	store.Save(&models.Email{Key: "team", HTMLBody: `<a href="https://example.com/private">Private</a>`})
+	return store, NewHandler(store, storage.NewConnectionRegistry(), "", "", "", Options{Keys: []string{"team"}}).SetupRoutes()
+}
+
+// token returns the tracking token of the stored email with the ID
+func token(t *testing.T, store *storage.Store, id int) string {
+	t.Helper()
+	email, ok := store.GetByID(id)
+	if !ok || email.TrackingToken == "" {
+		t.Fatalf("email %d has no tracking token", id)
+	}
+	return email.TrackingToken
+}
+
+func TestClickOnlyRedirectsToTrackedLinks(t *testing.T) {
+	store, routes := trackedStore(t)
+	shared, team := token(t, store, 1), token(t, store, 2)
+
+	tests := []struct {
+		name   string
+		id     string
+		token  string
+		target string
+		want   int
+	}{
+		{"tracked link", "1", shared, "https://example.com/welcome?a=1&b=2", http.StatusFound},
+		{"keyed partition without key", "2", team, "https://example.com/private", http.StatusFound},
+		{"foreign URL", "1", shared, "https://evil.example/", http.StatusNotFound},
+		{"link of another email", "1", shared, "https://example.com/private", http.StatusNotFound},
+		{"token of another email", "2", shared, "https://example.com/private", http.StatusNotFound},
+		{"missing token", "2", "", "https://example.com/private", http.StatusNotFound},
+		{"unknown email", "9", shared, "https://example.com/welcome?a=1&b=2", http.StatusNotFound},
+		{"not http", "1", shared, "javascript:alert(1)", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/click?emailId="+tt.id+"&token="+tt.token+"&url="+url.QueryEscape(tt.target), nil)
+			rec := httptest.NewRecorder()
+			routes.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if tt.want == http.StatusFound && rec.Header().Get("Location") != tt.target {
+				t.Errorf("Location = %q, want %q", rec.Header().Get("Location"), tt.target)
+			}
+		})
+	}
+
+	// The rewritten link itself carries everything the redirect needs
+	email, _ := store.GetByID(2)
+	if !strings.Contains(email.HTMLBody, "token="+team) {
+		t.Errorf("rewritten HTML %q lacks the tracking token", email.HTMLBody)
+	}
+}
+
+func TestOpenRequiresToken(t *testing.T) {
+	store, routes := trackedStore(t)
+	team := token(t, store, 2)
+
+	tests := []struct {
+		name  string
+		id    string
+		token string
+		want  int
+	}{
+		{"keyed partition without key", "2", team, http.StatusOK},
+		{"token of another email", "1", team, http.StatusNotFound},
+		{"missing token", "2", "", http.StatusNotFound},
+		{"unknown email", "9", team, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			routes.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/open?emailId="+tt.id+"&token="+tt.token, nil))
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if tt.want == http.StatusOK && rec.Header().Get("Content-Type") != "image/gif" {
+				t.Errorf("Content-Type = %q, want image/gif", rec.Header().Get("Content-Type"))
+			}
+		})
+	}
+
+	if opens := store.GetOpens(2); opens.Count != 1 {
+		t.Errorf("email 2 opened %d times, want 1", opens.Count)
+	}
+	if opens := store.GetOpens(1); opens.Count != 0 {
+		t.Errorf("email 1 opened %d times, want 0", opens.Count)
+	}
+	email, _ := store.GetByID(2)
+	if !strings.Contains(email.HTMLBody, "token="+team) {
+		t.Errorf("pixel in %q lacks the tracking token", email.HTMLBody)
+	}
+}
+
+func TestAdminConfig(t *testing.T) {
+	store := storage.NewStore()
+	store.SetRetention(time.Hour)
+	routes := NewHandler(store, storage.NewConnectionRegistry(), "", "", "", Options{Keys: []string{"team"}, AdminKey: "admin"}).SetupRoutes()
+
+	tests := []struct {
+		name      string
+		method    string
+		key       string
+		body      string
+		want      int
+		retention time.Duration
+	}{
+		{"get", http.MethodGet, "admin", "", http.StatusOK, time.Hour},
+		{"missing key", http.MethodGet, "", "", http.StatusUnauthorized, time.Hour},
+		{"API key", http.MethodPost, "team", `{"retention": "5m"}`, http.StatusUnauthorized, time.Hour},
+		{"change retention", http.MethodPost, "admin", `{"retention": "30m"}`, http.StatusOK, 30 * time.Minute},
+		{"invalid retention", http.MethodPost, "admin", `{"retention": "soon"}`, http.StatusBadRequest, 30 * time.Minute},
+		{"restart setting", http.MethodPost, "admin", `{"retention": "5m", "smtp-addr": ":25"}`, http.StatusConflict, 30 * time.Minute},
+		{"unknown setting", http.MethodPost, "admin", `{"retention": "5m", "fail-rate": 0.5}`, http.StatusBadRequest, 30 * time.Minute},
+		{"not an object", http.MethodPost, "admin", `[]`, http.StatusBadRequest, 30 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/api/admin/config", strings.NewReader(tt.body))
+			req.Header.Set("X-Mailer-Admin-Key", tt.key)
+			req.Header.Set("X-Mailer-Key", tt.key)
+			rec := httptest.NewRecorder()
+			routes.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if got := store.Retention(); got != tt.retention {
+				t.Errorf("retention = %s, want %s", got, tt.retention)
+			}
+			if tt.want == http.StatusOK && !strings.Contains(rec.Body.String(), `"retention":"`+tt.retention.String()+`"`) {
+				t.Errorf("body = %s, want the current retention", rec.Body)
+			}
+		})
+	}
+}
+
+func TestAdminConfigDisabledWithoutKey(t *testing.T) {
+	store := storage.NewStore()
+	routes := NewHandler(store, storage.NewConnectionRegistry(), "", "", "", Options{}).SetupRoutes()
+
+	rec := httptest.NewRecorder()
+	routes.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/admin/config", strings.NewReader(`{"retention": "1m"}`)))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if store.Retention() != 0 {
+		t.Errorf("retention changed to %s", store.Retention())
+	}
+}
@@ -0,0 +1,109 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"mailer/models"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// execQueueSize is the number of events that may wait for a free worker
+// before further ones are dropped
+const execQueueSize = 1000
+
+// execJob is an event waiting for a worker
+type execJob struct {
+	id     int
+	data   []byte
+	event  string
+	reason string
+}
+
+// ExecHook runs an external executable for each captured, evicted or opened email
+type ExecHook struct {
+	path    string
+	timeout time.Duration
+	queue   chan execJob
+}
+
+// NewExecHook creates a hook that runs the executable at path with at most
+// maxConcurrent invocations in flight, each killed after timeout. Events
+// wait in a bounded queue while all invocations are busy.
+func NewExecHook(path string, maxConcurrent int, timeout time.Duration) *ExecHook {
+	if maxConcurrent <= 0 {
+		maxConcurrent = 1
+	}
+
+	h := &ExecHook{
+		path:    path,
+		timeout: timeout,
+		queue:   make(chan execJob, execQueueSize),
+	}
+	for i := 0; i < maxConcurrent; i++ {
+		go h.work()
+	}
+	return h
+}
+
+// Handle asynchronously runs the executable with the email's JSON on stdin.
+// Failures are logged and never affect the capture itself.
+func (h *ExecHook) Handle(email *models.Email) {
+	h.enqueue(email, "captured", "")
+}
+
+// HandleEvicted asynchronously runs the executable with the evicted email's
+// JSON on stdin and the reason in the MAILER_EVICT_REASON environment variable
+func (h *ExecHook) HandleEvicted(email *models.Email, reason string) {
+	h.enqueue(email, "evicted", reason)
+}
+
+// HandleOpened asynchronously runs the executable with the JSON of an email
+// whose tracking pixel was loaded
+func (h *ExecHook) HandleOpened(email *models.Email) {
+	h.enqueue(email, "opened", "")
+}
+
+// enqueue queues an event for the workers, with MAILER_EVENT set to event
+func (h *ExecHook) enqueue(email *models.Email, event string, reason string) {
+	// Marshal on the caller's goroutine so the hook sees the email as captured
+	data, err := json.Marshal(email)
+	if err != nil {
+		log.Printf("Exec hook: error encoding email %d: %v", email.ID, err)
+		return
+	}
+
+	// Drop rather than block the store when a hanging hook has filled the queue
+	select {
+	case h.queue <- execJob{id: email.ID, data: data, event: event, reason: reason}:
+	default:
+		log.Printf("Exec hook: too many pending hooks, skipping %s email %d", event, email.ID)
+	}
+}
+
+// work runs queued events one at a time
+func (h *ExecHook) work() {
+	for job := range h.queue {
+		h.run(job)
+	}
+}
+
+// run runs the executable for one event, killing it after the timeout
+func (h *ExecHook) run(job execJob) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, h.path)
+	cmd.Stdin = bytes.NewReader(job.data)
+	cmd.Env = append(os.Environ(), "MAILER_EVENT="+job.event)
+	if job.reason != "" {
+		cmd.Env = append(cmd.Env, "MAILER_EVICT_REASON="+job.reason)
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		log.Printf("Exec hook failed for %s email %d: %v (output: %s)", job.event, job.id, err, bytes.TrimSpace(output))
+	}
+}
@@ -0,0 +1,41 @@
+package hooks
+
+import (
+	"mailer/models"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestExecHookQueuesWhileBusy checks events arriving while every worker is
+// busy run later instead of being dropped
+func TestExecHookQueuesWhileBusy(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "events")
+	script := filepath.Join(dir, "hook.sh")
+	body := "#!/bin/sh\nsleep 0.05\necho \"$MAILER_EVENT\" >> " + out + "\n"
+	if err := os.WriteFile(script, []byte(body), 0o755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	hook := NewExecHook(script, 1, 5*time.Second)
+	const events = 5
+	for i := 1; i <= events; i++ {
+		hook.Handle(&models.Email{ID: i})
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, _ := os.ReadFile(out)
+		lines := strings.Fields(string(data))
+		if len(lines) == events {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("hook ran for %d of %d events", len(lines), events)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,86 @@
+package hooks
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"mailer/models"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// anchorHrefPattern matches the href attribute of an anchor tag, capturing
+// everything up to the value and the double- or single-quoted value itself
+var anchorHrefPattern = regexp.MustCompile(`(?is)(<a\b[^>]*?\bhref\s*=\s*)(?:"([^"]*)"|'([^']*)')`)
+
+// LinkRewriter rewrites links in captured HTML to go through the
+// click-tracking endpoint
+type LinkRewriter struct {
+	baseURL string
+}
+
+// NewLinkRewriter creates a rewriter pointing links at baseURL's /api/click
+func NewLinkRewriter(baseURL string) *LinkRewriter {
+	return &LinkRewriter{baseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// Rewrite replaces each http(s) anchor href in the email's HTML body with a
+// tracking URL that redirects to the original
+func (lr *LinkRewriter) Rewrite(email *models.Email) {
+	if email.HTMLBody == "" {
+		return
+	}
+
+	email.HTMLBody = anchorHrefPattern.ReplaceAllStringFunc(email.HTMLBody, func(match string) string {
+		groups := anchorHrefPattern.FindStringSubmatch(match)
+		target := html.UnescapeString(groups[2] + groups[3])
+
+		// Links already tracked, e.g. in a captured email sent back through
+		// mailer, are re-pointed at this email's ID instead of being wrapped twice
+		if strings.HasPrefix(target, lr.baseURL+"/api/click?") {
+			if u, err := url.Parse(target); err == nil {
+				target = u.Query().Get("url")
+			}
+		}
+
+		lower := strings.ToLower(target)
+		if !strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "https://") {
+			return match
+		}
+
+		tracked := fmt.Sprintf("%s/api/click?emailId=%d&token=%s&url=%s", lr.baseURL, email.ID, trackingToken(email), url.QueryEscape(target))
+		return groups[1] + `"` + html.EscapeString(tracked) + `"`
+	})
+}
+
+// trackingToken returns the email's tracking token, generating it the first
+// time a link or pixel is added. The tracking endpoints are loaded by
+// browsers without an API key, so the token is what authorizes them.
+func trackingToken(email *models.Email) string {
+	if email.TrackingToken == "" {
+		b := make([]byte, 16)
+		rand.Read(b)
+		email.TrackingToken = hex.EncodeToString(b)
+	}
+	return email.TrackingToken
+}
+
+// IsTrackedLink reports whether target is the original URL of a link in the
+// email's HTML that was rewritten to be tracked for this email, so the click
+// endpoint only redirects to URLs the email actually contained
+func IsTrackedLink(email *models.Email, target string) bool {
+	for _, groups := range anchorHrefPattern.FindAllStringSubmatch(email.HTMLBody, -1) {
+		u, err := url.Parse(html.UnescapeString(groups[2] + groups[3]))
+		if err != nil || !strings.HasSuffix(u.Path, "/api/click") {
+			continue
+		}
+		query := u.Query()
+		if query.Get("emailId") == strconv.Itoa(email.ID) && query.Get("url") == target {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,257 @@
+package hooks
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"mailer/models"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNATS is a NATS server speaking just enough of the protocol for the
+// publisher: it greets, answers the handshake PING and hands each PUB
+// payload and client PONG to the test
+type fakeNATS struct {
+	ln    net.Listener
+	conns chan net.Conn // Each connection once its handshake is done
+	pubs  chan string
+	pongs chan struct{}
+}
+
+// startFakeNATS runs a fakeNATS on a free local port
+func startFakeNATS(t *testing.T) *fakeNATS {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	s := &fakeNATS{ln: ln, conns: make(chan net.Conn, 10), pubs: make(chan string, 10), pongs: make(chan struct{}, 10)}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// serve handles one client connection until it closes
+func (s *fakeNATS) serve(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	io.WriteString(conn, "INFO {\"server_id\":\"fake\",\"max_payload\":1048576}\r\n")
+	handshake := true
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		verb, args, _ := strings.Cut(strings.TrimSpace(line), " ")
+		switch verb {
+		case "PING":
+			io.WriteString(conn, "PONG\r\n")
+			if handshake {
+				handshake = false
+				s.conns <- conn
+			}
+		case "PONG":
+			s.pongs <- struct{}{}
+		case "PUB":
+			var subject string
+			var size int
+			fmt.Sscanf(args, "%s %d", &subject, &size)
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			s.pubs <- string(payload[:size])
+		}
+	}
+}
+
+// url returns the nats:// URL of the server for subject
+func (s *fakeNATS) url(subject string) string {
+	return "nats://" + s.ln.Addr().String() + "/" + subject
+}
+
+// logBuffer collects log output written from any goroutine
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+// Write appends p to the buffer
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// String returns everything logged so far
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog sends the log to a buffer until the test ends
+func captureLog(t *testing.T) *logBuffer {
+	t.Helper()
+	buf := &logBuffer{}
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return buf
+}
+
+// receive waits for the next value on ch
+func receive[T any](t *testing.T, ch <-chan T, what string) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+		panic("unreachable")
+	}
+}
+
+// waitDisconnected waits for the publisher to notice its connection closed
+func waitDisconnected(t *testing.T, p *NATSPublisher) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.mu.Lock()
+		conn := p.conn
+		p.mu.Unlock()
+		if conn == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("publisher still connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNATSPublishes(t *testing.T) {
+	server := startFakeNATS(t)
+	p, err := NewNATSPublisher(server.url("test.captured"), 5*time.Second)
+	if err != nil {
+		t.Fatalf("NewNATSPublisher: %v", err)
+	}
+
+	p.Handle(&models.Email{ID: 1, Subject: "First"})
+	p.Handle(&models.Email{ID: 2, Subject: "Second"})
+	for i, subject := range []string{"First", "Second"} {
+		if payload := receive(t, server.pubs, "PUB"); !strings.Contains(payload, `"subject":"`+subject+`"`) {
+			t.Errorf("message %d = %s, want email %q", i+1, payload, subject)
+		}
+	}
+}
+
+// TestNATSAnswersPing checks the server's keep-alive PINGs are answered so
+// it doesn't drop the connection as stale
+func TestNATSAnswersPing(t *testing.T) {
+	server := startFakeNATS(t)
+	p, err := NewNATSPublisher(server.url("test.captured"), 5*time.Second)
+	if err != nil {
+		t.Fatalf("NewNATSPublisher: %v", err)
+	}
+
+	p.Handle(&models.Email{ID: 1})
+	conn := receive(t, server.conns, "connection")
+	receive(t, server.pubs, "PUB")
+
+	io.WriteString(conn, "PING\r\n")
+	receive(t, server.pongs, "PONG")
+}
+
+// TestNATSReconnectsAfterError checks a server error is logged and the
+// publisher reconnects once the server closes the connection
+func TestNATSReconnectsAfterError(t *testing.T) {
+	logs := captureLog(t)
+	server := startFakeNATS(t)
+	p, err := NewNATSPublisher(server.url("test.captured"), 5*time.Second)
+	if err != nil {
+		t.Fatalf("NewNATSPublisher: %v", err)
+	}
+
+	p.Handle(&models.Email{ID: 1})
+	conn := receive(t, server.conns, "connection")
+	receive(t, server.pubs, "PUB")
+
+	io.WriteString(conn, "-ERR 'Stale Connection'\r\n")
+	conn.Close()
+	waitDisconnected(t, p)
+	if !strings.Contains(logs.String(), "NATS: server error: 'Stale Connection'") {
+		t.Errorf("log = %q, want the server error", logs.String())
+	}
+
+	p.Handle(&models.Email{ID: 2, Subject: "After reconnect"})
+	receive(t, server.conns, "reconnection")
+	if payload := receive(t, server.pubs, "PUB"); !strings.Contains(payload, "After reconnect") {
+		t.Errorf("message after reconnect = %s", payload)
+	}
+}
+
+// TestNATSQueueOverflow checks captures past the queue size are dropped
+// with a log line while the server doesn't answer, without blocking
+func TestNATSQueueOverflow(t *testing.T) {
+	logs := captureLog(t)
+
+	// A server that accepts but never greets keeps the first publish waiting
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	p, err := NewNATSPublisher("nats://"+ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("NewNATSPublisher: %v", err)
+	}
+
+	const captures = natsQueueSize + 10
+	done := make(chan struct{})
+	go func() {
+		for i := 1; i <= captures; i++ {
+			p.Handle(&models.Email{ID: i})
+		}
+		close(done)
+	}()
+	receive(t, done, "captures to be handled")
+
+	dropped := strings.Count(logs.String(), "too many pending messages")
+	if dropped < 9 || dropped > 10 {
+		t.Errorf("%d captures dropped, want 9 or 10 (the queue holds %d plus one being published)", dropped, natsQueueSize)
+	}
+	if !strings.Contains(logs.String(), fmt.Sprintf("skipping email %d", captures)) {
+		t.Errorf("last capture wasn't reported as dropped")
+	}
+
+	// Let the queue drain against a closed port before the log is restored
+	ln.Close()
+	deadline := time.Now().Add(30 * time.Second)
+	for len(p.queue) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,46 @@
+package hooks
+
+import (
+	"mailer/models"
+	"strings"
+)
+
+// NewlineNormalizer rewrites the line endings of captured bodies to one
+// style so byte-exact comparisons don't depend on the sender
+type NewlineNormalizer struct {
+	newline string
+}
+
+// NewNewlineNormalizer creates a normalizer that ends every body line with
+// newline, which is "\n" or "\r\n"
+func NewNewlineNormalizer(newline string) *NewlineNormalizer {
+	return &NewlineNormalizer{newline: newline}
+}
+
+// Normalize converts CRLF, bare CR and bare LF line endings in the email's
+// text and HTML bodies and marks the email if either body changed
+func (nn *NewlineNormalizer) Normalize(email *models.Email) {
+	body := nn.normalize(email.Body)
+	htmlBody := nn.normalize(email.HTMLBody)
+	if body == email.Body && htmlBody == email.HTMLBody {
+		return
+	}
+
+	email.Body = body
+	email.HTMLBody = htmlBody
+	email.NewlinesNormalized = true
+}
+
+// normalize returns s with every line ending replaced by nn.newline
+func (nn *NewlineNormalizer) normalize(s string) string {
+	if !strings.ContainsRune(s, '\r') && nn.newline == "\n" {
+		return s
+	}
+
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\r", "\n")
+	if nn.newline != "\n" {
+		s = strings.ReplaceAll(s, "\n", nn.newline)
+	}
+	return s
+}
@@ -0,0 +1,51 @@
+package hooks
+
+import (
+	"fmt"
+	"html"
+	"mailer/models"
+	"regexp"
+	"strings"
+)
+
+// closingBodyPattern matches the closing body tag the pixel is inserted before
+var closingBodyPattern = regexp.MustCompile(`(?i)</body\s*>`)
+
+// OpenTracker adds a tracking pixel to captured HTML so that views of the
+// email are recorded by the open-tracking endpoint
+type OpenTracker struct {
+	baseURL string
+	pixel   *regexp.Regexp
+}
+
+// NewOpenTracker creates a tracker whose pixel points at baseURL's /api/open
+func NewOpenTracker(baseURL string) *OpenTracker {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	return &OpenTracker{
+		baseURL: baseURL,
+		pixel:   regexp.MustCompile(`<img src="` + regexp.QuoteMeta(html.EscapeString(baseURL)) + `/api/open\?emailId=\d+&amp;token=[0-9a-f]+" width="1" height="1" alt="">`),
+	}
+}
+
+// Inject inserts a 1x1 pixel for the email before the last closing body tag,
+// or appends it when the HTML has none
+func (ot *OpenTracker) Inject(email *models.Email) {
+	if email.HTMLBody == "" {
+		return
+	}
+
+	// A pixel already present, e.g. in a captured email sent back through
+	// mailer, is replaced so that views count towards this email's ID
+	email.HTMLBody = ot.pixel.ReplaceAllString(email.HTMLBody, "")
+
+	src := fmt.Sprintf("%s/api/open?emailId=%d&token=%s", ot.baseURL, email.ID, trackingToken(email))
+	pixel := `<img src="` + html.EscapeString(src) + `" width="1" height="1" alt="">`
+
+	matches := closingBodyPattern.FindAllStringIndex(email.HTMLBody, -1)
+	if len(matches) == 0 {
+		email.HTMLBody += pixel
+		return
+	}
+	at := matches[len(matches)-1][0]
+	email.HTMLBody = email.HTMLBody[:at] + pixel + email.HTMLBody[at:]
+}
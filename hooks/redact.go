@@ -0,0 +1,88 @@
+package hooks
+
+import (
+	"mailer/models"
+	"regexp"
+)
+
+// RedactionPlaceholder replaces each redacted match
+const RedactionPlaceholder = "[REDACTED]"
+
+// Redactor replaces matches of sensitive patterns, such as tokens, in
+// captured emails so captures can be shared safely
+type Redactor struct {
+	patterns []*regexp.Regexp
+}
+
+// NewRedactor compiles the patterns, failing on the first invalid one
+func NewRedactor(patterns []string) (*Redactor, error) {
+	r := &Redactor{}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+// Redact replaces every match of each pattern with RedactionPlaceholder in
+// the email's text served by the API or IMAP: the subject, headers, bodies,
+// calendar, attachment text and transcript. Addresses are left alone. The
+// number of matches per pattern is recorded in Redactions. Once anything
+// matched, the raw message and the undecoded part bodies are dropped, since
+// their encodings can hide the same values.
+func (r *Redactor) Redact(email *models.Email) {
+	for _, re := range r.patterns {
+		count := 0
+		redact := func(s *string) {
+			if n := len(re.FindAllStringIndex(*s, -1)); n > 0 {
+				*s = re.ReplaceAllLiteralString(*s, RedactionPlaceholder)
+				count += n
+			}
+		}
+
+		redact(&email.Subject)
+		redact(&email.Body)
+		redact(&email.HTMLBody)
+		redact(&email.Calendar)
+		redact(&email.RawHeaders)
+		redact(&email.RawHeaderBlock)
+		redact(&email.Transcript)
+		for _, values := range email.CustomHeaders {
+			for i := range values {
+				redact(&values[i])
+			}
+		}
+		walkParts(email.Structure, func(part *models.MIMEPart) {
+			redact(&part.Text)
+		})
+		if count == 0 {
+			continue
+		}
+
+		if email.Redactions == nil {
+			email.Redactions = make(map[string]int)
+		}
+		email.Redactions[re.String()] += count
+	}
+
+	if len(email.Redactions) > 0 {
+		email.Raw = nil
+		walkParts(email.Structure, func(part *models.MIMEPart) {
+			part.EncodedBody = nil
+		})
+	}
+}
+
+// walkParts calls fn for part and each part nested in it
+func walkParts(part *models.MIMEPart, fn func(*models.MIMEPart)) {
+	if part == nil {
+		return
+	}
+	fn(part)
+	for _, child := range part.Parts {
+		walkParts(child, fn)
+	}
+}
@@ -0,0 +1,99 @@
+package hooks
+
+import (
+	"encoding/json"
+	"mailer/models"
+	"maps"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	r, err := NewRedactor([]string{`tok_[a-z0-9]+`, `\d{4}-\d{4}`})
+	if err != nil {
+		t.Fatalf("NewRedactor: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		body     string
+		htmlBody string
+		wantBody string
+		wantHTML string
+		want     map[string]int
+	}{
+		{"body", "Your token is tok_abc123.", "", "Your token is [REDACTED].", "", map[string]int{`tok_[a-z0-9]+`: 1}},
+		{"html", "", "<p>tok_abc</p><p>tok_def</p>", "", "<p>[REDACTED]</p><p>[REDACTED]</p>", map[string]int{`tok_[a-z0-9]+`: 2}},
+		{
+			"both patterns", "Card 1234-5678", "<b>tok_x</b> 1111-2222", "Card [REDACTED]", "<b>[REDACTED]</b> [REDACTED]",
+			map[string]int{`tok_[a-z0-9]+`: 1, `\d{4}-\d{4}`: 2},
+		},
+		{"no match", "Nothing here", "<p>Nothing</p>", "Nothing here", "<p>Nothing</p>", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			email := &models.Email{Body: tt.body, HTMLBody: tt.htmlBody, Raw: []byte("raw")}
+			r.Redact(email)
+
+			if email.Body != tt.wantBody {
+				t.Errorf("body = %q, want %q", email.Body, tt.wantBody)
+			}
+			if email.HTMLBody != tt.wantHTML {
+				t.Errorf("HTML body = %q, want %q", email.HTMLBody, tt.wantHTML)
+			}
+			if !maps.Equal(email.Redactions, tt.want) {
+				t.Errorf("redactions = %v, want %v", email.Redactions, tt.want)
+			}
+			if (email.Raw == nil) != (tt.want != nil) {
+				t.Errorf("raw kept = %v, want it dropped only after a match", email.Raw != nil)
+			}
+		})
+	}
+}
+
+// TestRedactLeavesNoCopies checks the secret is gone from every field the
+// API serves, including the structure and transcript endpoints
+func TestRedactLeavesNoCopies(t *testing.T) {
+	const secret = "tok_s3cret"
+	r, err := NewRedactor([]string{`tok_[a-z0-9]+`})
+	if err != nil {
+		t.Fatalf("NewRedactor: %v", err)
+	}
+
+	email := &models.Email{
+		Subject:        "Login " + secret,
+		Body:           "Use " + secret,
+		Calendar:       "DESCRIPTION:" + secret,
+		RawHeaders:     "X-Token: " + secret,
+		RawHeaderBlock: "X-Token: " + secret,
+		CustomHeaders:  map[string][]string{"X-Token": {secret}},
+		Transcript:     "C: XTOKEN " + secret + "\nS: 500 Unknown command",
+		Structure: &models.MIMEPart{
+			ContentType: "multipart/mixed",
+			Parts: []*models.MIMEPart{
+				{ContentType: "text/plain", EncodedBody: []byte("VXNlIHRva19zM2NyZXQ=")},
+				{ContentType: "text/csv", Filename: "keys.csv", Text: "key\n" + secret + "\n"},
+			},
+		},
+	}
+	r.Redact(email)
+
+	data, err := json.Marshal(email)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if strings.Contains(string(data), secret) {
+		t.Errorf("secret still served: %s", data)
+	}
+	for _, part := range email.Structure.Parts {
+		if part.EncodedBody != nil {
+			t.Errorf("%s part keeps its encoded body %q", part.ContentType, part.EncodedBody)
+		}
+	}
+	if got := email.Redactions[`tok_[a-z0-9]+`]; got != 8 {
+		t.Errorf("redactions = %d, want 8", got)
+	}
+	if !strings.Contains(email.Transcript, "C: XTOKEN [REDACTED]") {
+		t.Errorf("transcript = %q, want the token redacted", email.Transcript)
+	}
+}
@@ -0,0 +1,67 @@
+package hooks
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"mailer/models"
+	"sync"
+)
+
+// JSONWriter writes each captured email as a single line of JSON
+type JSONWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	fields map[string]bool // JSON field names to keep, nil for all
+}
+
+// NewJSONWriter creates a writer emitting emails to w, limited to the given
+// JSON field names when any are given
+func NewJSONWriter(w io.Writer, fields []string) *JSONWriter {
+	jw := &JSONWriter{w: w}
+	if len(fields) > 0 {
+		jw.fields = make(map[string]bool, len(fields))
+		for _, field := range fields {
+			jw.fields[field] = true
+		}
+	}
+	return jw
+}
+
+// Handle writes the email as one JSON line. Writes are synchronous so lines
+// appear in capture order; a slow reader applies backpressure to captures.
+func (jw *JSONWriter) Handle(email *models.Email) {
+	var v interface{} = email
+	if jw.fields != nil {
+		// Round-trip through a map so fields are selected by their JSON names
+		data, err := json.Marshal(email)
+		if err != nil {
+			log.Printf("Stdout JSON: error encoding email %d: %v", email.ID, err)
+			return
+		}
+		var object map[string]interface{}
+		if err := json.Unmarshal(data, &object); err != nil {
+			log.Printf("Stdout JSON: error encoding email %d: %v", email.ID, err)
+			return
+		}
+		for key := range object {
+			if !jw.fields[key] {
+				delete(object, key)
+			}
+		}
+		v = object
+	}
+
+	line, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Stdout JSON: error encoding email %d: %v", email.ID, err)
+		return
+	}
+
+	jw.mu.Lock()
+	defer jw.mu.Unlock()
+
+	if _, err := jw.w.Write(append(line, '\n')); err != nil {
+		log.Printf("Stdout JSON: error writing email %d: %v", email.ID, err)
+	}
+}
@@ -0,0 +1,124 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mailer/models"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// webhookQueueSize is the number of captures that may wait for a free
+// worker before further ones are dropped
+const webhookQueueSize = 1000
+
+// webhookDelivery is a capture waiting to be posted
+type webhookDelivery struct {
+	id   int
+	data []byte
+}
+
+// WebhookHook POSTs the JSON of each captured email to a URL, optionally
+// signed so receivers can verify it came from mailer
+type WebhookHook struct {
+	url     string
+	secret  []byte
+	client  *http.Client
+	timeout time.Duration
+	queue   chan webhookDelivery
+}
+
+// NewWebhookHook creates a hook that posts to url with at most
+// maxConcurrent requests in flight, each cancelled after timeout. Captures
+// wait in a bounded queue while all requests are busy. A non-empty secret
+// signs each request, see Sign.
+func NewWebhookHook(url string, secret string, maxConcurrent int, timeout time.Duration) *WebhookHook {
+	if maxConcurrent <= 0 {
+		maxConcurrent = 1
+	}
+
+	h := &WebhookHook{
+		url:     url,
+		secret:  []byte(secret),
+		client:  &http.Client{},
+		timeout: timeout,
+		queue:   make(chan webhookDelivery, webhookQueueSize),
+	}
+	for i := 0; i < maxConcurrent; i++ {
+		go h.work()
+	}
+	return h
+}
+
+// Sign returns the X-Mailer-Signature value for a request body sent at
+// timestamp (Unix seconds): "t=<timestamp>,v1=<signature>", where the
+// signature is the hex HMAC-SHA256 of "<timestamp>.<body>" keyed with the
+// secret. Receivers recompute it and reject stale timestamps to stop replays.
+func Sign(secret []byte, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "t=" + strconv.FormatInt(timestamp, 10) + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Handle queues the email's JSON for posting to the webhook. Failures are
+// logged and never affect the capture itself.
+func (h *WebhookHook) Handle(email *models.Email) {
+	// Marshal on the caller's goroutine so the hook sees the email as captured
+	data, err := json.Marshal(email)
+	if err != nil {
+		log.Printf("Webhook: error encoding email %d: %v", email.ID, err)
+		return
+	}
+
+	// Drop rather than block captures when a hanging receiver has filled the queue
+	select {
+	case h.queue <- webhookDelivery{id: email.ID, data: data}:
+	default:
+		log.Printf("Webhook: too many pending requests, skipping email %d", email.ID)
+	}
+}
+
+// work posts queued captures one at a time
+func (h *WebhookHook) work() {
+	for delivery := range h.queue {
+		h.post(delivery)
+	}
+}
+
+// post sends one capture, signed at the time it is sent
+func (h *WebhookHook) post(delivery webhookDelivery) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(delivery.data))
+	if err != nil {
+		log.Printf("Webhook failed for email %d: %v", delivery.id, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Mailer-Event", "captured")
+	if len(h.secret) > 0 {
+		req.Header.Set("X-Mailer-Signature", Sign(h.secret, time.Now().Unix(), delivery.data))
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		log.Printf("Webhook failed for email %d: %v", delivery.id, err)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Printf("Webhook failed for email %d: %s", delivery.id, resp.Status)
+	}
+}
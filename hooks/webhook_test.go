@@ -0,0 +1,98 @@
+package hooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"mailer/models"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	secret := []byte("whsec_test")
+	body := []byte(`{"id":1}`)
+
+	// Computed independently, e.g. with Python's hmac module
+	want := "t=1700000000,v1=2f441ba4b3b2d50d28a9ab9d9fd8880376ecd1eb5d0435401553f5d8d0a5dcf8"
+	if got := Sign(secret, 1700000000, body); got != want {
+		t.Errorf("Sign = %q, want %q", got, want)
+	}
+	if Sign([]byte("other"), 1700000000, body) == want {
+		t.Error("Sign with another secret produced the same signature")
+	}
+	if Sign(secret, 1700000001, body) == want {
+		t.Error("Sign with another timestamp produced the same signature")
+	}
+}
+
+// signaturePattern matches the X-Mailer-Signature format
+var signaturePattern = regexp.MustCompile(`^t=(\d+),v1=([0-9a-f]{64})$`)
+
+// verify checks a signature the way the README tells receivers to
+func verify(secret []byte, signature string, body []byte) bool {
+	groups := signaturePattern.FindStringSubmatch(signature)
+	if groups == nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(groups[1] + "."))
+	mac.Write(body)
+	got, _ := hex.DecodeString(groups[2])
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// TestWebhookDeliversWhileBusy checks captures arriving while the only
+// request is in flight are queued and delivered signed, not dropped
+func TestWebhookDeliversWhileBusy(t *testing.T) {
+	secret := "whsec_test"
+	var mu sync.Mutex
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		signature := r.Header.Get("X-Mailer-Signature")
+		if !verify([]byte(secret), signature, body) {
+			t.Errorf("signature %q doesn't verify for %s", signature, body)
+		}
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		received = append(received, string(body))
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	hook := NewWebhookHook(server.URL, secret, 1, 5*time.Second)
+	const captures = 5
+	for i := 1; i <= captures; i++ {
+		hook.Handle(&models.Email{ID: i})
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(received)
+		mu.Unlock()
+		if n == captures {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("webhook received %d of %d captures", n, captures)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, body := range received {
+		if !strings.Contains(body, `"id":`+strconv.Itoa(i+1)+`,`) {
+			t.Errorf("delivery %d = %s, want email %d", i+1, body, i+1)
+		}
+	}
+}
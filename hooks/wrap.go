@@ -0,0 +1,21 @@
+package hooks
+
+import (
+	"html"
+	"mailer/models"
+)
+
+// WrapText gives text-only emails a generated HTML body showing the escaped
+// text with its line breaks and spacing preserved, so HTML previews always
+// have something to show. Emails with a real HTML part are left alone.
+func WrapText(email *models.Email) {
+	if email.HTMLBody != "" || email.Body == "" {
+		return
+	}
+
+	email.HTMLBody = "<!DOCTYPE html>\n<html>\n<head><meta charset=\"utf-8\"></head>\n" +
+		"<body><pre style=\"white-space: pre-wrap; font-family: inherit;\">" +
+		html.EscapeString(email.Body) +
+		"</pre></body>\n</html>\n"
+	email.GeneratedHTML = true
+}
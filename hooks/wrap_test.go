@@ -0,0 +1,41 @@
+package hooks
+
+import (
+	"mailer/models"
+	"strings"
+	"testing"
+)
+
+func TestWrapTextEscapes(t *testing.T) {
+	email := &models.Email{Body: "if a < b && c > d {\n\tsay(\"hi\", 'there')\n}\n<script>alert(1)</script>"}
+	WrapText(email)
+
+	if !email.GeneratedHTML {
+		t.Error("GeneratedHTML not set")
+	}
+	want := "if a &lt; b &amp;&amp; c &gt; d {\n\tsay(&#34;hi&#34;, &#39;there&#39;)\n}\n&lt;script&gt;alert(1)&lt;/script&gt;"
+	if !strings.Contains(email.HTMLBody, "<pre style=\"white-space: pre-wrap; font-family: inherit;\">"+want+"</pre>") {
+		t.Errorf("HTML body = %q, want the escaped text with its line breaks in a pre-wrap block", email.HTMLBody)
+	}
+	if strings.Contains(email.HTMLBody, "<script>") {
+		t.Errorf("HTML body contains the unescaped script tag: %q", email.HTMLBody)
+	}
+}
+
+func TestWrapTextKeepsRealHTML(t *testing.T) {
+	tests := []struct {
+		name  string
+		email models.Email
+	}{
+		{"html part", models.Email{Body: "Hello", HTMLBody: "<p>Hello</p>"}},
+		{"html only", models.Email{HTMLBody: "<p>Hello</p>"}},
+		{"no body", models.Email{}},
+	}
+	for _, tt := range tests {
+		email := tt.email
+		WrapText(&email)
+		if email.HTMLBody != tt.email.HTMLBody || email.GeneratedHTML {
+			t.Errorf("%s: HTML body = %q (generated %v), want it unchanged", tt.name, email.HTMLBody, email.GeneratedHTML)
+		}
+	}
+}
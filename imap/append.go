@@ -0,0 +1,88 @@
+package imap
+
+import (
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/server"
+)
+
+// appendExtension overrides go-imap's APPEND handler so that every APPEND
+// reports the UID of its message, whether it was stored or matched an
+// existing one with -dedup
+type appendExtension struct{}
+
+// Capabilities returns nothing. UIDPLUS isn't advertised since COPYUID and
+// UID EXPUNGE aren't implemented; clients ignore the unknown APPENDUID code.
+func (ext *appendExtension) Capabilities(c server.Conn) []string {
+	return nil
+}
+
+// Command returns the handler factory for the APPEND command
+func (ext *appendExtension) Command(name string) server.HandlerFactory {
+	if name != "APPEND" {
+		return nil
+	}
+
+	return func() server.Handler {
+		return &appendHandler{}
+	}
+}
+
+// appendHandler handles the APPEND command
+type appendHandler struct {
+	server.Append
+}
+
+// Handle stores the message like go-imap, announcing it with EXISTS when
+// the mailbox is selected, and completes with [APPENDUID validity uid]
+// (RFC 4315). A duplicate skipped by -dedup gets the existing email's UID.
+func (h *appendHandler) Handle(conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return server.ErrNotAuthenticated
+	}
+
+	mbox, err := ctx.User.GetMailbox(h.Mailbox)
+	if err == backend.ErrNoSuchMailbox {
+		return server.ErrStatusResp(&imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: imap.CodeTryCreate,
+			Info: err.Error(),
+		})
+	} else if err != nil {
+		return err
+	}
+	mailbox, ok := mbox.(*Mailbox)
+	if !ok {
+		return h.Append.Handle(conn)
+	}
+
+	if err := mailbox.CreateMessage(h.Flags, h.Date, h.Message); err != nil {
+		return err
+	}
+
+	info := "APPEND completed"
+	if mailbox.duplicate {
+		info = "APPEND completed, message already exists"
+	} else if ctx.Mailbox != nil && ctx.Mailbox.Name() == mailbox.Name() {
+		status, err := mailbox.Status([]imap.StatusItem{imap.StatusMessages})
+		if err != nil {
+			return err
+		}
+		status.Flags = nil
+		status.PermanentFlags = nil
+		status.UnseenSeqNum = 0
+		if err := conn.WriteResp(&responses.Select{Mailbox: status}); err != nil {
+			return err
+		}
+	}
+
+	// go-imap reports success through a status response error as well
+	return server.ErrStatusResp(&imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      "APPENDUID",
+		Arguments: []interface{}{mailbox.backend.store.UIDValidity(), mailbox.appended},
+		Info:      info,
+	})
+}
@@ -0,0 +1,52 @@
+package imap
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"mailer/storage"
+)
+
+// appendCommand returns an APPEND of raw to INBOX as a non-synchronizing
+// literal
+func appendCommand(raw string) string {
+	return fmt.Sprintf("APPEND INBOX {%d+}\r\n%s", len(raw), raw)
+}
+
+func TestAppendUID(t *testing.T) {
+	captured := "From: jane@example.com\r\nMessage-ID: <one@example.com>\r\nSubject: Captured\r\n\r\nHello\r\n"
+	other := "From: jane@example.com\r\nMessage-ID: <two@example.com>\r\nSubject: Other\r\n\r\nHello\r\n"
+
+	tests := []struct {
+		name   string
+		dedup  bool
+		raw    string
+		uid    int
+		exists bool // A new message is announced to the selected mailbox
+		stored int
+	}{
+		{"new message", false, other, 2, true, 2},
+		{"duplicate without -dedup", false, captured, 2, true, 2},
+		{"new message with -dedup", true, other, 2, true, 2},
+		{"duplicate with -dedup", true, captured, 1, false, 1},
+	}
+	for _, tt := range tests {
+		store := storage.NewStore()
+		saveRaw(t, store, captured)
+		c := dial(t, store, Options{Dedup: tt.dedup})
+		c.run("SELECT INBOX")
+
+		out := c.run(appendCommand(tt.raw))
+		want := fmt.Sprintf("OK [APPENDUID %d %d]", store.UIDValidity(), tt.uid)
+		if !strings.Contains(out, want) {
+			t.Errorf("%s: APPEND = %q, want %q", tt.name, out, want)
+		}
+		if exists := strings.Contains(out, "* 2 EXISTS"); exists != tt.exists {
+			t.Errorf("%s: APPEND = %q, want EXISTS %v", tt.name, out, tt.exists)
+		}
+		if n := len(store.GetAll()); n != tt.stored {
+			t.Errorf("%s: %d emails stored, want %d", tt.name, n, tt.stored)
+		}
+	}
+}
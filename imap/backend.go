@@ -2,39 +2,79 @@ package imap
 
 import (
 	"errors"
+	"log"
+	"strings"
+	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
+	"mailer/models"
+	"mailer/smtp"
 	"mailer/storage"
 )
 
+// Options configures the IMAP server
+type Options struct {
+	Parse smtp.ParseOptions // Parsing of APPENDed messages
+
+	// PerRecipient makes users who log in with an email address see only
+	// the messages addressed to it
+	PerRecipient bool
+
+	// Dedup makes APPEND skip messages whose Message-ID matches an email
+	// already in the mailbox, answering with that email's UID instead
+	Dedup bool
+
+	// IdleMax logs out clients whose IDLE lasts longer than this (0 = no limit)
+	IdleMax time.Duration
+}
+
 // Backend implements the IMAP backend interface
 type Backend struct {
-	store *storage.Store
+	store       *storage.Store
+	connections *storage.ConnectionRegistry
+	opts        Options
 }
 
 // NewBackend creates a new IMAP backend
-func NewBackend(store *storage.Store) *Backend {
-	return &Backend{store: store}
+func NewBackend(store *storage.Store, connections *storage.ConnectionRegistry, opts Options) *Backend {
+	return &Backend{store: store, connections: connections, opts: opts}
 }
 
 // Login authenticates a user
 // For testing purposes, we accept any username/password combination
-func (b *Backend) Login(_ *imap.ConnInfo, username, password string) (backend.User, error) {
+func (b *Backend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
 	// For development/testing, accept any credentials
 	// In production, you would validate credentials here
+	remoteAddr := connInfo.RemoteAddr.String()
+	connID := b.connections.Add("imap", remoteAddr)
+	log.Printf("IMAP login from %s as %s", remoteAddr, username)
+
+	// Per-recipient views are keyed by the login address
+	recipient := ""
+	if b.opts.PerRecipient && strings.Contains(username, "@") {
+		recipient = username
+	}
+
 	return &User{
 		username:     username,
+		recipient:    recipient,
 		backend:      b,
-		deletedFlags: make(map[uint32]bool),
+		deletedFlags: make(map[uint32]*models.Email),
+		connID:       connID,
+		remoteAddr:   remoteAddr,
 	}, nil
 }
 
 // User implements the IMAP user interface
 type User struct {
 	username     string
+	recipient    string // Address whose messages the user sees, "" for all
 	backend      *Backend
-	deletedFlags map[uint32]bool // Persists across GetMailbox calls for STORE+EXPUNGE workflow
+	deletedFlags map[uint32]*models.Email // Persists across GetMailbox calls for STORE+EXPUNGE workflow
+	utf8Accept   bool                     // Set once the client has sent ENABLE UTF8=ACCEPT
+	connID       int                      // Entry in the live connection registry
+	remoteAddr   string
 }
 
 // Username returns the username
@@ -54,14 +94,15 @@ func (u *User) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
 	return []backend.Mailbox{mailbox}, nil
 }
 
-// GetMailbox returns a mailbox by name
+// GetMailbox returns a mailbox by name. INBOX is matched case-insensitively
+// (RFC 3501 5.1); other names would be case-sensitive.
 func (u *User) GetMailbox(name string) (backend.Mailbox, error) {
-	if name != "INBOX" {
+	if !strings.EqualFold(name, imap.InboxName) {
 		return nil, errors.New("mailbox not found")
 	}
 
 	return &Mailbox{
-		name:         name,
+		name:         imap.InboxName,
 		user:         u,
 		backend:      u.backend,
 		deletedFlags: u.deletedFlags,
@@ -83,7 +124,9 @@ func (u *User) RenameMailbox(existingName, newName string) error {
 	return errors.New("renaming mailboxes is not supported")
 }
 
-// Logout is called when the user logs out
+// Logout is called when the user logs out or the connection closes
 func (u *User) Logout() error {
+	u.backend.connections.Remove(u.connID)
+	log.Printf("IMAP logout from %s", u.remoteAddr)
 	return nil
 }
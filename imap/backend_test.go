@@ -0,0 +1,38 @@
+package imap
+
+import (
+	"strings"
+	"testing"
+
+	"mailer/storage"
+)
+
+func TestSelectInboxAnyCase(t *testing.T) {
+	store := storage.NewStore()
+	saveRaw(t, store, plainMessage)
+	c := dial(t, store, Options{})
+
+	for _, name := range []string{"INBOX", "Inbox", "inbox", "iNbOx"} {
+		if out := c.run("SELECT " + name); !strings.Contains(out, "* 1 EXISTS") {
+			t.Errorf("SELECT %s = %q, want the inbox's message", name, out)
+		}
+	}
+}
+
+func TestGetMailboxCase(t *testing.T) {
+	user := &User{backend: NewBackend(storage.NewStore(), storage.NewConnectionRegistry(), Options{})}
+	for _, name := range []string{"Inbox", "inbox"} {
+		mbox, err := user.GetMailbox(name)
+		if err != nil {
+			t.Fatalf("GetMailbox(%q): %v", name, err)
+		}
+		if mbox.Name() != "INBOX" {
+			t.Errorf("GetMailbox(%q) name = %q, want INBOX", name, mbox.Name())
+		}
+	}
+	for _, name := range []string{"INBOX/Sub", "Inboxes", "Trash"} {
+		if _, err := user.GetMailbox(name); err == nil {
+			t.Errorf("GetMailbox(%q) succeeded, want mailbox not found", name)
+		}
+	}
+}
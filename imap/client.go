@@ -0,0 +1,50 @@
+package imap
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+	"mailer/smtp"
+)
+
+// AppendFiles connects to the IMAP server at addr and APPENDs each message
+// file into INBOX. A directory path is expanded to the .eml files it contains.
+// It returns the number of messages appended.
+func AppendFiles(addr string, path string) (int, error) {
+	files, err := smtp.MessageFiles(path)
+	if err != nil {
+		return 0, err
+	}
+	if len(files) == 0 {
+		return 0, fmt.Errorf("no .eml files found in %s", path)
+	}
+
+	c, err := client.Dial(addr)
+	if err != nil {
+		return 0, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	defer c.Logout()
+
+	// Any credentials are accepted by the mailer IMAP server
+	if err := c.Login("mailer", "mailer"); err != nil {
+		return 0, fmt.Errorf("failed to login: %w", err)
+	}
+
+	appended := 0
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return appended, fmt.Errorf("failed to read %s: %w", file, err)
+		}
+
+		if err := c.Append("INBOX", nil, time.Now(), bytes.NewBuffer(data)); err != nil {
+			return appended, fmt.Errorf("failed to append %s: %w", file, err)
+		}
+		appended++
+	}
+
+	return appended, nil
+}
@@ -0,0 +1,51 @@
+package imap
+
+import (
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/server"
+)
+
+// closeExtension overrides go-imap's CLOSE handler, which expunges even
+// when the mailbox was opened with EXAMINE
+type closeExtension struct{}
+
+// Capabilities returns nothing, CLOSE is part of IMAP4rev1
+func (ext *closeExtension) Capabilities(c server.Conn) []string {
+	return nil
+}
+
+// Command returns the handler factory for the CLOSE command
+func (ext *closeExtension) Command(name string) server.HandlerFactory {
+	if name != "CLOSE" {
+		return nil
+	}
+
+	return func() server.Handler {
+		return &closeHandler{}
+	}
+}
+
+// closeHandler handles the CLOSE command
+type closeHandler struct {
+	commands.Close
+}
+
+// Handle deselects the mailbox and, unless it was opened read-only,
+// silently removes the messages marked \Deleted (RFC 3501 6.4.2). No
+// EXPUNGE responses are sent since the mailbox is no longer selected.
+func (h *closeHandler) Handle(conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return server.ErrNoMailboxSelected
+	}
+
+	mailbox := ctx.Mailbox
+	readOnly := ctx.MailboxReadOnly
+	ctx.Mailbox = nil
+	ctx.MailboxReadOnly = false
+
+	if readOnly {
+		return nil
+	}
+	return mailbox.Expunge()
+}
@@ -0,0 +1,49 @@
+package imap
+
+import (
+	"strings"
+	"testing"
+
+	"mailer/storage"
+)
+
+func TestCloseExpunges(t *testing.T) {
+	store := storage.NewStore()
+	saveRaw(t, store, plainMessage)
+	saveRaw(t, store, plainMessage)
+	c := dial(t, store, Options{})
+
+	c.run("SELECT INBOX")
+	c.run(`STORE 1 +FLAGS (\Deleted)`)
+	if out := c.run("CLOSE"); strings.Contains(out, "EXPUNGE") {
+		t.Errorf("CLOSE = %q, want no EXPUNGE responses", out)
+	}
+	if out := c.run("SELECT INBOX"); !strings.Contains(out, "* 1 EXISTS") {
+		t.Errorf("SELECT after CLOSE = %q, want 1 message left", out)
+	}
+	_, first := store.GetByID(1)
+	_, second := store.GetByID(2)
+	if first || !second {
+		t.Errorf("CLOSE removed the wrong message")
+	}
+
+	// Nothing is left pending for a later EXPUNGE
+	c.run("EXPUNGE")
+	if n := len(store.GetAll()); n != 1 {
+		t.Errorf("%d emails after EXPUNGE, want 1", n)
+	}
+}
+
+func TestCloseAfterExamineKeepsMessages(t *testing.T) {
+	store := storage.NewStore()
+	saveRaw(t, store, plainMessage)
+	c := dial(t, store, Options{})
+
+	c.run("SELECT INBOX")
+	c.run(`STORE 1 +FLAGS (\Deleted)`)
+	c.run("EXAMINE INBOX")
+	c.run("CLOSE")
+	if out := c.run("SELECT INBOX"); !strings.Contains(out, "* 1 EXISTS") {
+		t.Errorf("SELECT after CLOSE of an EXAMINEd mailbox = %q, want the message kept", out)
+	}
+}
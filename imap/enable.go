@@ -0,0 +1,62 @@
+package imap
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/server"
+)
+
+// utf8AcceptCapability is the RFC 6855 capability clients can ENABLE
+const utf8AcceptCapability = "UTF8=ACCEPT"
+
+// enableExtension implements the ENABLE extension (RFC 5161)
+type enableExtension struct{}
+
+// Capabilities returns the capabilities advertised by the extension
+func (ext *enableExtension) Capabilities(c server.Conn) []string {
+	return []string{"ENABLE", utf8AcceptCapability}
+}
+
+// Command returns the handler factory for the ENABLE command
+func (ext *enableExtension) Command(name string) server.HandlerFactory {
+	if name != "ENABLE" {
+		return nil
+	}
+
+	return func() server.Handler {
+		return &enableHandler{}
+	}
+}
+
+// enableHandler handles the ENABLE command
+type enableHandler struct {
+	commands.Enable
+}
+
+// Handle enables the supported capabilities requested by the client
+func (h *enableHandler) Handle(conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.State != imap.AuthenticatedState {
+		return errors.New("ENABLE is only valid in authenticated state")
+	}
+
+	user, ok := ctx.User.(*User)
+	if !ok {
+		return errors.New("not authenticated")
+	}
+
+	// Unknown capabilities are silently ignored as required by RFC 5161
+	var enabled []string
+	for _, c := range h.Caps {
+		if strings.EqualFold(c, utf8AcceptCapability) {
+			user.utf8Accept = true
+			enabled = append(enabled, utf8AcceptCapability)
+		}
+	}
+
+	return conn.WriteResp(&responses.Enabled{Caps: enabled})
+}
@@ -0,0 +1,122 @@
+package imap
+
+import (
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/server"
+)
+
+// fetchExtension overrides go-imap's FETCH handler, whose envelopes always
+// encode the subject and display names as RFC 2047 words. Envelopes are
+// sent as buildEnvelope made them instead, which encodes them unless the
+// client enabled UTF8=ACCEPT.
+type fetchExtension struct{}
+
+// Capabilities returns nothing, FETCH is part of IMAP4rev1
+func (ext *fetchExtension) Capabilities(c server.Conn) []string {
+	return nil
+}
+
+// Command returns the handler factory for the FETCH and UID FETCH commands
+func (ext *fetchExtension) Command(name string) server.HandlerFactory {
+	if name != "FETCH" {
+		return nil
+	}
+
+	return func() server.Handler {
+		return &fetchHandler{}
+	}
+}
+
+// fetchHandler handles the FETCH command
+type fetchHandler struct {
+	commands.Fetch
+}
+
+// Handle fetches messages by sequence number
+func (h *fetchHandler) Handle(conn server.Conn) error {
+	return h.handle(false, conn)
+}
+
+// UidHandle fetches messages by UID, always including the UID item
+func (h *fetchHandler) UidHandle(conn server.Conn) error {
+	hasUid := false
+	for _, item := range h.Items {
+		if item == imap.FetchUid {
+			hasUid = true
+		}
+	}
+	if !hasUid {
+		h.Items = append(h.Items, imap.FetchUid)
+	}
+	return h.handle(true, conn)
+}
+
+// handle streams the messages from the mailbox to the client as they are
+// listed, like go-imap's handler
+func (h *fetchHandler) handle(uid bool, conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return server.ErrNoMailboxSelected
+	}
+
+	ch := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.WriteResp(&fetchResponse{messages: ch})
+		// Drain the channel if writing failed
+		for range ch {
+		}
+	}()
+
+	if err := ctx.Mailbox.ListMessages(uid, h.SeqSet, h.Items, ch); err != nil {
+		return err
+	}
+	return <-done
+}
+
+// fetchResponse writes untagged FETCH responses for the messages sent on
+// its channel until it is closed
+type fetchResponse struct {
+	messages <-chan *imap.Message
+}
+
+// WriteTo writes the responses, keeping on draining messages after a
+// write error
+func (r *fetchResponse) WriteTo(w *imap.Writer) error {
+	var err error
+	for msg := range r.messages {
+		fields := msg.Format()
+		for i := 0; i+1 < len(fields); i += 2 {
+			if fields[i] == imap.RawString(imap.FetchEnvelope) && msg.Envelope != nil {
+				fields[i+1] = formatEnvelope(msg.Envelope)
+			}
+		}
+
+		resp := imap.NewUntaggedResp([]interface{}{msg.SeqNum, imap.RawString("FETCH"), fields})
+		if err == nil {
+			err = resp.WriteTo(w)
+		}
+	}
+	return err
+}
+
+// formatEnvelope formats an envelope like go-imap, but with the subject and
+// display names as they are rather than encoded. Non-ASCII values are
+// written as literals.
+func formatEnvelope(e *imap.Envelope) []interface{} {
+	fields := e.Format()
+	if e.Subject != "" {
+		fields[1] = e.Subject
+	}
+
+	lists := [][]*imap.Address{e.From, e.Sender, e.ReplyTo, e.To, e.Cc, e.Bcc}
+	for i, addrs := range lists {
+		for j, addr := range addrs {
+			if addr.PersonalName != "" {
+				fields[2+i].([]interface{})[j].([]interface{})[0] = addr.PersonalName
+			}
+		}
+	}
+	return fields
+}
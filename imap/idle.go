@@ -0,0 +1,98 @@
+package imap
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/server"
+)
+
+// idleExtension replaces go-imap's IDLE handler with one that ends the
+// session once an IDLE has lasted max, so clients that never send DONE
+// don't hold their connection forever
+type idleExtension struct {
+	max   time.Duration
+	armed bool // Set by enableIdle once the extension is registered
+}
+
+// enableIdle registers ext on s so its handler replaces go-imap's IDLE.
+// Enable drops any extension handling IDLE, meant to skip the obsolete
+// go-imap-idle package, so ext only starts returning its handler after
+// Enable has accepted it. Extensions take precedence over built-in
+// commands, see server.Server.Command.
+func enableIdle(s *server.Server, ext *idleExtension) {
+	s.Enable(ext)
+	ext.armed = true
+}
+
+// Capabilities returns nothing, IDLE is already advertised by go-imap
+func (ext *idleExtension) Capabilities(c server.Conn) []string {
+	return nil
+}
+
+// Command returns the handler factory for the IDLE command
+func (ext *idleExtension) Command(name string) server.HandlerFactory {
+	if name != "IDLE" || !ext.armed {
+		return nil
+	}
+
+	return func() server.Handler {
+		return &idleHandler{max: ext.max}
+	}
+}
+
+// idleHandler handles the IDLE command
+type idleHandler struct {
+	commands.Idle
+	max time.Duration
+}
+
+// Handle waits for the client's DONE. If it doesn't arrive within max, the
+// client is logged out with a BYE, as RFC 2177 allows for inactivity
+// timeouts, so it can reconnect and IDLE again rather than seeing the
+// connection drop.
+func (h *idleHandler) Handle(conn server.Conn) error {
+	if err := conn.WriteResp(&imap.ContinuationReq{Info: "idling"}); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(conn)
+		scanner.Scan()
+		if err := scanner.Err(); err != nil {
+			done <- err
+			return
+		}
+		if strings.ToUpper(scanner.Text()) != "DONE" {
+			done <- errors.New("Expected DONE")
+			return
+		}
+		done <- nil
+	}()
+
+	timer := time.NewTimer(h.max)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+	}
+
+	log.Printf("IMAP IDLE from %s exceeded %s, logging out", conn.Info().RemoteAddr, h.max)
+	bye := &imap.StatusResp{Type: imap.StatusRespBye, Info: "IDLE time limit reached, reconnect to continue"}
+	if err := conn.WriteResp(bye); err != nil {
+		return err
+	}
+
+	// The session ends before another command is read, which also stops
+	// the reader above once the connection is closed
+	conn.Context().State = imap.LogoutState
+	return nil
+}
@@ -0,0 +1,50 @@
+package imap
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"mailer/storage"
+)
+
+// readLine reads one line from the server, failing the test on errors
+func (c *session) readLine() string {
+	c.t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("reading: %v", err)
+	}
+	return line
+}
+
+// TestIdleMax checks the server's own IDLE handler is used: an IDLE that
+// outlasts -idle-max is ended with a BYE, while one ended by DONE in time
+// completes normally
+func TestIdleMax(t *testing.T) {
+	c := dial(t, storage.NewStore(), Options{IdleMax: 200 * time.Millisecond})
+	c.run("SELECT INBOX")
+
+	fmt.Fprintf(c.conn, "i1 IDLE\r\n")
+	if line := c.readLine(); !strings.HasPrefix(line, "+ ") {
+		t.Fatalf("IDLE = %q, want a continuation", line)
+	}
+	fmt.Fprintf(c.conn, "DONE\r\n")
+	if line := c.readLine(); !strings.HasPrefix(line, "i1 OK") {
+		t.Fatalf("IDLE ended by DONE = %q, want OK", line)
+	}
+
+	fmt.Fprintf(c.conn, "i2 IDLE\r\n")
+	if line := c.readLine(); !strings.HasPrefix(line, "+ ") {
+		t.Fatalf("IDLE = %q, want a continuation", line)
+	}
+	start := time.Now()
+	line := c.readLine()
+	if !strings.HasPrefix(line, "* BYE") || !strings.Contains(line, "IDLE time limit") {
+		t.Fatalf("IDLE past the limit = %q, want the IDLE time limit BYE", line)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("BYE came after %s, want about 200ms", elapsed)
+	}
+}
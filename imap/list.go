@@ -0,0 +1,246 @@
+package imap
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-imap/utf7"
+)
+
+// specialUseAttrs are the mailbox attributes defined by RFC 6154
+var specialUseAttrs = []string{`\All`, `\Archive`, `\Drafts`, `\Flagged`, `\Junk`, `\Sent`, `\Trash`}
+
+// listExtension implements LIST-EXTENDED (RFC 5258) with the SPECIAL-USE
+// (RFC 6154) and STATUS (RFC 5819) return options
+type listExtension struct{}
+
+// Capabilities returns the capabilities advertised by the extension
+func (ext *listExtension) Capabilities(c server.Conn) []string {
+	return []string{"LIST-EXTENDED", "LIST-STATUS", "SPECIAL-USE"}
+}
+
+// Command returns the handler factory for the extended LIST command
+func (ext *listExtension) Command(name string) server.HandlerFactory {
+	if name != "LIST" {
+		return nil
+	}
+
+	return func() server.Handler {
+		return &listHandler{}
+	}
+}
+
+// listHandler handles basic and extended LIST commands
+type listHandler struct {
+	Reference string
+	Patterns  []string
+
+	SelectSpecialUse bool // Only list mailboxes with a special-use attribute
+	ReturnSpecialUse bool // Include special-use attributes in the response
+	ReturnChildren   bool // Include \HasChildren/\HasNoChildren attributes
+	ReturnStatus     []imap.StatusItem
+}
+
+// Parse parses LIST [(selection-opts)] reference patterns [RETURN (return-opts)]
+func (h *listHandler) Parse(fields []interface{}) error {
+	// Optional selection options
+	if len(fields) > 0 {
+		if opts, ok := fields[0].([]interface{}); ok {
+			for _, opt := range opts {
+				name, err := imap.ParseString(opt)
+				if err != nil {
+					return err
+				}
+				if strings.EqualFold(name, "SPECIAL-USE") {
+					h.SelectSpecialUse = true
+				}
+			}
+			fields = fields[1:]
+		}
+	}
+
+	if len(fields) < 2 {
+		return errors.New("not enough arguments")
+	}
+
+	dec := utf7.Encoding.NewDecoder()
+	reference, err := imap.ParseString(fields[0])
+	if err != nil {
+		return err
+	}
+	if reference, err = dec.String(reference); err != nil {
+		return err
+	}
+	h.Reference = imap.CanonicalMailboxName(reference)
+
+	// A single pattern or a parenthesized list of patterns
+	patterns := []interface{}{fields[1]}
+	if list, ok := fields[1].([]interface{}); ok {
+		patterns = list
+	}
+	for _, p := range patterns {
+		pattern, err := imap.ParseString(p)
+		if err != nil {
+			return err
+		}
+		if pattern, err = dec.String(pattern); err != nil {
+			return err
+		}
+		h.Patterns = append(h.Patterns, imap.CanonicalMailboxName(pattern))
+	}
+
+	// Optional return options
+	fields = fields[2:]
+	if len(fields) == 0 {
+		return nil
+	}
+	if keyword, err := imap.ParseString(fields[0]); err != nil || !strings.EqualFold(keyword, "RETURN") || len(fields) < 2 {
+		return errors.New("expected RETURN options")
+	}
+	opts, ok := fields[1].([]interface{})
+	if !ok {
+		return errors.New("RETURN options must be a list")
+	}
+	for i := 0; i < len(opts); i++ {
+		name, err := imap.ParseString(opts[i])
+		if err != nil {
+			return err
+		}
+
+		switch strings.ToUpper(name) {
+		case "SPECIAL-USE":
+			h.ReturnSpecialUse = true
+		case "CHILDREN":
+			h.ReturnChildren = true
+		case "STATUS":
+			if i+1 >= len(opts) {
+				return errors.New("STATUS return option requires a list of items")
+			}
+			items, ok := opts[i+1].([]interface{})
+			if !ok {
+				return errors.New("STATUS return option requires a list of items")
+			}
+			for _, item := range items {
+				s, err := imap.ParseString(item)
+				if err != nil {
+					return err
+				}
+				h.ReturnStatus = append(h.ReturnStatus, imap.StatusItem(strings.ToUpper(s)))
+			}
+			i++
+		}
+	}
+
+	return nil
+}
+
+// Handle lists the matching mailboxes with the requested return data
+func (h *listHandler) Handle(conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return server.ErrNotAuthenticated
+	}
+
+	mailboxes, err := ctx.User.ListMailboxes(false)
+	if err != nil {
+		return err
+	}
+
+	for _, mbox := range mailboxes {
+		info, err := mbox.Info()
+		if err != nil {
+			return err
+		}
+
+		// An empty pattern requests the hierarchy delimiter only
+		if len(h.Patterns) == 1 && h.Patterns[0] == "" {
+			return conn.WriteResp(listResponse(&imap.MailboxInfo{
+				Attributes: []string{imap.NoSelectAttr},
+				Delimiter:  info.Delimiter,
+				Name:       info.Delimiter,
+			}))
+		}
+
+		if !h.matches(info) {
+			continue
+		}
+
+		specialUse := specialUseOf(info)
+		if h.SelectSpecialUse && len(specialUse) == 0 {
+			continue
+		}
+
+		// Special-use attributes are only returned when asked for
+		attrs := make([]string, 0, len(info.Attributes)+1)
+		for _, attr := range info.Attributes {
+			if h.ReturnSpecialUse || h.SelectSpecialUse || !isSpecialUse(attr) {
+				attrs = append(attrs, attr)
+			}
+		}
+		if h.ReturnChildren {
+			attrs = append(attrs, imap.HasNoChildrenAttr)
+		}
+
+		if err := conn.WriteResp(listResponse(&imap.MailboxInfo{
+			Attributes: attrs,
+			Delimiter:  info.Delimiter,
+			Name:       info.Name,
+		})); err != nil {
+			return err
+		}
+
+		if len(h.ReturnStatus) > 0 {
+			status, err := mbox.Status(h.ReturnStatus)
+			if err != nil {
+				return err
+			}
+			if err := conn.WriteResp(&responses.Status{Mailbox: status}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// matches reports whether the mailbox matches any of the requested patterns
+func (h *listHandler) matches(info *imap.MailboxInfo) bool {
+	for _, pattern := range h.Patterns {
+		if info.Match(h.Reference, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// listResponse wraps a single mailbox in a LIST response
+func listResponse(info *imap.MailboxInfo) *responses.List {
+	ch := make(chan *imap.MailboxInfo, 1)
+	ch <- info
+	close(ch)
+	return &responses.List{Mailboxes: ch}
+}
+
+// specialUseOf returns the special-use attributes of a mailbox
+func specialUseOf(info *imap.MailboxInfo) []string {
+	var attrs []string
+	for _, attr := range info.Attributes {
+		if isSpecialUse(attr) {
+			attrs = append(attrs, attr)
+		}
+	}
+	return attrs
+}
+
+// isSpecialUse reports whether attr is a special-use attribute
+func isSpecialUse(attr string) bool {
+	for _, special := range specialUseAttrs {
+		if strings.EqualFold(attr, special) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package imap
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/server"
+	"mailer/storage"
+)
+
+// specialUseBackend logs in users that also see a Trash and an Archive
+// mailbox, which the real backend doesn't have
+type specialUseBackend struct {
+	*Backend
+}
+
+func (b specialUseBackend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	user, err := b.Backend.Login(connInfo, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return specialUseUser{user.(*User)}, nil
+}
+
+// specialUseUser lists INBOX followed by Trash and Archive, which show the
+// same messages as INBOX
+type specialUseUser struct {
+	*User
+}
+
+func (u specialUseUser) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	mailboxes, err := u.User.ListMailboxes(subscribed)
+	if err != nil {
+		return nil, err
+	}
+	for _, special := range []struct{ name, attr string }{{"Trash", `\Trash`}, {"Archive", `\Archive`}} {
+		mailboxes = append(mailboxes, specialUseMailbox{
+			Mailbox: &Mailbox{name: special.name, user: u.User, backend: u.backend, deletedFlags: u.deletedFlags},
+			attr:    special.attr,
+		})
+	}
+	return mailboxes, nil
+}
+
+// specialUseMailbox is a mailbox carrying a special-use attribute
+type specialUseMailbox struct {
+	*Mailbox
+	attr string
+}
+
+func (m specialUseMailbox) Info() (*imap.MailboxInfo, error) {
+	info, err := m.Mailbox.Info()
+	if err != nil {
+		return nil, err
+	}
+	info.Attributes = append(info.Attributes, m.attr)
+	return info, nil
+}
+
+func TestListExtended(t *testing.T) {
+	store := storage.NewStore()
+	saveRaw(t, store, plainMessage)
+	s := server.New(specialUseBackend{NewBackend(store, storage.NewConnectionRegistry(), Options{})})
+	s.Enable(extensions...)
+	s.AllowInsecureAuth = true
+	c := connect(t, s)
+
+	if caps := c.run("CAPABILITY"); !strings.Contains(caps, "LIST-EXTENDED") || !strings.Contains(caps, "SPECIAL-USE") {
+		t.Errorf("CAPABILITY = %q, want LIST-EXTENDED and SPECIAL-USE", caps)
+	}
+
+	tests := []struct {
+		command string
+		want    []string // Untagged responses in order
+	}{
+		{
+			`LIST "" "*"`,
+			[]string{
+				`* LIST () "/" INBOX`,
+				`* LIST () "/" "Trash"`,
+				`* LIST () "/" "Archive"`,
+			},
+		},
+		{
+			`LIST "" "*" RETURN (SPECIAL-USE STATUS (UNSEEN))`,
+			[]string{
+				`* LIST () "/" INBOX`,
+				`* STATUS INBOX (UNSEEN 1)`,
+				`* LIST (\Trash) "/" "Trash"`,
+				`* STATUS "Trash" (UNSEEN 1)`,
+				`* LIST (\Archive) "/" "Archive"`,
+				`* STATUS "Archive" (UNSEEN 1)`,
+			},
+		},
+		{
+			`LIST (SPECIAL-USE) "" "*"`,
+			[]string{
+				`* LIST (\Trash) "/" "Trash"`,
+				`* LIST (\Archive) "/" "Archive"`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		lines := strings.Split(strings.TrimSuffix(c.run(tt.command), "\r\n"), "\r\n")
+		got := lines[:len(lines)-1]
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s =\n%s\nwant\n%s", tt.command, strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+		}
+	}
+}
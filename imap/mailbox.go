@@ -1,21 +1,35 @@
 package imap
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/mail"
+	"strings"
 	"time"
 
 	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-message/textproto"
 	"mailer/models"
+	"mailer/smtp"
 )
 
 // Mailbox implements the IMAP mailbox interface
 type Mailbox struct {
-	name           string
-	user           *User
-	backend        *Backend
-	deletedFlags   map[uint32]bool // Track which messages are marked for deletion
+	name         string
+	user         *User
+	backend      *Backend
+	deletedFlags map[uint32]*models.Email // Track which messages are marked for deletion
+	readOnly     bool                     // Opened with EXAMINE, see selectExtension
+
+	appended  uint32 // UID of the email the last APPEND stored or matched, see appendExtension
+	duplicate bool   // The last APPEND matched an existing email and stored nothing
 }
 
 // Name returns the mailbox name
@@ -33,27 +47,57 @@ func (m *Mailbox) Info() (*imap.MailboxInfo, error) {
 	return info, nil
 }
 
+// emails returns the messages visible to the user: all of them, or with a
+// per-recipient view those addressed to the user. Views only filter the
+// single stored copy, so deleting a message removes it for every recipient.
+// The result is shared with other sessions and must not be modified.
+func (m *Mailbox) emails() []*models.Email {
+	emails := m.backend.store.Snapshot()
+	if m.user.recipient == "" {
+		return emails
+	}
+
+	visible := make([]*models.Email, 0, len(emails))
+	for _, email := range emails {
+		if email.HasRecipient(m.user.recipient) {
+			visible = append(visible, email)
+		}
+	}
+	return visible
+}
+
 // Status returns the mailbox status
 func (m *Mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
-	emails := m.backend.store.GetAll()
+	emails := m.emails()
 
 	status := imap.NewMailboxStatus(m.name, items)
-	status.Flags = []string{imap.SeenFlag, imap.DeletedFlag}
-	status.PermanentFlags = []string{imap.SeenFlag, imap.DeletedFlag}
+	// \* announces that clients may create their own keywords
+	status.Flags = []string{imap.SeenFlag, imap.AnsweredFlag, imap.FlaggedFlag, imap.DeletedFlag, imap.DraftFlag}
+	status.PermanentFlags = []string{imap.SeenFlag, imap.AnsweredFlag, imap.FlaggedFlag, imap.DeletedFlag, imap.DraftFlag, imap.TryCreateFlag}
 	status.UnseenSeqNum = 0
 
+	unseen := uint32(0)
+	for i, email := range emails {
+		if !m.backend.store.HasFlag(email.ID, imap.SeenFlag) {
+			unseen++
+			if status.UnseenSeqNum == 0 {
+				status.UnseenSeqNum = uint32(i + 1)
+			}
+		}
+	}
+
 	for _, item := range items {
 		switch item {
 		case imap.StatusMessages:
 			status.Messages = uint32(len(emails))
 		case imap.StatusUidNext:
-			status.UidNext = uint32(len(emails) + 1)
+			status.UidNext = uint32(m.backend.store.NextID())
 		case imap.StatusUidValidity:
-			status.UidValidity = 1
+			status.UidValidity = m.backend.store.UIDValidity()
 		case imap.StatusRecent:
 			status.Recent = 0
 		case imap.StatusUnseen:
-			status.Unseen = 0
+			status.Unseen = unseen
 		}
 	}
 
@@ -74,39 +118,46 @@ func (m *Mailbox) Check() error {
 func (m *Mailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
 	defer close(ch)
 
-	emails := m.backend.store.GetAll()
+	emails := m.emails()
 
 	for i, email := range emails {
 		seqNum := uint32(i + 1)
 		uidNum := uint32(email.ID)
 
 		// Check if this message is in the requested sequence set
-		checkNum := seqNum
-		if uid {
-			checkNum = uidNum
-		}
-		if !seqset.Contains(checkNum) {
+		if !inSeqSet(uid, seqset, emails, i) {
 			continue
 		}
 
+		// Fetching content without PEEK implicitly sets \Seen (RFC 3501 6.4.5),
+		// except in a mailbox opened with EXAMINE
+		if marksSeen(items) && !m.readOnly {
+			m.backend.store.SetFlag(email.ID, imap.SeenFlag, true)
+		}
+
 		msg := imap.NewMessage(seqNum, items)
 		for _, item := range items {
 			switch item {
 			case imap.FetchEnvelope:
 				msg.Envelope = m.buildEnvelope(email)
 			case imap.FetchBody, imap.FetchBodyStructure:
-				msg.BodyStructure = m.buildBodyStructure(email)
+				msg.BodyStructure = m.buildBodyStructure(email, item == imap.FetchBodyStructure)
 			case imap.FetchFlags:
-				msg.Flags = []string{}
-				if m.deletedFlags[uidNum] {
-					msg.Flags = append(msg.Flags, imap.DeletedFlag)
-				}
+				msg.Flags = m.flags(email)
 			case imap.FetchInternalDate:
 				msg.InternalDate = email.ReceivedAt
 			case imap.FetchRFC822Size:
-				msg.Size = uint32(len(email.Body))
+				msg.Size = m.messageSize(email)
 			case imap.FetchUid:
 				msg.Uid = uidNum
+			case imap.FetchRFC822, imap.FetchRFC822Header, imap.FetchRFC822Text:
+				// RFC 1730 items are answered as BODY[], BODY.PEEK[HEADER] and
+				// BODY[TEXT], but the response keeps the requested item name
+				section, err := imap.ParseBodySectionName(item)
+				if err != nil {
+					continue
+				}
+				msg.Body[section] = m.buildBody(email, section)
 			default:
 				// Handle BODY[] and BODY[HEADER] requests
 				section, err := imap.ParseBodySectionName(item)
@@ -123,153 +174,326 @@ func (m *Mailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.Fetch
 	return nil
 }
 
+// inSeqSet reports whether emails[i] is in seqset, comparing its UID when uid
+// is set and its sequence number otherwise. "*" stands for the largest number
+// in use, so "*" and "n:*" with n past the end still match the last message
+// (RFC 3501 6.4.8 and 9).
+func inSeqSet(uid bool, seqset *imap.SeqSet, emails []*models.Email, i int) bool {
+	num, largest := uint32(i+1), uint32(len(emails))
+	if uid {
+		num, largest = uint32(emails[i].ID), uint32(emails[len(emails)-1].ID)
+	}
+
+	for _, seq := range seqset.Set {
+		start, stop := seq.Start, seq.Stop
+		if start == 0 {
+			start = largest
+		}
+		if stop == 0 {
+			stop = largest
+		}
+		if start > stop {
+			start, stop = stop, start
+		}
+		if start <= num && num <= stop {
+			return true
+		}
+	}
+	return false
+}
+
 // buildEnvelope creates an IMAP envelope from an email
 func (m *Mailbox) buildEnvelope(email *models.Email) *imap.Envelope {
+	from := m.envelopeAddress(parseAddress(email.From))
+	to := parseAddresses(email.To)
+	for _, addr := range to {
+		m.envelopeAddress(addr)
+	}
+
 	return &imap.Envelope{
 		Date:    email.Date,
-		Subject: email.Subject,
-		From:    []*imap.Address{parseAddress(email.From)},
-		To:      parseAddresses(email.To),
-		Sender:  []*imap.Address{parseAddress(email.From)},
+		Subject: m.headerValue(email.Subject),
+		From:    []*imap.Address{from},
+		To:      to,
+		Sender:  []*imap.Address{from},
+	}
+}
+
+// envelopeAddress encodes the display name of an envelope address like
+// other header values, see headerValue
+func (m *Mailbox) envelopeAddress(addr *imap.Address) *imap.Address {
+	if addr.PersonalName != "" {
+		addr.PersonalName = m.headerValue(addr.PersonalName)
 	}
+	return addr
 }
 
-// buildBodyStructure creates a body structure for an email
-func (m *Mailbox) buildBodyStructure(email *models.Email) *imap.BodyStructure {
-	if email.HTMLBody != "" {
-		// Multipart message with text and HTML
-		return &imap.BodyStructure{
-			MIMEType:    "multipart",
-			MIMESubType: "alternative",
-			Parts: []*imap.BodyStructure{
-				{
-					MIMEType:    "text",
-					MIMESubType: "plain",
-					Params:      map[string]string{"charset": "utf-8"},
-					Size:        uint32(len(email.Body)),
-				},
-				{
-					MIMEType:    "text",
-					MIMESubType: "html",
-					Params:      map[string]string{"charset": "utf-8"},
-					Size:        uint32(len(email.HTMLBody)),
-				},
-			},
+// buildBodyStructure creates the body structure of the message buildBody
+// serves, extended for BODYSTRUCTURE
+func (m *Mailbox) buildBodyStructure(email *models.Email, extended bool) *imap.BodyStructure {
+	if header, body, err := rawEntity(email); err == nil {
+		if bs, err := backendutil.FetchBodyStructure(header, body, extended); err == nil {
+			return bs
 		}
 	}
 
-	// Plain text only
+	// The rebuilt message has a single text part
+	subType, body := "plain", email.Body
+	if html := sentHTML(email); html != "" {
+		subType, body = "html", html
+	}
 	return &imap.BodyStructure{
 		MIMEType:    "text",
-		MIMESubType: "plain",
+		MIMESubType: subType,
 		Params:      map[string]string{"charset": "utf-8"},
-		Size:        uint32(len(email.Body)),
+		Encoding:    "8bit",
+		Size:        uint32(len(body)),
+		Lines:       uint32(strings.Count(body, "\n")),
+		Extended:    extended,
 	}
 }
 
-// buildBody creates the body content for an email
+// rawEntity splits the raw message of an email into its header and body
+func rawEntity(email *models.Email) (textproto.Header, io.Reader, error) {
+	if email.Raw == nil {
+		return textproto.Header{}, nil, errors.New("no raw message")
+	}
+	br := bufio.NewReader(bytes.NewReader(email.Raw))
+	header, err := textproto.ReadHeader(br)
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	return header, br, nil
+}
+
+// messageSize returns the size reported as RFC822.SIZE and compared by
+// SEARCH LARGER and SMALLER: that of the whole message BODY[] returns
+func (m *Mailbox) messageSize(email *models.Email) uint32 {
+	if email.Raw != nil {
+		return uint32(len(email.Raw))
+	}
+	n, _ := io.Copy(io.Discard, m.buildBody(email, &imap.BodySectionName{}))
+	return uint32(n)
+}
+
+// sentHTML returns the email's HTML body unless it was generated by
+// -wrap-text, which clients should not see as a part of the message
+func sentHTML(email *models.Email) string {
+	if email.GeneratedHTML {
+		return ""
+	}
+	return email.HTMLBody
+}
+
+// buildBody returns a body section of an email. Emails with a raw message
+// are served from it, with parts and transfer encodings as received;
+// others from a single-part message rebuilt from the stored fields.
 func (m *Mailbox) buildBody(email *models.Email, section *imap.BodySectionName) imap.Literal {
+	if header, body, err := rawEntity(email); err == nil {
+		literal, err := backendutil.FetchBodySection(header, body, section)
+		if err != nil {
+			// A part that doesn't exist is returned empty (RFC 3501 6.4.5)
+			return bytes.NewReader(nil)
+		}
+		return literal
+	}
+
+	// The only part of the rebuilt message is its body
+	if len(section.Path) > 0 {
+		if len(section.Path) > 1 || section.Path[0] != 1 {
+			return bytes.NewReader(nil)
+		}
+		if section.Specifier == imap.EntireSpecifier {
+			section = &imap.BodySectionName{BodyPartName: imap.BodyPartName{Specifier: imap.TextSpecifier}, Partial: section.Partial}
+		}
+	}
+
 	var buf bytes.Buffer
 
-	if section.Specifier == imap.HeaderSpecifier {
-		// Return headers
-		fmt.Fprintf(&buf, "From: %s\r\n", email.From)
-		fmt.Fprintf(&buf, "To: %s\r\n", email.To[0])
-		fmt.Fprintf(&buf, "Subject: %s\r\n", email.Subject)
-		fmt.Fprintf(&buf, "Date: %s\r\n", email.Date.Format(time.RFC1123Z))
-		buf.WriteString("\r\n")
-	} else {
-		// Return full message
+	// Header-only fetches return the headers exactly as received when known
+	if section.Specifier == imap.HeaderSpecifier && email.RawHeaderBlock != "" {
+		buf.WriteString(email.RawHeaderBlock)
+		buf.WriteString("\r\n\r\n")
+		return bytes.NewReader(section.ExtractPartial(buf.Bytes()))
+	}
+
+	// Header block, followed by the body unless only the header was asked for
+	if section.Specifier != imap.TextSpecifier {
 		fmt.Fprintf(&buf, "From: %s\r\n", email.From)
-		fmt.Fprintf(&buf, "To: %s\r\n", email.To[0])
-		fmt.Fprintf(&buf, "Subject: %s\r\n", email.Subject)
+		fmt.Fprintf(&buf, "To: %s\r\n", models.FormatAddressList(email.To))
+		fmt.Fprintf(&buf, "Subject: %s\r\n", m.headerValue(email.Subject))
 		fmt.Fprintf(&buf, "Date: %s\r\n", email.Date.Format(time.RFC1123Z))
 
 		// Add Content-Type header
-		if email.HTMLBody != "" {
+		if sentHTML(email) != "" {
 			buf.WriteString("Content-Type: text/html; charset=utf-8\r\n")
 		} else {
 			buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
 		}
 		buf.WriteString("\r\n")
+	}
 
-		if email.HTMLBody != "" {
-			buf.WriteString(email.HTMLBody)
+	if section.Specifier != imap.HeaderSpecifier {
+		if html := sentHTML(email); html != "" {
+			buf.WriteString(html)
 		} else {
 			buf.WriteString(email.Body)
 		}
 	}
 
-	return bytes.NewReader(buf.Bytes())
+	return bytes.NewReader(section.ExtractPartial(buf.Bytes()))
 }
 
-// SearchMessages searches for messages
-func (m *Mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
-	emails := m.backend.store.GetAll()
+// headerValue encodes non-ASCII header values as RFC 2047 words unless the
+// client has enabled UTF8=ACCEPT, in which case raw UTF-8 is sent
+func (m *Mailbox) headerValue(value string) string {
+	if m.user.utf8Accept {
+		dec := new(mime.WordDecoder)
+		if decoded, err := dec.DecodeHeader(value); err == nil {
+			return decoded
+		}
+		return value
+	}
+	return mime.QEncoding.Encode("utf-8", value)
+}
 
-	// For simplicity, return all message sequence numbers
-	// A full implementation would filter based on criteria
-	results := make([]uint32, 0, len(emails))
+// SearchMessages returns the sequence numbers, or UIDs when uid is set, of
+// the messages matching the criteria
+func (m *Mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	emails := m.emails()
 
+	var results []uint32
 	for i, email := range emails {
-		seqNum := uint32(i + 1)
-		uidNum := uint32(email.ID)
+		if !m.matchCriteria(m.newSearchMessage(emails, i), criteria) {
+			continue
+		}
 
 		if uid {
-			results = append(results, uidNum)
+			results = append(results, uint32(email.ID))
 		} else {
-			results = append(results, seqNum)
+			results = append(results, uint32(i+1))
 		}
 	}
 
 	return results, nil
 }
 
-// CreateMessage creates a new message (not supported)
+// CreateMessage stores a message uploaded with APPEND, recording its UID
+// for appendExtension
 func (m *Mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
-	return errors.New("creating messages is not supported")
-}
+	email, err := smtp.ParseMessage(body, "", nil, m.backend.opts.Parse)
+	if err != nil {
+		return fmt.Errorf("invalid message: %w", err)
+	}
 
-// UpdateMessagesFlags updates message flags (used for marking as deleted)
-func (m *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, flags []string) error {
-	emails := m.backend.store.GetAll()
+	if m.backend.opts.Dedup && email.MessageID != "" {
+		for _, existing := range m.emails() {
+			if existing.MessageID != email.MessageID {
+				continue
+			}
+			log.Printf("APPEND of %s matches email %d, not storing a duplicate", email.MessageID, existing.ID)
+			m.appended, m.duplicate = uint32(existing.ID), true
+			return nil
+		}
+	}
+	if !date.IsZero() {
+		email.ReceivedAt = date
+	}
 
-	// Check if we're setting the Deleted flag
-	hasDeletedFlag := false
+	id := m.backend.store.Save(email)
+	m.appended, m.duplicate = uint32(id), false
+	log.Printf("Email appended via IMAP and stored with ID: %d (From: %s, Subject: %s)", id, email.From, email.Subject)
 	for _, flag := range flags {
-		if flag == imap.DeletedFlag {
-			hasDeletedFlag = true
-			break
-		}
+		m.setFlag(email, flag, true)
 	}
 
-	if !hasDeletedFlag {
-		return nil
+	return nil
+}
+
+// UpdateMessagesFlags updates the flags of messages. \Deleted is kept per
+// mailbox until EXPUNGE; all other flags, including custom keywords, are
+// stored with the email and shared by all sessions.
+func (m *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, flags []string) error {
+	if m.readOnly {
+		return server.ErrMailboxReadOnly
 	}
 
-	// Mark messages as deleted
-	for i, email := range emails {
-		seqNum := uint32(i + 1)
-		uidNum := uint32(email.ID)
+	emails := m.emails()
 
-		// Check correct identifier based on uid flag
-		checkNum := seqNum
-		if uid {
-			checkNum = uidNum
+	for i, email := range emails {
+		if !inSeqSet(uid, seqset, emails, i) {
+			continue
 		}
 
-		if seqset.Contains(checkNum) {
-			if operation == imap.AddFlags || operation == imap.SetFlags {
-				m.deletedFlags[uidNum] = true
-			} else if operation == imap.RemoveFlags {
-				delete(m.deletedFlags, uidNum)
+		if operation == imap.SetFlags {
+			for _, flag := range m.flags(email) {
+				if !containsFlag(flags, flag) {
+					m.setFlag(email, flag, false)
+				}
 			}
 		}
+		for _, flag := range flags {
+			m.setFlag(email, flag, operation != imap.RemoveFlags)
+		}
 	}
 
 	return nil
 }
 
+// setFlag sets or clears a flag on an email. Flags are case-insensitive, so
+// they are stored in go-imap's canonical form, which lowercases keywords.
+func (m *Mailbox) setFlag(email *models.Email, flag string, set bool) {
+	switch flag = imap.CanonicalFlag(flag); flag {
+	case imap.DeletedFlag:
+		if set {
+			m.deletedFlags[uint32(email.ID)] = email
+		} else {
+			delete(m.deletedFlags, uint32(email.ID))
+		}
+	case imap.RecentFlag:
+		// \Recent is managed by the server only
+	default:
+		m.backend.store.SetFlag(email.ID, flag, set)
+	}
+}
+
+// flags returns the flags currently set on an email
+func (m *Mailbox) flags(email *models.Email) []string {
+	flags := m.backend.store.Flags(email.ID)
+	if m.isDeleted(email) {
+		flags = append(flags, imap.DeletedFlag)
+	}
+	return flags
+}
+
+// containsFlag reports whether flags contains flag, ignoring case
+func containsFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// marksSeen reports whether fetching items implicitly sets \Seen, which is
+// the case for RFC822, RFC822.TEXT and any non-PEEK body section
+func marksSeen(items []imap.FetchItem) bool {
+	for _, item := range items {
+		switch item {
+		case imap.FetchRFC822, imap.FetchRFC822Text:
+			return true
+		case imap.FetchRFC822Header:
+			continue
+		}
+		section, err := imap.ParseBodySectionName(item)
+		if err == nil && !section.Peek {
+			return true
+		}
+	}
+	return false
+}
+
 // CopyMessages copies messages to another mailbox (not supported)
 func (m *Mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error {
 	return errors.New("copying messages is not supported")
@@ -277,22 +501,48 @@ func (m *Mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error
 
 // Expunge permanently removes messages marked as deleted
 func (m *Mailbox) Expunge() error {
-	// Delete all messages marked for deletion
-	for emailID := range m.deletedFlags {
-		m.backend.store.Delete(int(emailID))
+	if m.readOnly {
+		return server.ErrMailboxReadOnly
 	}
 
-	// Clear the deleted flags map
-	m.deletedFlags = make(map[uint32]bool)
+	// Delete all messages marked for deletion. Emails removed concurrently
+	// (e.g. via the HTTP API) are skipped, and an ID reused after a clear
+	// never matches the flagged email, so the wrong message can't be removed.
+	for uid, email := range m.deletedFlags {
+		m.backend.store.DeleteEmail(email)
+		delete(m.deletedFlags, uid)
+	}
 
 	return nil
 }
 
-// parseAddress parses an email address string into an IMAP address
+// isDeleted reports whether the email is marked for deletion
+func (m *Mailbox) isDeleted(email *models.Email) bool {
+	flagged, ok := m.deletedFlags[uint32(email.ID)]
+	return ok && flagged == email
+}
+
+// parseAddress parses an email address string, with or without a display
+// name, into an IMAP address. Unparseable input falls back to splitting the
+// raw string at its last "@".
 func parseAddress(addr string) *imap.Address {
+	var personalName string
+	if parsed, err := mail.ParseAddress(addr); err == nil {
+		personalName = parsed.Name
+		addr = parsed.Address
+	} else {
+		addr = strings.Trim(strings.TrimSpace(addr), "<>")
+	}
+
+	mailbox, host := addr, ""
+	if at := strings.LastIndex(addr, "@"); at >= 0 {
+		mailbox, host = addr[:at], addr[at+1:]
+	}
+
 	return &imap.Address{
-		MailboxName: addr,
-		HostName:    "",
+		PersonalName: personalName,
+		MailboxName:  mailbox,
+		HostName:     host,
 	}
 }
 
@@ -0,0 +1,593 @@
+package imap
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/server"
+	"mailer/models"
+	"mailer/smtp"
+	"mailer/storage"
+)
+
+// newTestMailbox returns the INBOX of a fresh session on store
+func newTestMailbox(store *storage.Store) *Mailbox {
+	be := NewBackend(store, storage.NewConnectionRegistry(), Options{})
+	user := &User{username: "test", backend: be, deletedFlags: make(map[uint32]*models.Email)}
+	return &Mailbox{name: imap.InboxName, user: user, backend: be, deletedFlags: user.deletedFlags}
+}
+
+// saveRaw parses and stores a raw message, failing the test on parse errors
+func saveRaw(t testing.TB, store *storage.Store, raw string) *models.Email {
+	t.Helper()
+	email, err := smtp.ParseMessage(strings.NewReader(raw), "", nil, smtp.ParseOptions{})
+	if err != nil {
+		t.Fatalf("ParseMessage: %v", err)
+	}
+	store.Save(email)
+	return email
+}
+
+// fetch runs a FETCH of items for the messages in seqset
+func fetch(t testing.TB, m *Mailbox, uid bool, seqset string, items ...imap.FetchItem) []*imap.Message {
+	t.Helper()
+	set, err := imap.ParseSeqSet(seqset)
+	if err != nil {
+		t.Fatalf("ParseSeqSet(%q): %v", seqset, err)
+	}
+
+	ch := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() { done <- m.ListMessages(uid, set, items, ch) }()
+
+	var messages []*imap.Message
+	for msg := range ch {
+		messages = append(messages, msg)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("ListMessages: %v", err)
+	}
+	return messages
+}
+
+// sectionText returns the content of the body section fetched as item,
+// e.g. "BODY.PEEK[1]<0.2>"
+func sectionText(t testing.TB, msg *imap.Message, item imap.FetchItem) string {
+	t.Helper()
+	var literal imap.Literal
+	for section, l := range msg.Body {
+		if section.FetchItem() == item {
+			literal = l
+		}
+	}
+	if literal == nil {
+		t.Fatalf("no %s in the FETCH response", item)
+	}
+	data, err := io.ReadAll(literal)
+	if err != nil {
+		t.Fatalf("reading %s: %v", item, err)
+	}
+	return string(data)
+}
+
+// session is a raw IMAP connection to a test server, for checking what
+// goes over the wire
+type session struct {
+	t    testing.TB
+	conn net.Conn
+	r    *bufio.Reader
+	tag  int
+}
+
+// dial starts a server on store configured like StartServer and logs in
+// to it
+func dial(t testing.TB, store *storage.Store, opts Options) *session {
+	t.Helper()
+	return connect(t, newServer(NewBackend(store, storage.NewConnectionRegistry(), opts), opts))
+}
+
+// connect serves s on a free local port and logs in to it
+func connect(t testing.TB, s *server.Server) *session {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	s.ErrorLog = nopLogger{}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &session{t: t, conn: conn, r: bufio.NewReader(conn)}
+	if _, err := c.r.ReadString('\n'); err != nil {
+		t.Fatalf("reading greeting: %v", err)
+	}
+	c.run("LOGIN test test")
+	return c
+}
+
+// run sends a command and returns everything the server sent up to and
+// including the tagged reply, failing the test unless it is OK
+func (c *session) run(command string) string {
+	c.t.Helper()
+	out, status := c.try(command)
+	if status != "OK" {
+		c.t.Fatalf("%s: %s", command, out)
+	}
+	return out
+}
+
+// try sends a command and returns everything the server sent up to and
+// including the tagged reply, along with the reply's status
+func (c *session) try(command string) (string, string) {
+	c.t.Helper()
+	c.tag++
+	tag := fmt.Sprintf("a%d", c.tag)
+	fmt.Fprintf(c.conn, "%s %s\r\n", tag, command)
+
+	var out strings.Builder
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("%s: %v", command, err)
+		}
+		out.WriteString(line)
+		if rest, ok := strings.CutPrefix(line, tag+" "); ok {
+			status, _, _ := strings.Cut(rest, " ")
+			return out.String(), status
+		}
+	}
+}
+
+// nopLogger discards the server's error log
+type nopLogger struct{}
+
+func (nopLogger) Printf(format string, v ...interface{}) {}
+func (nopLogger) Println(v ...interface{})               {}
+
+const plainMessage = "From: Jane Doe <jane@example.com>\r\n" +
+	"To: bob@example.com\r\n" +
+	"Subject: Hello\r\n" +
+	"Date: Mon, 01 Jan 2024 10:00:00 +0000\r\n" +
+	"\r\n" +
+	"Hi Bob\r\n"
+
+// TestFetchDuringDeleteAll fetches, flags and expunges in two sessions
+// while the store is repeatedly cleared and refilled. Run with -race.
+func TestFetchDuringDeleteAll(t *testing.T) {
+	store := storage.NewStore()
+	template := saveRaw(t, store, plainMessage).Clone()
+
+	const rounds = 200
+	var wg sync.WaitGroup
+	wg.Add(3)
+
+	go func() {
+		defer wg.Done()
+		reader := newTestMailbox(store)
+		set, _ := imap.ParseSeqSet("1:*")
+		items := []imap.FetchItem{imap.FetchEnvelope, imap.FetchFlags, imap.FetchUid, imap.FetchRFC822Size, "BODY[]", "BODY.PEEK[HEADER]"}
+		for i := 0; i < rounds; i++ {
+			ch := make(chan *imap.Message)
+			go func() {
+				for range ch {
+				}
+			}()
+			if err := reader.ListMessages(false, set, items, ch); err != nil {
+				t.Errorf("ListMessages: %v", err)
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		expunger := newTestMailbox(store)
+		set, _ := imap.ParseSeqSet("1:3")
+		for i := 0; i < rounds; i++ {
+			if err := expunger.UpdateMessagesFlags(false, set, imap.AddFlags, []string{imap.DeletedFlag, imap.FlaggedFlag}); err != nil {
+				t.Errorf("UpdateMessagesFlags: %v", err)
+				return
+			}
+			if err := expunger.Expunge(); err != nil {
+				t.Errorf("Expunge: %v", err)
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			store.DeleteAll()
+			for j := 0; j < 5; j++ {
+				store.Save(template.Clone())
+			}
+		}
+	}()
+
+	wg.Wait()
+}
+
+const multipartMessage = "From: jane@example.com\r\n" +
+	"To: bob@example.com\r\n" +
+	"Subject: Report\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"See attached\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/octet-stream; name=data.bin\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"AAEC/w==\r\n" +
+	"--outer--\r\n"
+
+// TestFetchSectionsMatchBodyStructure checks that the parts BODYSTRUCTURE
+// describes are the ones BODY[<part>] returns, in their declared encoding
+func TestFetchSectionsMatchBodyStructure(t *testing.T) {
+	store := storage.NewStore()
+	saveRaw(t, store, multipartMessage)
+	m := newTestMailbox(store)
+
+	msgs := fetch(t, m, false, "1", imap.FetchBodyStructure, "BODY.PEEK[1]", "BODY.PEEK[2]", "BODY.PEEK[2.MIME]", "BODY.PEEK[3]")
+	if len(msgs) != 1 {
+		t.Fatalf("got %d messages, want 1", len(msgs))
+	}
+	msg := msgs[0]
+
+	bs := msg.BodyStructure
+	if bs == nil || bs.MIMEType != "multipart" || bs.MIMESubType != "mixed" || len(bs.Parts) != 2 {
+		t.Fatalf("BODYSTRUCTURE = %+v, want multipart/mixed with 2 parts", bs)
+	}
+	if part := bs.Parts[1]; part.MIMEType != "application" || part.Encoding != "base64" {
+		t.Errorf("part 2 is %s/%s in %s, want application/octet-stream in base64", part.MIMEType, part.MIMESubType, part.Encoding)
+	}
+
+	tests := []struct {
+		item imap.FetchItem
+		want string
+	}{
+		{"BODY.PEEK[1]", "See attached"},
+		{"BODY.PEEK[2]", "AAEC/w=="},
+		{"BODY.PEEK[2.MIME]", "Content-Type: application/octet-stream; name=data.bin\r\nContent-Transfer-Encoding: base64\r\n\r\n"},
+		{"BODY.PEEK[3]", ""},
+	}
+	for _, tt := range tests {
+		if got := sectionText(t, msg, tt.item); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.item, got, tt.want)
+		}
+	}
+}
+
+// TestFetchRebuiltMessage checks emails without a raw message are served
+// as the single text part their BODYSTRUCTURE describes
+func TestFetchRebuiltMessage(t *testing.T) {
+	store := storage.NewStore()
+	email := saveRaw(t, store, plainMessage)
+	email.Raw = nil
+	m := newTestMailbox(store)
+
+	msg := fetch(t, m, false, "1", imap.FetchBodyStructure, "BODY.PEEK[1]", "BODY.PEEK[1]<0.2>", "BODY.PEEK[2]")[0]
+	if bs := msg.BodyStructure; bs.MIMEType != "text" || bs.MIMESubType != "plain" || len(bs.Parts) != 0 {
+		t.Errorf("BODYSTRUCTURE = %s/%s with %d parts, want a single text/plain part", bs.MIMEType, bs.MIMESubType, len(bs.Parts))
+	}
+	if got := sectionText(t, msg, "BODY.PEEK[1]"); got != email.Body {
+		t.Errorf("BODY[1] = %q, want %q", got, email.Body)
+	}
+	if got := sectionText(t, msg, "BODY.PEEK[1]<0.2>"); got != email.Body[:2] {
+		t.Errorf("BODY[1]<0.2> = %q, want %q", got, email.Body[:2])
+	}
+	if got := sectionText(t, msg, "BODY.PEEK[2]"); got != "" {
+		t.Errorf("BODY[2] = %q, want it empty", got)
+	}
+}
+
+// TestFetchOverRawLimit checks messages past MaxRawBytes keep no raw copy
+// and are served rebuilt from their bodies, with a BODYSTRUCTURE, full
+// body and RFC822.SIZE that agree
+func TestFetchOverRawLimit(t *testing.T) {
+	htmlOnly := "From: jane@example.com\r\nTo: bob@example.com\r\nSubject: News\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n\r\n<p>News</p>\r\n"
+	tests := []struct {
+		name    string
+		raw     string
+		subtype string
+	}{
+		{"plain", plainMessage, "plain"},
+		{"multipart", multipartMessage, "plain"},
+		{"html only", htmlOnly, "html"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := storage.NewStore()
+			email, err := smtp.ParseMessage(strings.NewReader(tt.raw), "", nil, smtp.ParseOptions{MaxRawBytes: len(tt.raw) - 1})
+			if err != nil {
+				t.Fatalf("ParseMessage: %v", err)
+			}
+			if email.Raw != nil {
+				t.Fatalf("raw copy of %d bytes kept over a limit of %d", len(email.Raw), len(tt.raw)-1)
+			}
+			store.Save(email)
+			m := newTestMailbox(store)
+
+			msg := fetch(t, m, false, "1", imap.FetchBodyStructure, imap.FetchRFC822Size, "BODY.PEEK[]", "BODY.PEEK[1]")[0]
+			if bs := msg.BodyStructure; bs.MIMEType != "text" || bs.MIMESubType != tt.subtype || len(bs.Parts) != 0 {
+				t.Errorf("BODYSTRUCTURE = %s/%s with %d parts, want a single text/%s part", bs.MIMEType, bs.MIMESubType, len(bs.Parts), tt.subtype)
+			}
+			part := email.Body
+			if tt.subtype == "html" {
+				part = email.HTMLBody
+			}
+			if got := sectionText(t, msg, "BODY.PEEK[1]"); got != part {
+				t.Errorf("BODY[1] = %q, want %q", got, part)
+			}
+			full := sectionText(t, msg, "BODY.PEEK[]")
+			header, text, _ := strings.Cut(full, "\r\n\r\n")
+			if !strings.Contains(header, "Subject: "+email.Subject) || !strings.Contains(header, "Content-Type: text/"+tt.subtype) || text != part {
+				t.Errorf("BODY[] = %q, want a text/%s message of the %s body", full, tt.subtype, tt.subtype)
+			}
+			if int(msg.Size) != len(full) {
+				t.Errorf("RFC822.SIZE = %d, want the %d bytes of BODY[]", msg.Size, len(full))
+			}
+		})
+	}
+
+	email, err := smtp.ParseMessage(strings.NewReader(plainMessage), "", nil, smtp.ParseOptions{MaxRawBytes: len(plainMessage)})
+	if err != nil {
+		t.Fatalf("ParseMessage: %v", err)
+	}
+	if string(email.Raw) != plainMessage {
+		t.Errorf("raw copy = %q within the limit, want the message as received", email.Raw)
+	}
+}
+
+// TestEnvelopeUTF8Accept checks that envelopes carry encoded words until
+// the client enables UTF8=ACCEPT, and raw UTF-8 afterwards
+func TestEnvelopeUTF8Accept(t *testing.T) {
+	store := storage.NewStore()
+	saveRaw(t, store, "From: =?utf-8?q?Ren=C3=A9e?= <renee@example.com>\r\n"+
+		"To: bob@example.com\r\n"+
+		"Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\n"+
+		"\r\n"+
+		"Hallo\r\n")
+
+	c := dial(t, store, Options{})
+	c.run("SELECT INBOX")
+
+	encoded := c.run("FETCH 1 ENVELOPE")
+	if !strings.Contains(encoded, `"=?utf-8?q?Gr=C3=BC=C3=9Fe?="`) || !strings.Contains(encoded, `"=?utf-8?q?Ren=C3=A9e?="`) {
+		t.Errorf("FETCH ENVELOPE before ENABLE = %q, want encoded words", encoded)
+	}
+
+	c.run("ENABLE UTF8=ACCEPT")
+	raw := c.run("FETCH 1 ENVELOPE")
+	if !strings.Contains(raw, "Grüße") || !strings.Contains(raw, "Renée") || strings.Contains(raw, "=?utf-8?") {
+		t.Errorf("FETCH ENVELOPE after ENABLE UTF8=ACCEPT = %q, want raw UTF-8", raw)
+	}
+	if uidRaw := c.run("UID FETCH 1 ENVELOPE"); !strings.Contains(uidRaw, "Grüße") || !strings.Contains(uidRaw, "UID 1") {
+		t.Errorf("UID FETCH ENVELOPE = %q, want raw UTF-8 and the UID", uidRaw)
+	}
+}
+
+// TestFetchRFC822 checks the legacy RFC822 items return the whole message,
+// its header and its text, and that only RFC822.HEADER leaves it unseen
+func TestFetchRFC822(t *testing.T) {
+	header := strings.TrimSuffix(plainMessage, "Hi Bob\r\n")
+	tests := []struct {
+		item imap.FetchItem
+		want string
+		seen bool
+	}{
+		{imap.FetchRFC822, plainMessage, true},
+		{imap.FetchRFC822Header, header, false},
+		{imap.FetchRFC822Text, "Hi Bob\r\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.item), func(t *testing.T) {
+			store := storage.NewStore()
+			saveRaw(t, store, plainMessage)
+			m := newTestMailbox(store)
+
+			msg := fetch(t, m, false, "1", tt.item)[0]
+			if got := sectionText(t, msg, tt.item); got != tt.want {
+				t.Errorf("%s = %q, want %q", tt.item, got, tt.want)
+			}
+
+			flags := fetch(t, m, false, "1", imap.FetchFlags)[0].Flags
+			if seen := containsFlag(flags, imap.SeenFlag); seen != tt.seen {
+				t.Errorf("\\Seen after fetching %s = %v, want %v", tt.item, seen, tt.seen)
+			}
+		})
+	}
+}
+
+// unseen returns the mailbox's STATUS UNSEEN count
+func unseen(t testing.TB, m *Mailbox) uint32 {
+	t.Helper()
+	status, err := m.Status([]imap.StatusItem{imap.StatusUnseen})
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	return status.Unseen
+}
+
+// TestFetchPeekKeepsUnseen checks BODY.PEEK fetches leave messages unseen,
+// BODY fetches mark them \Seen, and neither does in an EXAMINEd mailbox
+func TestFetchPeekKeepsUnseen(t *testing.T) {
+	tests := []struct {
+		item     imap.FetchItem
+		readOnly bool
+		want     uint32
+	}{
+		{"BODY.PEEK[]", false, 2},
+		{"BODY.PEEK[TEXT]", false, 2},
+		{"BODY.PEEK[HEADER]", false, 2},
+		{imap.FetchEnvelope, false, 2},
+		{"BODY[]", false, 1},
+		{"BODY[TEXT]", false, 1},
+		{"BODY[1]", false, 1},
+		{"BODY[]", true, 2},
+	}
+	for _, tt := range tests {
+		name := string(tt.item)
+		if tt.readOnly {
+			name += " after EXAMINE"
+		}
+		t.Run(name, func(t *testing.T) {
+			store := storage.NewStore()
+			saveRaw(t, store, plainMessage)
+			saveRaw(t, store, plainMessage)
+			m := newTestMailbox(store)
+			m.readOnly = tt.readOnly
+
+			if got := unseen(t, m); got != 2 {
+				t.Fatalf("UNSEEN before fetching = %d, want 2", got)
+			}
+			fetch(t, m, false, "1", tt.item)
+			if got := unseen(t, m); got != tt.want {
+				t.Errorf("UNSEEN after fetching %s = %d, want %d", tt.item, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		addr string
+		want imap.Address
+	}{
+		{"jane@example.com", imap.Address{MailboxName: "jane", HostName: "example.com"}},
+		{"<jane@example.com>", imap.Address{MailboxName: "jane", HostName: "example.com"}},
+		{"Jane Doe <jane@example.com>", imap.Address{PersonalName: "Jane Doe", MailboxName: "jane", HostName: "example.com"}},
+		{`"Doe, Jane" <jane@example.com>`, imap.Address{PersonalName: "Doe, Jane", MailboxName: "jane", HostName: "example.com"}},
+		{"=?utf-8?q?Ren=C3=A9e?= <renee@example.com>", imap.Address{PersonalName: "Renée", MailboxName: "renee", HostName: "example.com"}},
+		{`"jane@home"@example.com`, imap.Address{MailboxName: "jane@home", HostName: "example.com"}},
+		{"Jane <jane@example.com", imap.Address{MailboxName: "Jane <jane", HostName: "example.com"}},
+		{" <postmaster> ", imap.Address{MailboxName: "postmaster"}},
+		{"undisclosed-recipients", imap.Address{MailboxName: "undisclosed-recipients"}},
+		{"", imap.Address{}},
+	}
+	for _, tt := range tests {
+		if got := parseAddress(tt.addr); *got != tt.want {
+			t.Errorf("parseAddress(%q) = %+v, want %+v", tt.addr, *got, tt.want)
+		}
+	}
+}
+
+// TestEnvelopeAddresses checks addresses are split into display name,
+// mailbox and host in fetched envelopes
+func TestEnvelopeAddresses(t *testing.T) {
+	store := storage.NewStore()
+	saveRaw(t, store, "From: Jane Doe <jane@example.com>\r\n"+
+		"To: bob@example.com, \"Smith, Ann\" <ann@example.org>\r\n"+
+		"Subject: Hi\r\n"+
+		"\r\n"+
+		"Hello\r\n")
+	m := newTestMailbox(store)
+
+	envelope := fetch(t, m, false, "1", imap.FetchEnvelope)[0].Envelope
+	if len(envelope.From) != 1 || *envelope.From[0] != (imap.Address{PersonalName: "Jane Doe", MailboxName: "jane", HostName: "example.com"}) {
+		t.Errorf("envelope From = %+v, want Jane Doe <jane@example.com> split", envelope.From)
+	}
+	// Recipients are stored as bare addresses, so they have no display name
+	want := []imap.Address{
+		{MailboxName: "bob", HostName: "example.com"},
+		{MailboxName: "ann", HostName: "example.org"},
+	}
+	if len(envelope.To) != len(want) {
+		t.Fatalf("envelope To has %d addresses, want %d", len(envelope.To), len(want))
+	}
+	for i, addr := range envelope.To {
+		if *addr != want[i] {
+			t.Errorf("envelope To[%d] = %+v, want %+v", i, *addr, want[i])
+		}
+	}
+}
+
+// TestFetchUIDsAfterDeletion checks FETCH matches sequence numbers and UID
+// FETCH matches UIDs once the two differ
+func TestFetchUIDsAfterDeletion(t *testing.T) {
+	store := storage.NewStore()
+	for range 4 {
+		saveRaw(t, store, plainMessage)
+	}
+	store.Delete(1)
+	store.Delete(2)
+	m := newTestMailbox(store)
+
+	tests := []struct {
+		uid    bool
+		seqset string
+		want   []uint32 // UIDs in the response
+	}{
+		{false, "1", []uint32{3}},
+		{false, "2", []uint32{4}},
+		{false, "3", nil},
+		{false, "*", []uint32{4}},
+		{true, "1", nil},
+		{true, "3", []uint32{3}},
+		{true, "1:3", []uint32{3}},
+		{true, "*", []uint32{4}},
+		{true, "2:*", []uint32{3, 4}},
+		{true, "10:*", []uint32{4}},
+	}
+	for _, tt := range tests {
+		var uids []uint32
+		for _, msg := range fetch(t, m, tt.uid, tt.seqset, imap.FetchUid) {
+			uids = append(uids, msg.Uid)
+		}
+		if !slices.Equal(uids, tt.want) {
+			t.Errorf("FETCH %s (uid %v) = UIDs %v, want %v", tt.seqset, tt.uid, uids, tt.want)
+		}
+	}
+
+	// STORE picks messages the same way
+	set, _ := imap.ParseSeqSet("3")
+	if err := m.UpdateMessagesFlags(true, set, imap.AddFlags, []string{imap.FlaggedFlag}); err != nil {
+		t.Fatalf("UID STORE: %v", err)
+	}
+	if !store.HasFlag(3, imap.FlaggedFlag) || store.HasFlag(4, imap.FlaggedFlag) {
+		t.Errorf("UID STORE 3 flagged the wrong message")
+	}
+}
+
+func TestCustomKeywords(t *testing.T) {
+	store := storage.NewStore()
+	saveRaw(t, store, plainMessage)
+	c := dial(t, store, Options{})
+
+	if out := c.run("SELECT INBOX"); !strings.Contains(out, `[PERMANENTFLAGS (`) || !strings.Contains(out, `\*)]`) {
+		t.Errorf("SELECT = %q, want \\* in PERMANENTFLAGS", out)
+	}
+	c.run(`STORE 1 +FLAGS (Work $Important \Flagged)`)
+	c.run(`STORE 1 -FLAGS (work)`)
+
+	// A second session sees the keywords kept in the store, which go-imap
+	// lowercases
+	other := dial(t, store, Options{})
+	other.run("EXAMINE INBOX")
+	if out := other.run("FETCH 1 FLAGS"); !strings.Contains(out, `FLAGS ($important \Flagged)`) {
+		t.Errorf("FETCH FLAGS = %q, want $important and \\Flagged without work", out)
+	}
+
+	c.run(`STORE 1 FLAGS (Personal)`)
+	if out := other.run("FETCH 1 FLAGS"); !strings.Contains(out, "FLAGS (personal)") {
+		t.Errorf("FETCH FLAGS after replacing them = %q, want only personal", out)
+	}
+}
@@ -0,0 +1,62 @@
+package imap
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"mailer/api"
+	"mailer/storage"
+)
+
+// TestReadStateAcrossChannels checks reading an email over HTTP or IMAP
+// marks it read in both
+func TestReadStateAcrossChannels(t *testing.T) {
+	store := storage.NewStore()
+	saveRaw(t, store, plainMessage)
+	saveRaw(t, store, plainMessage)
+	routes := api.NewHandler(store, storage.NewConnectionRegistry(), "", "", "", api.Options{}).SetupRoutes()
+	get := func(path string, v any) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d: %s", path, rec.Code, rec.Body)
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+	}
+
+	// HTTP to IMAP
+	var email struct {
+		Read bool `json:"read"`
+	}
+	get("/api/emails/1?markRead=true", &email)
+	c := dial(t, store, Options{})
+	c.run("SELECT INBOX")
+	out := c.run("FETCH 1:2 FLAGS")
+	if !strings.Contains(out, `* 1 FETCH (FLAGS (\Seen))`) || strings.Contains(out, `* 2 FETCH (FLAGS (\Seen))`) {
+		t.Errorf("FETCH FLAGS after markRead = %q, want only message 1 seen", out)
+	}
+
+	// IMAP to HTTP
+	var count struct {
+		Count int `json:"count"`
+	}
+	get("/api/emails/count?read=false", &count)
+	if count.Count != 1 {
+		t.Errorf("unread count = %d, want 1", count.Count)
+	}
+	c.run("FETCH 2 BODY[]")
+	get("/api/emails/2", &email)
+	if !email.Read {
+		t.Error("email read over IMAP isn't read over HTTP")
+	}
+	get("/api/emails/count?read=false", &count)
+	if count.Count != 0 {
+		t.Errorf("unread count after the IMAP read = %d, want 0", count.Count)
+	}
+}
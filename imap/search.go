@@ -0,0 +1,177 @@
+package imap
+
+import (
+	"bufio"
+	"mime"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"mailer/models"
+)
+
+// searchMessage is a message being matched against SEARCH criteria, with
+// the values several keys need computed once
+type searchMessage struct {
+	email  *models.Email
+	emails []*models.Email // The mailbox, for sequence number and UID sets
+	index  int             // Position of email in emails
+	flags  []string
+	header textproto.MIMEHeader
+}
+
+// newSearchMessage prepares emails[i] for matching
+func (m *Mailbox) newSearchMessage(emails []*models.Email, i int) *searchMessage {
+	email := emails[i]
+	return &searchMessage{
+		email:  email,
+		emails: emails,
+		index:  i,
+		flags:  m.flags(email),
+		header: searchHeader(email),
+	}
+}
+
+// matchCriteria reports whether msg matches all keys of c, recursing into
+// its NOT and OR keys (RFC 3501 6.4.4)
+func (m *Mailbox) matchCriteria(msg *searchMessage, c *imap.SearchCriteria) bool {
+	email := msg.email
+
+	if c.SeqNum != nil && !inSeqSet(false, c.SeqNum, msg.emails, msg.index) {
+		return false
+	}
+	if c.Uid != nil && !inSeqSet(true, c.Uid, msg.emails, msg.index) {
+		return false
+	}
+
+	// Date keys compare days, ignoring the time and timezone. SINCE and
+	// BEFORE use the internal date, SENTSINCE and SENTBEFORE the Date header.
+	if !c.Since.IsZero() && searchDay(email.ReceivedAt).Before(searchDay(c.Since)) {
+		return false
+	}
+	if !c.Before.IsZero() && !searchDay(email.ReceivedAt).Before(searchDay(c.Before)) {
+		return false
+	}
+	if !c.SentSince.IsZero() && searchDay(email.Date).Before(searchDay(c.SentSince)) {
+		return false
+	}
+	if !c.SentBefore.IsZero() && !searchDay(email.Date).Before(searchDay(c.SentBefore)) {
+		return false
+	}
+
+	for name, values := range c.Header {
+		for _, value := range values {
+			if !matchHeader(msg.header, name, value) {
+				return false
+			}
+		}
+	}
+	body := email.Body + "\n" + sentHTML(email)
+	for _, s := range c.Body {
+		if !containsFold(body, s) {
+			return false
+		}
+	}
+	for _, s := range c.Text {
+		if !containsFold(body, s) && !headerContains(msg.header, s) {
+			return false
+		}
+	}
+
+	// \Recent isn't tracked, so RECENT and NEW never match and OLD always does
+	for _, flag := range c.WithFlags {
+		if !containsFlag(msg.flags, flag) {
+			return false
+		}
+	}
+	for _, flag := range c.WithoutFlags {
+		if containsFlag(msg.flags, flag) {
+			return false
+		}
+	}
+
+	size := m.messageSize(email)
+	if c.Larger > 0 && size <= c.Larger {
+		return false
+	}
+	if c.Smaller > 0 && size >= c.Smaller {
+		return false
+	}
+
+	for _, not := range c.Not {
+		if m.matchCriteria(msg, not) {
+			return false
+		}
+	}
+	for _, or := range c.Or {
+		if !m.matchCriteria(msg, or[0]) && !m.matchCriteria(msg, or[1]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// searchDay returns the calendar date of t as midnight UTC
+func searchDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// searchHeader returns the header fields searched by FROM, SUBJECT, HEADER
+// and the like: the header as received, or for emails stored without one
+// (e.g. imported through the API) the fields rebuilt from the model
+func searchHeader(email *models.Email) textproto.MIMEHeader {
+	if email.RawHeaderBlock != "" {
+		r := textproto.NewReader(bufio.NewReader(strings.NewReader(email.RawHeaderBlock + "\r\n\r\n")))
+		if header, err := r.ReadMIMEHeader(); err == nil || len(header) > 0 {
+			return header
+		}
+	}
+
+	header := make(textproto.MIMEHeader)
+	header.Set("From", email.From)
+	header.Set("To", models.FormatAddressList(email.To))
+	header.Set("Subject", email.Subject)
+	header.Set("Date", email.Date.Format(time.RFC1123Z))
+	if email.MessageID != "" {
+		header.Set("Message-Id", email.MessageID)
+	}
+	return header
+}
+
+// matchHeader reports whether a field called name contains value, ignoring
+// case. An empty value matches any message that has the field.
+func matchHeader(header textproto.MIMEHeader, name string, value string) bool {
+	for _, field := range header.Values(name) {
+		if containsFold(decodeHeader(field), value) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerContains reports whether any header field contains s, ignoring case
+func headerContains(header textproto.MIMEHeader, s string) bool {
+	for name, fields := range header {
+		for _, field := range fields {
+			if containsFold(name+": "+decodeHeader(field), s) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// decodeHeader resolves the RFC 2047 encoded words in a header value
+func decodeHeader(value string) string {
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(value); err == nil {
+		return decoded
+	}
+	return value
+}
+
+// containsFold reports whether substr is within s, ignoring case
+func containsFold(s string, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
@@ -0,0 +1,116 @@
+package imap
+
+import (
+	"bufio"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"mailer/storage"
+)
+
+// parseSearch parses SEARCH arguments as the server would receive them
+func parseSearch(t *testing.T, args string) *imap.SearchCriteria {
+	t.Helper()
+	fields, err := imap.NewReader(bufio.NewReader(strings.NewReader(args + "\r\n"))).ReadLine()
+	if err != nil {
+		t.Fatalf("reading %q: %v", args, err)
+	}
+	criteria := new(imap.SearchCriteria)
+	if err := criteria.ParseWithCharset(fields, nil); err != nil {
+		t.Fatalf("parsing %q: %v", args, err)
+	}
+	return criteria
+}
+
+func searchTestMessage(from string, subject string, body string) string {
+	return "From: " + from + "\r\n" +
+		"To: bob@example.com\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: Mon, 01 Jan 2024 10:00:00 +0000\r\n" +
+		"\r\n" +
+		body + "\r\n"
+}
+
+func TestSearchMessages(t *testing.T) {
+	store := storage.NewStore()
+	raws := []string{
+		searchTestMessage("alice@example.com", "Invoice", "Please pay"),
+		searchTestMessage("bob@example.com", "Report", strings.Repeat("Quarterly numbers. ", 100)),
+		searchTestMessage("alice@example.com", "Hello", "Hi there"),
+	}
+	received := []time.Time{
+		time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC),
+		time.Date(2024, 2, 1, 9, 0, 0, 0, time.UTC),
+		time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC),
+	}
+	for i, raw := range raws {
+		saveRaw(t, store, raw).ReceivedAt = received[i]
+	}
+	store.SetFlag(1, imap.SeenFlag, true)
+	store.SetFlag(3, imap.FlaggedFlag, true)
+	m := newTestMailbox(store)
+
+	// The raw size, well above the body's length, is what LARGER and SMALLER compare
+	size := len(raws[0])
+
+	tests := []struct {
+		args string
+		want []uint32
+	}{
+		{"ALL", []uint32{1, 2, 3}},
+		{"SEEN", []uint32{1}},
+		{"UNSEEN", []uint32{2, 3}},
+		{"NOT SEEN", []uint32{2, 3}},
+		{"FROM alice UNSEEN", []uint32{3}},
+		{"NOT FROM alice", []uint32{2}},
+		{"OR FROM bob FLAGGED", []uint32{2, 3}},
+		{"NOT (OR SEEN FLAGGED)", []uint32{2}},
+		{"OR SEEN SINCE 1-Mar-2024", []uint32{1, 3}},
+		{"SINCE 1-Feb-2024", []uint32{2, 3}},
+		{"SINCE 1-Feb-2024 NOT FLAGGED", []uint32{2}},
+		{"SINCE 1-Feb-2024 UNSEEN NOT FROM bob", []uint32{3}},
+		{"BEFORE 1-Feb-2024", []uint32{1}},
+		{"NOT SINCE 1-Feb-2024 UNSEEN", nil},
+		{"ON 1-Feb-2024", []uint32{2}},
+		{"SUBJECT invoice", []uint32{1}},
+		{"LARGER 1000", []uint32{2}},
+		{"SMALLER 1000", []uint32{1, 3}},
+		{fmt.Sprintf("LARGER %d SMALLER 1000", size-1), []uint32{1}},
+		{fmt.Sprintf("LARGER %d SMALLER 1000", size), nil},
+		{fmt.Sprintf("SMALLER %d", size+1), []uint32{1, 3}},
+		{fmt.Sprintf("SMALLER %d", size), []uint32{3}},
+		{"OR LARGER 1000 SEEN UNSEEN", []uint32{2}},
+		{"UID 2:* UNSEEN", []uint32{2, 3}},
+		{"2:3 NOT FLAGGED", []uint32{2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.args, func(t *testing.T) {
+			got, err := m.SearchMessages(false, parseSearch(t, tt.args))
+			if err != nil {
+				t.Fatalf("SearchMessages: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("SEARCH %s = %v, want %v", tt.args, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestRFC822SizeMatchesBody checks RFC822.SIZE is the length of BODY[],
+// for messages served as received and as rebuilt
+func TestRFC822SizeMatchesBody(t *testing.T) {
+	store := storage.NewStore()
+	saveRaw(t, store, plainMessage)
+	saveRaw(t, store, plainMessage).Raw = nil
+	m := newTestMailbox(store)
+
+	for _, msg := range fetch(t, m, false, "1:2", imap.FetchRFC822Size, "BODY.PEEK[]") {
+		if body := sectionText(t, msg, "BODY.PEEK[]"); int(msg.Size) != len(body) {
+			t.Errorf("message %d: RFC822.SIZE = %d, want the %d bytes of BODY[]", msg.SeqNum, msg.Size, len(body))
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package imap
+
+import "github.com/emersion/go-imap/server"
+
+// selectExtension wraps go-imap's SELECT and EXAMINE handlers to tell the
+// selected mailbox whether it was opened read-only
+type selectExtension struct{}
+
+// Capabilities returns nothing, SELECT and EXAMINE are part of IMAP4rev1
+func (ext *selectExtension) Capabilities(c server.Conn) []string {
+	return nil
+}
+
+// Command returns the handler factory for the SELECT and EXAMINE commands
+func (ext *selectExtension) Command(name string) server.HandlerFactory {
+	switch name {
+	case "SELECT":
+		return func() server.Handler {
+			return &selectHandler{}
+		}
+	case "EXAMINE":
+		return func() server.Handler {
+			h := &selectHandler{}
+			h.ReadOnly = true
+			return h
+		}
+	}
+	return nil
+}
+
+// selectHandler handles the SELECT and EXAMINE commands
+type selectHandler struct {
+	server.Select
+}
+
+// Handle selects the mailbox like go-imap, which answers with [READ-ONLY]
+// after EXAMINE, and marks our mailbox read-only to match
+func (h *selectHandler) Handle(conn server.Conn) error {
+	// go-imap reports success through a status response error as well
+	err := h.Select.Handle(conn)
+
+	ctx := conn.Context()
+	if mbox, ok := ctx.Mailbox.(*Mailbox); ok {
+		mbox.readOnly = ctx.MailboxReadOnly
+	}
+	return err
+}
@@ -0,0 +1,57 @@
+package imap
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/server"
+	"mailer/storage"
+)
+
+func TestExamineIsReadOnly(t *testing.T) {
+	store := storage.NewStore()
+	saveRaw(t, store, plainMessage)
+	c := dial(t, store, Options{})
+
+	if out := c.run("EXAMINE INBOX"); !strings.Contains(out, "[READ-ONLY]") {
+		t.Errorf("EXAMINE = %q, want [READ-ONLY]", out)
+	}
+	for _, cmd := range []string{`STORE 1 +FLAGS (\Deleted)`, `UID STORE 1 +FLAGS (\Seen)`, "EXPUNGE"} {
+		if out, status := c.try(cmd); status != "NO" {
+			t.Errorf("%s after EXAMINE = %q, want NO", cmd, out)
+		}
+	}
+	c.run("FETCH 1 BODY[]")
+	if store.HasFlag(1, imap.SeenFlag) || store.HasFlag(1, imap.DeletedFlag) {
+		t.Error("flags changed after EXAMINE")
+	}
+
+	// SELECT makes the mailbox writable again
+	if out := c.run("SELECT INBOX"); !strings.Contains(out, "[READ-WRITE]") {
+		t.Errorf("SELECT = %q, want [READ-WRITE]", out)
+	}
+	c.run("FETCH 1 BODY[]")
+	if !store.HasFlag(1, imap.SeenFlag) {
+		t.Error("BODY[] after SELECT didn't set \\Seen")
+	}
+}
+
+func TestReadOnlyMailboxRefusesChanges(t *testing.T) {
+	store := storage.NewStore()
+	saveRaw(t, store, plainMessage)
+	m := newTestMailbox(store)
+	m.readOnly = true
+
+	set, _ := imap.ParseSeqSet("1")
+	if err := m.UpdateMessagesFlags(false, set, imap.AddFlags, []string{imap.DeletedFlag}); !errors.Is(err, server.ErrMailboxReadOnly) {
+		t.Errorf("UpdateMessagesFlags = %v, want ErrMailboxReadOnly", err)
+	}
+	if err := m.Expunge(); !errors.Is(err, server.ErrMailboxReadOnly) {
+		t.Errorf("Expunge = %v, want ErrMailboxReadOnly", err)
+	}
+	if n := len(store.GetAll()); n != 1 || store.HasFlag(1, imap.DeletedFlag) {
+		t.Error("read-only mailbox was changed")
+	}
+}
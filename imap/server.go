@@ -7,19 +7,14 @@ import (
 	"mailer/storage"
 )
 
-// StartServer starts the IMAP server
-func StartServer(store *storage.Store, addr string) error {
-	// Create backend
-	be := NewBackend(store)
+// extensions are the go-imap extensions enabled on the server
+var extensions = []server.Extension{&enableExtension{}, &listExtension{}, &closeExtension{}, &selectExtension{}, &fetchExtension{}, &appendExtension{}}
 
-	// Create server
-	s := server.New(be)
+// StartServer starts the IMAP server
+func StartServer(store *storage.Store, connections *storage.ConnectionRegistry, addr string, opts Options) error {
+	s := newServer(NewBackend(store, connections, opts), opts)
 	s.Addr = addr
 
-	// Allow insecure auth for development
-	// In production, you should use TLS
-	s.AllowInsecureAuth = true
-
 	log.Printf("IMAP server starting on %s", addr)
 	log.Printf("IMAP: Use any username/password to login")
 
@@ -29,3 +24,29 @@ func StartServer(store *storage.Store, addr string) error {
 
 	return nil
 }
+
+// newServer creates a server for be with the extensions and options of
+// StartServer
+func newServer(be *Backend, opts Options) *server.Server {
+	s := server.New(be)
+	s.Enable(extensions...)
+	if opts.IdleMax > 0 {
+		enableIdle(s, &idleExtension{max: opts.IdleMax})
+	}
+
+	// Allow insecure auth for development
+	// In production, you should use TLS
+	s.AllowInsecureAuth = true
+	return s
+}
+
+// Capabilities returns the capabilities advertised before login on a
+// plaintext connection, following go-imap's CAPABILITY response for the
+// server's configuration
+func Capabilities() []string {
+	caps := []string{"IMAP4rev1", "LITERAL+", "SASL-IR", "CHILDREN", "UNSELECT", "MOVE", "IDLE", "APPENDLIMIT", "AUTH=PLAIN"}
+	for _, ext := range extensions {
+		caps = append(caps, ext.Capabilities(nil)...)
+	}
+	return caps
+}
@@ -2,19 +2,29 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"log"
+	"mailer/analysis"
 	"mailer/api"
+	"mailer/hooks"
 	imapserver "mailer/imap"
 	mcpserver "mailer/mcp"
+	"mailer/models"
 	"mailer/smtp"
 	"mailer/storage"
+	"net"
 	"net/http"
 	"os"
+	"os/exec"
 	"os/signal"
+	"runtime"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"text/template"
 	"time"
 )
 
@@ -33,75 +43,473 @@ func main() {
 		runMCP()
 	case "server":
 		runServer()
+	case "append":
+		runAppend()
+	case "replay":
+		runReplay()
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", command)
-		fmt.Fprintf(os.Stderr, "Usage: %s [server|mcp] [flags]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [server|mcp|append|replay] [flags]\n", os.Args[0])
 		os.Exit(1)
 	}
 }
 
 func runMCP() {
 	apiURL := flag.String("api-url", "http://localhost:8080", "Mailer daemon API URL")
+	retries := flag.Int("retries", 3, "Retries for daemon reads that fail with a connection error or 5xx response")
+	retryBackoff := flag.Duration("retry-backoff", 200*time.Millisecond, "Delay before the first retry, doubled for each further one")
+	maxBodyBytes := flag.Int("max-body-bytes", 64*1024, "Bytes of body, HTML and attachment text returned per field by get_email (0 = unlimited)")
+	listLimit := flag.Int("list-limit", 100, "Most recent emails summarized by the email://list resource (0 = unlimited)")
 	flag.Parse()
 
-	server := mcpserver.NewServer(*apiURL)
+	server := mcpserver.NewServer(*apiURL, mcpserver.Options{
+		Retries:      *retries,
+		RetryBackoff: *retryBackoff,
+		MaxBodyBytes: *maxBodyBytes,
+		ListLimit:    *listLimit,
+	})
 	if err := server.Run(context.Background()); err != nil {
 		log.Fatalf("MCP server error: %v", err)
 	}
 }
 
+func runAppend() {
+	imapAddr := flag.String("imap-addr", ":1143", "IMAP server address to append to")
+	file := flag.String("file", "", "Path to an .eml file or a directory of .eml files")
+	flag.Parse()
+
+	if *file == "" {
+		log.Fatalf("The -file flag is required")
+	}
+
+	count, err := imapserver.AppendFiles(*imapAddr, *file)
+	if err != nil {
+		log.Fatalf("Append error: %v", err)
+	}
+	log.Printf("Appended %d message(s) to INBOX", count)
+}
+
+func runReplay() {
+	smtpAddr := flag.String("smtp-addr", ":2500", "SMTP server address to send to")
+	file := flag.String("file", "", "Path to an .eml file or a directory of .eml files")
+	from := flag.String("from", "", "Envelope sender (default: the message's From header)")
+	to := flag.String("to", "", "Comma-separated envelope recipients (default: the message's To, Cc and Bcc headers)")
+	flag.Parse()
+
+	if *file == "" {
+		log.Fatalf("The -file flag is required")
+	}
+
+	count, err := smtp.ReplayFiles(*smtpAddr, *file, *from, splitList(*to))
+	if err != nil {
+		log.Fatalf("Replay error: %v", err)
+	}
+	log.Printf("Replayed %d message(s) over SMTP", count)
+}
+
 func runServer() {
 	// Parse command-line flags
 	smtpAddr := flag.String("smtp-addr", ":2500", "SMTP server bind address (e.g., :2500 or 127.0.0.1:2500)")
 	imapAddr := flag.String("imap-addr", ":1143", "IMAP server bind address (e.g., :1143 or 127.0.0.1:1143)")
 	httpAddr := flag.String("http-addr", ":8080", "HTTP server bind address (e.g., :8080 or 127.0.0.1:8080)")
+	maxSubjectLen := flag.Int("max-subject-len", 0, "Maximum subject length in characters (0 = unlimited)")
+	maxMessageBytes := flag.Int("max-message-bytes", 10*1024*1024, "Maximum raw message size in bytes; larger messages are rejected with 552 without being buffered")
+	maxLineLength := flag.Int("max-line-length", 2000, "Maximum SMTP command or message line length in bytes; longer lines are rejected with 500 without being buffered")
+	maxBodyBytes := flag.Int("max-body-bytes", 0, "Maximum plain text or HTML body size in bytes (0 = unlimited)")
+	ignoreFrom := flag.String("ignore-from", "", "Comma-separated sender substrings; matching messages are accepted but not stored")
+	ignoreSubject := flag.String("ignore-subject", "", "Comma-separated subject substrings; matching messages are accepted but not stored")
+	parseWorkers := flag.Int("parse-workers", 0, "Maximum number of messages parsed concurrently; further messages wait for a free slot (0 = unlimited)")
+	rejectOversize := flag.Bool("reject-oversize", false, "Reject messages exceeding -max-subject-len or -max-body-bytes with 552 instead of truncating")
+	acceptMessage := flag.String("accept-message", "", "Template for the 250 reply after a message is stored, e.g. \"Ok: queued as {{.ID}}\" (default: library reply)")
+	var redact listFlag
+	flag.Var(&redact, "redact", "Regular expression whose matches in stored bodies are replaced with [REDACTED] (repeatable)")
+	wrapText := flag.Bool("wrap-text", false, "Store an escaped HTML rendering of text-only emails as their HTML body for previews (marked generatedHtml)")
+	normalizeNewlines := flag.String("normalize-newlines", "", "Convert the line endings of stored text and HTML bodies to lf or crlf (marked newlinesNormalized; default: as received)")
+	warnRecipients := flag.Int("warn-recipients", 0, fmt.Sprintf("Accept but tag as highRecipientCount messages with more recipients than this; the hard limit is %d (0 = off)", smtp.MaxRecipients))
+	maxMsgsPerConn := flag.Int("smtp-max-msgs-per-conn", 0, "Messages accepted per SMTP connection before further ones get 421 and the connection is closed (0 = unlimited)")
+	smtpReadRate := flag.Int("smtp-read-rate", 0, "Read message content at most this many bytes per second to simulate a slow server (0 = unthrottled)")
+	captureTranscript := flag.Bool("capture-transcript", false, "Store the SMTP commands and replies that delivered each email, without its content, as its transcript")
+	disableVRFY := flag.Bool("disable-vrfy", false, "Answer SMTP VRFY and EXPN with 502 instead of verifying addresses")
+	validRecipients := flag.String("valid-recipients", "", "Comma-separated addresses SMTP VRFY and EXPN confirm with 250, answering any other with 550 (empty = 252 to VRFY, 502 to EXPN)")
+	addReceived := flag.Bool("add-received", false, "Prepend a Received header naming the client and envelope recipient to each captured message")
+	allowTimeOverride := flag.Bool("allow-time-override", false, "Use an RFC3339 X-Mailer-Received-At header as the email's receive time instead of the clock")
+	attachmentTextBytes := flag.Int("attachment-text-bytes", 256*1024, "Decoded text kept per text-like attachment for searching (0 = none)")
+	maxAttachmentSize := flag.Int("max-attachment-size", 0, "Decoded attachment size in bytes above which only its metadata is kept (0 = unlimited)")
+	maxAttachments := flag.Int("max-attachments-per-email", 0, "Attachments per email whose content is kept; later ones keep only their metadata (0 = unlimited)")
+	maxRawBytes := flag.Int("max-raw-bytes", 0, "Largest message kept as received for IMAP; larger ones are served rebuilt from their bodies to save memory (0 = unlimited)")
+	keepEncoded := flag.Bool("keep-encoded", false, "Keep each MIME part's undecoded body in the structure endpoint for decoding debugging")
+	defaultFrom := flag.String("default-from", "", "Sender stored when neither MAIL FROM nor the From header name one, e.g. unknown@localhost (empty = leave blank)")
+	defaultTo := flag.String("default-to", "", "Recipient stored when neither the envelope nor the To header name one, e.g. unknown@localhost (empty = leave blank)")
+	imapPerRecipient := flag.Bool("imap-per-recipient", false, "IMAP users logging in with an email address see only messages addressed to it")
+	idleMax := flag.Duration("idle-max", 30*time.Minute, "Log out IMAP clients whose IDLE lasts longer than this, so they reconnect (0 = no limit)")
+	dedup := flag.Bool("dedup", false, "Don't store IMAP APPENDs whose Message-ID matches an existing email; APPENDUID names the existing UID")
+	scanHTML := flag.Bool("scan-html", false, "Flag <script> tags, inline event handlers and javascript: URLs in captured HTML (bodies are stored unaltered)")
+	rewriteLinks := flag.Bool("rewrite-links", false, "Rewrite links in captured HTML through /api/click to record clicks")
+	trackOpens := flag.Bool("track-opens", false, "Add a 1x1 tracking pixel to captured HTML that records views through /api/open")
+	httpTLSCert := flag.String("http-tls-cert", "", "TLS certificate file; serves the web UI and API over HTTPS together with -http-tls-key")
+	httpTLSKey := flag.String("http-tls-key", "", "TLS private key file for -http-tls-cert")
+	httpClientCA := flag.String("http-client-ca", "", "CA bundle file; when set, HTTPS clients must present a certificate signed by it (requires -http-tls-cert)")
+	openBrowserFlag := flag.Bool("open", false, "Open the web interface in the default browser once the HTTP server is listening")
+	noBanner := flag.Bool("no-banner", false, "Don't log the web interface URL on startup, e.g. for quiet CI runs")
+	basePath := flag.String("base-path", "", "Path prefix to serve the web UI and API under, e.g. /mailer (default: root)")
+	httpLatency := flag.Duration("http-latency", 0, "Artificial delay added to each HTTP API request (e.g. 500ms)")
+	httpJitter := flag.Duration("http-jitter", 0, "Random extra delay of up to this much added on top of -http-latency")
+	adminKey := flag.String("admin-key", "", "Key required in the X-Mailer-Admin-Key header to change settings through /api/admin/config (empty = endpoint disabled)")
+	apiKeys := flag.String("api-keys", "", "Comma-separated API keys that each get an isolated partition (X-Mailer-Key header, SMTP AUTH username)")
+	idleShutdown := flag.Duration("idle-shutdown", 0, "Shut down gracefully after this long without a captured email (0 = never)")
+	storageSpec := flag.String("storage", "memory", "Storage backends as primary[+secondary]; memory+dir:<path> also mirrors each email to a JSON file in <path> for durability testing")
+	retention := flag.Duration("retention", 0, "Delete emails older than this (0 = keep forever); X-Mailer-TTL headers override it per email")
+	onCapture := flag.String("on-capture", "", "Executable to run for each captured email (email JSON is passed on stdin)")
+	stdoutJSON := flag.Bool("stdout-json", false, "Print each captured email to stdout as a single line of JSON (logs stay on stderr)")
+	stdoutFields := flag.String("stdout-fields", "", "Comma-separated JSON fields to include with -stdout-json, e.g. id,from,subject (default: all)")
+	webhook := flag.String("webhook", "", "URL to POST each captured email's JSON to")
+	webhookSecret := flag.String("webhook-secret", "", "Secret for signing -webhook requests with HMAC-SHA256 in the X-Mailer-Signature header")
+	publish := flag.String("publish", "", "Message queue URL to publish each captured email's JSON to, e.g. nats://localhost:4222/mailer.captured")
+	autoReply := flag.String("auto-reply", "", "Template for the text of an automatic reply to each captured email, e.g. \"Out of office, re: {{.Subject}}\" (default: no replies)")
+	autoReplyTo := flag.String("auto-reply-to", "", "Comma-separated recipient substrings (case-insensitive) whose mail -auto-reply answers (default: all)")
+	autoReplyRelay := flag.String("auto-reply-relay", "", "SMTP server address to send -auto-reply replies to instead of storing them, e.g. localhost:25")
+	onOpen := flag.String("on-open", "", "Executable to run each time an email's -track-opens pixel is loaded (email JSON on stdin)")
+	audit := flag.Bool("audit", false, "Record the metadata of every deleted or evicted email, served by /api/audit")
+	auditMax := flag.Int("audit-max", 1000, "Maximum number of -audit entries kept; the oldest are dropped first")
+	onEvict := flag.String("on-evict", "", "Executable to run for each email evicted by -retention or X-Mailer-TTL (email JSON on stdin, reason in MAILER_EVICT_REASON)")
+	onCaptureTimeout := flag.Duration("on-capture-timeout", 30*time.Second, "Maximum run time of the on-capture, on-evict and on-open executables, of -webhook requests and of -publish connects and writes")
+	onCaptureWorkers := flag.Int("on-capture-workers", 4, "Maximum number of concurrently running on-capture, on-evict or on-open executables or -webhook requests each")
 	flag.Parse()
+	envFallback("api-keys", "admin-key", "webhook-secret", "publish", "http-tls-cert", "http-tls-key", "http-client-ca")
+
+	if (*httpTLSCert == "") != (*httpTLSKey == "") {
+		log.Fatalf("-http-tls-cert and -http-tls-key must be set together")
+	}
+	if *httpClientCA != "" && *httpTLSCert == "" {
+		log.Fatalf("-http-client-ca requires -http-tls-cert and -http-tls-key")
+	}
+	if (*autoReplyTo != "" || *autoReplyRelay != "") && *autoReply == "" {
+		log.Fatalf("-auto-reply-to and -auto-reply-relay require -auto-reply")
+	}
+	if *disableVRFY && *validRecipients != "" {
+		log.Fatalf("-disable-vrfy and -valid-recipients cannot be combined")
+	}
+	if *webhookSecret != "" && *webhook == "" {
+		log.Fatalf("-webhook-secret requires -webhook")
+	}
+	if *warnRecipients >= smtp.MaxRecipients {
+		log.Fatalf("-warn-recipients must be below the hard limit of %d recipients", smtp.MaxRecipients)
+	}
+	newlines := map[string]string{"": "", "lf": "\n", "crlf": "\r\n"}
+	newline, ok := newlines[strings.ToLower(*normalizeNewlines)]
+	if !ok {
+		log.Fatalf("-normalize-newlines must be lf or crlf")
+	}
+	primary, secondary, _ := strings.Cut(*storageSpec, "+")
+	if primary != "memory" {
+		log.Fatalf("-storage primary must be memory")
+	}
+	mirrorDir, isDir := strings.CutPrefix(secondary, "dir:")
+	if secondary != "" && (!isDir || mirrorDir == "") {
+		log.Fatalf("-storage secondary must be dir:<path>")
+	}
+	if *audit && *auditMax <= 0 {
+		log.Fatalf("-audit-max must be positive")
+	}
+	if *basePath != "" {
+		*basePath = "/" + strings.Trim(*basePath, "/")
+	}
+	httpScheme := "http"
+	if *httpTLSCert != "" {
+		httpScheme = "https"
+	}
+
+	keys := splitList(*apiKeys)
 
 	// Create storage
 	store := storage.NewStore()
+	connections := storage.NewConnectionRegistry()
+	store.SetRetention(*retention)
 
-	// Setup HTTP server
-	handler := api.NewHandler(store, *smtpAddr, *imapAddr, *httpAddr)
-	httpServer := &http.Server{
-		Addr:    *httpAddr,
-		Handler: handler.SetupRoutes(),
+	// Redact first so no other hook, listener or IMAP client sees the
+	// sensitive values
+	if len(redact) > 0 {
+		redactor, err := hooks.NewRedactor(redact)
+		if err != nil {
+			log.Fatalf("Invalid -redact pattern: %v", err)
+		}
+		store.BeforeSave(redactor.Redact)
 	}
 
-	// Start SMTP server in goroutine
-	go func() {
-		if err := smtp.StartServer(store, *smtpAddr); err != nil {
-			log.Fatalf("SMTP server error: %v", err)
+	// Scan HTML before links are rewritten so findings reflect the original body
+	if *scanHTML {
+		store.BeforeSave(analysis.ScanHTML)
+	}
+
+	// Rewrite links through the click-tracking endpoint
+	if *rewriteLinks {
+		rewriter := hooks.NewLinkRewriter(browserURL(httpScheme, *httpAddr) + *basePath)
+		store.BeforeSave(rewriter.Rewrite)
+	}
+
+	// Add the open-tracking pixel
+	if *trackOpens {
+		tracker := hooks.NewOpenTracker(browserURL(httpScheme, *httpAddr) + *basePath)
+		store.BeforeSave(tracker.Inject)
+	}
+
+	// Wrap text-only emails in HTML last so the HTML hooks above only see
+	// bodies that were actually sent
+	if *wrapText {
+		store.BeforeSave(hooks.WrapText)
+	}
+
+	// Normalize line endings after all body transforms so every stored body
+	// byte follows the chosen style
+	if newline != "" {
+		store.BeforeSave(hooks.NewNewlineNormalizer(newline).Normalize)
+	}
+
+	// Mirror saves and deletions to the secondary store. Reads stay on the
+	// in-memory store and mirror failures are only logged.
+	if mirrorDir != "" {
+		mirror, err := storage.NewDirMirror(mirrorDir)
+		if err != nil {
+			log.Fatalf("Failed to create storage mirror: %v", err)
 		}
-	}()
+		store.OnSave(mirror.Save)
+		store.OnDelete(mirror.Delete)
+		log.Printf("Mirroring stored emails to %s", mirror.Dir())
+	}
+
+	// Register the per-message processing hook
+	if *onCapture != "" {
+		hook := hooks.NewExecHook(*onCapture, *onCaptureWorkers, *onCaptureTimeout)
+		store.OnSave(hook.Handle)
+		log.Printf("Running %s for each captured email", *onCapture)
+	}
+
+	// Post captured emails to the webhook
+	if *webhook != "" {
+		hook := hooks.NewWebhookHook(*webhook, *webhookSecret, *onCaptureWorkers, *onCaptureTimeout)
+		store.OnSave(hook.Handle)
+		log.Printf("Posting each captured email to %s", *webhook)
+	}
+
+	// Publish captured emails to the message queue
+	if *publish != "" {
+		if strings.HasPrefix(*publish, "kafka://") {
+			log.Fatalf("-publish doesn't support Kafka, only nats:// URLs")
+		}
+		publisher, err := hooks.NewNATSPublisher(*publish, *onCaptureTimeout)
+		if err != nil {
+			log.Fatalf("Invalid -publish URL: %v", err)
+		}
+		store.OnSave(publisher.Handle)
+		log.Printf("Publishing each captured email to NATS subject %s", publisher.Subject())
+	}
+
+	// Stream captured emails to stdout
+	if *stdoutJSON {
+		store.OnSave(hooks.NewJSONWriter(os.Stdout, splitList(*stdoutFields)).Handle)
+	}
+
+	// Register the open hook
+	if *onOpen != "" {
+		hook := hooks.NewExecHook(*onOpen, *onCaptureWorkers, *onCaptureTimeout)
+		store.OnOpen(hook.HandleOpened)
+		log.Printf("Running %s for each opened email", *onOpen)
+	}
+
+	// Log evictions and register the eviction hook
+	store.OnEvict(func(email *models.Email, reason string) {
+		log.Printf("Email %d evicted (%s)", email.ID, reason)
+	})
+	if *onEvict != "" {
+		hook := hooks.NewExecHook(*onEvict, *onCaptureWorkers, *onCaptureTimeout)
+		store.OnEvict(hook.HandleEvicted)
+		log.Printf("Running %s for each evicted email", *onEvict)
+	}
+
+	// Record deletions for the audit endpoint
+	var auditLog *storage.AuditLog
+	if *audit {
+		auditLog = storage.NewAuditLog(*auditMax, store)
+		store.OnDelete(auditLog.Record)
+		log.Printf("Auditing deletions (keeping up to %d entries)", *auditMax)
+	}
+
+	// Configure message parsing and SMTP validation
+	parseOpts := smtp.ParseOptions{
+		KeepEncoded: *keepEncoded,
+		MaxRawBytes: *maxRawBytes,
+		DefaultFrom: *defaultFrom,
+		DefaultTo:   *defaultTo,
+
+		AttachmentTextBytes: *attachmentTextBytes,
+		MaxAttachmentSize:   *maxAttachmentSize,
+		MaxAttachments:      *maxAttachments,
+		AllowTimeOverride:   *allowTimeOverride,
+		Clock:               store, // Receive times follow the store's clock, which expiry uses
+	}
+	smtpOpts := smtp.Options{
+		Parse:           parseOpts,
+		MaxSubjectLen:   *maxSubjectLen,
+		MaxBodyBytes:    *maxBodyBytes,
+		RejectOversize:  *rejectOversize,
+		MaxMessageBytes: *maxMessageBytes,
+		MaxLineLength:   *maxLineLength,
+		ParseWorkers:    *parseWorkers,
+		AddReceived:     *addReceived,
+		WarnRecipients:  *warnRecipients,
+		IgnoreFrom:      splitList(*ignoreFrom),
+		IgnoreSubject:   splitList(*ignoreSubject),
+		Keys:            keys,
+
+		MaxMessagesPerConn: *maxMsgsPerConn,
+		ReadRate:           *smtpReadRate,
+		CaptureTranscript:  *captureTranscript,
+		DisableVRFY:        *disableVRFY,
+		ValidRecipients:    splitList(*validRecipients),
+	}
+	if *acceptMessage != "" {
+		tmpl, err := template.New("accept-message").Parse(*acceptMessage)
+		if err != nil {
+			log.Fatalf("Invalid -accept-message template: %v", err)
+		}
+		smtpOpts.AcceptMessage = tmpl
+	}
+
+	// Answer captured emails, registered after the capture hooks so they
+	// see each original before its reply
+	if *autoReply != "" {
+		tmpl, err := template.New("auto-reply").Parse(*autoReply)
+		if err != nil {
+			log.Fatalf("Invalid -auto-reply template: %v", err)
+		}
+		replier := smtp.NewAutoReplier(store, tmpl, splitList(*autoReplyTo), *autoReplyRelay, parseOpts)
+		store.OnSave(replier.Handle)
+		log.Printf("Auto-replying to captured emails")
+	}
+
+	// Start SMTP server
+	smtpServer, err := smtp.StartServer(store, connections, *smtpAddr, smtpOpts)
+	if err != nil {
+		log.Fatalf("SMTP server error: %v", err)
+	}
 
 	// Start IMAP server in goroutine
 	go func() {
-		if err := imapserver.StartServer(store, *imapAddr); err != nil {
+		imapOpts := imapserver.Options{Parse: parseOpts, PerRecipient: *imapPerRecipient, Dedup: *dedup, IdleMax: *idleMax}
+		if err := imapserver.StartServer(store, connections, *imapAddr, imapOpts); err != nil {
 			log.Fatalf("IMAP server error: %v", err)
 		}
 	}()
 
-	// Start HTTP server in goroutine
+	// Setup HTTP server
+	handler := api.NewHandler(store, connections, *smtpAddr, *imapAddr, *httpAddr, api.Options{
+		Latency:  *httpLatency,
+		Jitter:   *httpJitter,
+		Keys:     keys,
+		AdminKey: *adminKey,
+		BasePath: *basePath,
+		Audit:    auditLog,
+
+		SMTPCapabilities: smtpServer.Capabilities(),
+		IMAPCapabilities: imapserver.Capabilities(),
+	})
+	httpServer := &http.Server{
+		Addr:    *httpAddr,
+		Handler: handler.SetupRoutes(),
+	}
+	if *httpClientCA != "" {
+		tlsConfig, err := clientCertTLSConfig(*httpClientCA)
+		if err != nil {
+			log.Fatalf("Invalid -http-client-ca: %v", err)
+		}
+		httpServer.TLSConfig = tlsConfig
+		log.Printf("HTTP clients must present a certificate signed by %s", *httpClientCA)
+	}
+
+	// Start HTTP server in goroutine, binding first so the browser can't
+	// race the listener
+	httpListener, err := net.Listen("tcp", *httpAddr)
+	if err != nil {
+		log.Fatalf("HTTP server error: %v", err)
+	}
 	go func() {
 		log.Printf("HTTP server starting on %s", *httpAddr)
 
-		// Construct proper URL for browser
-		browserURL := *httpAddr
-		if browserURL[0] == ':' {
-			browserURL = "localhost" + browserURL
-		} else if len(browserURL) >= 7 && browserURL[:7] == "0.0.0.0" {
-			browserURL = "localhost" + browserURL[7:]
+		var err error
+		if *httpTLSCert != "" {
+			err = httpServer.ServeTLS(httpListener, *httpTLSCert, *httpTLSKey)
+		} else {
+			err = httpServer.Serve(httpListener)
 		}
-		log.Printf("Open http://%s in your browser", browserURL)
-
-		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("HTTP server error: %v", err)
 		}
 	}()
 
+	uiURL := browserURL(httpScheme, *httpAddr) + *basePath
+	if !*noBanner {
+		log.Printf("Open %s in your browser", uiURL)
+	}
+	if *openBrowserFlag {
+		if err := openBrowser(uiURL); err != nil {
+			log.Printf("Failed to open browser: %v", err)
+		}
+	}
+
+	// Sweep expired emails
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			if deleted := store.DeleteExpired(); deleted > 0 {
+				log.Printf("Retention sweep deleted %d expired email(s)", deleted)
+			}
+		}
+	}()
+
+	// Clear the store on SIGHUP so test runners can reset between runs
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			count := store.DeleteAll()
+			log.Printf("SIGHUP received, cleared %d email(s)", count)
+		}
+	}()
+
 	// Wait for interrupt signal for graceful shutdown
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+
+	// Shut down like on SIGTERM once no email has been captured for a while
+	if *idleShutdown > 0 {
+		var lastCapture atomic.Int64
+		lastCapture.Store(store.Now().UnixNano())
+		store.OnSave(func(*models.Email) {
+			lastCapture.Store(store.Now().UnixNano())
+		})
+		log.Printf("Shutting down after %s without captured emails", *idleShutdown)
+
+		go func() {
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			var warnedFor int64 // Capture time the countdown warning was logged for
+			for range ticker.C {
+				last := lastCapture.Load()
+				remaining := *idleShutdown - store.Now().Sub(time.Unix(0, last))
+				if remaining <= 0 {
+					log.Printf("No emails captured for %s, shutting down", *idleShutdown)
+					quit <- syscall.SIGTERM
+					return
+				}
+				if (remaining <= *idleShutdown/10 || remaining <= 10*time.Second) && warnedFor != last {
+					log.Printf("Idle, shutting down in %s unless an email is captured", remaining.Round(time.Second))
+					warnedFor = last
+				}
+			}
+		}()
+	}
+
 	<-quit
 
 	log.Println("Shutting down servers...")
@@ -110,10 +518,123 @@ func runServer() {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
+	// Let messages being received finish storing before closing SMTP sessions
+	if err := smtpServer.Shutdown(ctx); err != nil {
+		log.Printf("SMTP server shutdown error: %v", err)
+	}
+
 	if err := httpServer.Shutdown(ctx); err != nil {
 		log.Printf("HTTP server shutdown error: %v", err)
 	}
 
 	log.Println("Servers stopped")
-	fmt.Printf("\nCaptured %d email(s) during this session\n", store.Count())
+
+	// Keep stdout a clean JSON stream when it is used for captured emails
+	summary := os.Stdout
+	if *stdoutJSON {
+		summary = os.Stderr
+	}
+	fmt.Fprintf(summary, "\nCaptured %d email(s) during this session\n", store.Count())
+}
+
+// listFlag collects the values of a flag that can be given multiple times,
+// for values like regular expressions that may contain commas
+type listFlag []string
+
+// String returns the values joined with commas
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set adds a value
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// envFallback sets each named flag that wasn't given on the command line
+// from its MAILER_* environment variable (e.g. -webhook-secret from
+// MAILER_WEBHOOK_SECRET), so secrets needn't show up in process listings.
+// Flags take precedence over the environment.
+func envFallback(names ...string) {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	for _, name := range names {
+		if set[name] {
+			continue
+		}
+		env := "MAILER_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		if value, ok := os.LookupEnv(env); ok {
+			if err := flag.Set(name, value); err != nil {
+				log.Fatalf("Invalid %s: %v", env, err)
+			}
+		}
+	}
+}
+
+// clientCertTLSConfig returns a TLS config requiring client certificates
+// signed by one of the CAs in the PEM file at caFile
+func clientCertTLSConfig(caFile string) (*tls.Config, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", caFile)
+	}
+
+	return &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+	}, nil
+}
+
+// browserURL constructs a URL for reaching the HTTP server from a browser.
+// Wildcard bind addresses such as ":8080", "0.0.0.0:8080" and "[::]:8080"
+// are reached through localhost; specific hosts are kept as they are.
+func browserURL(scheme string, httpAddr string) string {
+	host, port, err := net.SplitHostPort(httpAddr)
+	if err != nil {
+		return scheme + "://" + httpAddr
+	}
+	switch host {
+	case "", "0.0.0.0", "::":
+		host = "localhost"
+	}
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
+
+// openBrowser opens url in the default browser using the platform's opener
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// Reap the opener without blocking startup
+	go cmd.Wait()
+	return nil
 }
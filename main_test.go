@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestBrowserURL(t *testing.T) {
+	tests := []struct {
+		scheme string
+		addr   string
+		want   string
+	}{
+		{"http", ":8080", "http://localhost:8080"},
+		{"http", "0.0.0.0:8080", "http://localhost:8080"},
+		{"http", "[::]:8080", "http://localhost:8080"},
+		{"http", "127.0.0.1:8080", "http://127.0.0.1:8080"},
+		{"http", "mail.test:80", "http://mail.test:80"},
+		{"https", "[::1]:8443", "https://[::1]:8443"},
+		{"https", "[2001:db8::1]:8443", "https://[2001:db8::1]:8443"},
+		{"http", "localhost", "http://localhost"},
+	}
+	for _, tt := range tests {
+		if got := browserURL(tt.scheme, tt.addr); got != tt.want {
+			t.Errorf("browserURL(%q, %q) = %q, want %q", tt.scheme, tt.addr, got, tt.want)
+		}
+	}
+}
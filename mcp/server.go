@@ -6,25 +6,40 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
+	"github.com/google/jsonschema-go/jsonschema"
 	"github.com/modelcontextprotocol/go-sdk/mcp"
 	"mailer/models"
 )
 
+// Options configures how the MCP server talks to the daemon
+type Options struct {
+	Retries      int           // Extra attempts for reads that fail with a connection error or 5xx
+	RetryBackoff time.Duration // Delay before the first retry, doubled for each further one
+	MaxBodyBytes int           // Cap on get_email's body, HTML and attachment text (0 = unlimited)
+	ListLimit    int           // Emails included in the email://list resource (0 = unlimited)
+}
+
 // Server provides MCP access to the mailer daemon
 type Server struct {
 	apiURL string
 	client *http.Client
+	opts   Options
 }
 
-// NewServer creates a new MCP server that connects to the mailer daemon
-func NewServer(apiURL string) *Server {
+// NewServer creates a new MCP server that connects to the mailer daemon.
+// apiURL may include the daemon's base path, e.g. http://host/mailer.
+func NewServer(apiURL string, opts Options) *Server {
 	return &Server{
-		apiURL: apiURL,
+		apiURL: strings.TrimSuffix(apiURL, "/"),
 		client: &http.Client{Timeout: 10 * time.Second},
+		opts:   opts,
 	}
 }
 
@@ -45,6 +60,15 @@ type ListEmailsOutput struct {
 	HasMore    bool           `json:"hasMore"`
 }
 
+// EmailListResource is the content of the email://list resource
+type EmailListResource struct {
+	Emails     []EmailSummary `json:"emails"`
+	Count      int            `json:"count"`
+	TotalCount int            `json:"totalCount"`
+	HasMore    bool           `json:"hasMore"`
+	Note       string         `json:"note"`
+}
+
 // EmailSummary provides a brief email summary
 type EmailSummary struct {
 	ID         int    `json:"id"`
@@ -61,12 +85,15 @@ type GetEmailInput struct {
 
 // GetEmailOutput defines output for get_email tool
 type GetEmailOutput struct {
-	Email *models.Email `json:"email"`
+	Email     *models.Email `json:"email"`
+	Truncated bool          `json:"truncated,omitempty"`
+	Note      string        `json:"note,omitempty"`
 }
 
 // SearchEmailsInput defines input for search_emails tool
 type SearchEmailsInput struct {
-	Query string `json:"query"`
+	Query       string `json:"query"`
+	Attachments bool   `json:"attachments,omitempty"`
 }
 
 // SearchEmailsOutput defines output for search_emails tool
@@ -100,7 +127,7 @@ func (s *Server) Run(ctx context.Context) error {
 		&mcp.Resource{
 			URI:         "email://list",
 			Name:        "Email List",
-			Description: "List of all captured emails",
+			Description: "Summaries of the most recent captured emails; use get_email for full content and list_emails to page through the rest",
 			MIMEType:    "application/json",
 		},
 		s.resourceEmailList,
@@ -113,13 +140,14 @@ func (s *Server) Run(ctx context.Context) error {
 	}, s.listEmails)
 
 	mcp.AddTool(server, &mcp.Tool{
-		Name:        "get_email",
-		Description: "Get complete email details by ID including body, HTML body, and headers.",
+		Name:         "get_email",
+		Description:  "Get complete email details by ID including body, HTML body, and headers. Large bodies are truncated; the result then says so and links the full email.",
+		OutputSchema: getEmailOutputSchema(),
 	}, s.getEmail)
 
 	mcp.AddTool(server, &mcp.Tool{
 		Name:        "search_emails",
-		Description: "Search emails by text content in subject or body (case-insensitive).",
+		Description: "Search emails by text content in subject or body (case-insensitive). Set attachments to also search text-like attachments (text/*, JSON, CSV, XML).",
 	}, s.searchEmails)
 
 	mcp.AddTool(server, &mcp.Tool{
@@ -143,7 +171,24 @@ func (s *Server) resourceEmailList(ctx context.Context, req *mcp.ReadResourceReq
 		return nil, err
 	}
 
-	data, err := json.MarshalIndent(emails, "", "  ")
+	// The daemon lists the newest emails first, so the cap keeps the most recent
+	list := EmailListResource{
+		Emails:     make([]EmailSummary, 0, len(emails)),
+		TotalCount: len(emails),
+		Note:       "Summaries only. Use the get_email tool with an email's id for its body, HTML and headers.",
+	}
+	if limit := s.opts.ListLimit; limit > 0 && len(emails) > limit {
+		emails = emails[:limit]
+		list.HasMore = true
+		list.Note = fmt.Sprintf("Showing the %d most recent of %d emails. Use the list_emails tool with offset and limit to page through the rest, "+
+			"and the get_email tool with an email's id for its body, HTML and headers.", limit, list.TotalCount)
+	}
+	for _, email := range emails {
+		list.Emails = append(list.Emails, summarize(email))
+	}
+	list.Count = len(list.Emails)
+
+	data, err := json.MarshalIndent(list, "", "  ")
 	if err != nil {
 		return nil, err
 	}
@@ -159,6 +204,17 @@ func (s *Server) resourceEmailList(ctx context.Context, req *mcp.ReadResourceReq
 	}, nil
 }
 
+// summarize reduces an email to its summary
+func summarize(email *models.Email) EmailSummary {
+	return EmailSummary{
+		ID:         email.ID,
+		From:       email.From,
+		To:         models.FormatAddressList(email.To),
+		Subject:    email.Subject,
+		ReceivedAt: email.ReceivedAt.Format(time.RFC3339),
+	}
+}
+
 // listEmails tool implementation
 func (s *Server) listEmails(ctx context.Context, req *mcp.CallToolRequest, input ListEmailsInput) (*mcp.CallToolResult, *ListEmailsOutput, error) {
 	emails, err := s.fetchAllEmails()
@@ -172,20 +228,16 @@ func (s *Server) listEmails(ctx context.Context, req *mcp.CallToolRequest, input
 		if input.From != "" && !strings.Contains(strings.ToLower(email.From), strings.ToLower(input.From)) {
 			continue
 		}
-		if input.To != "" && !strings.Contains(strings.ToLower(strings.Join(email.To, ",")), strings.ToLower(input.To)) {
+		if input.To != "" && !slices.ContainsFunc(email.To, func(to string) bool {
+			return strings.Contains(strings.ToLower(to), strings.ToLower(input.To))
+		}) {
 			continue
 		}
 		if input.Subject != "" && !strings.Contains(strings.ToLower(email.Subject), strings.ToLower(input.Subject)) {
 			continue
 		}
 
-		filtered = append(filtered, EmailSummary{
-			ID:         email.ID,
-			From:       email.From,
-			To:         strings.Join(email.To, ", "),
-			Subject:    email.Subject,
-			ReceivedAt: email.ReceivedAt.Format(time.RFC3339),
-		})
+		filtered = append(filtered, summarize(email))
 	}
 
 	totalCount := len(filtered)
@@ -233,7 +285,78 @@ func (s *Server) getEmail(ctx context.Context, req *mcp.CallToolRequest, input G
 		return nil, nil, err
 	}
 
-	return nil, &GetEmailOutput{Email: email}, nil
+	output := &GetEmailOutput{Email: email}
+	if s.truncateEmail(email) {
+		output.Truncated = true
+		output.Note = fmt.Sprintf("Content was truncated to %d bytes per field and attachment bytes were omitted; "+
+			"fetch the full email from %s/api/emails/%d", s.opts.MaxBodyBytes, s.apiURL, email.ID)
+	}
+	return nil, output, nil
+}
+
+// getEmailOutputSchema describes GetEmailOutput. Schema inference rejects
+// the recursive MIME structure, so its nodes are described as plain objects.
+func getEmailOutputSchema() *jsonschema.Schema {
+	schema, err := jsonschema.For[GetEmailOutput](&jsonschema.ForOptions{
+		TypeSchemas: map[reflect.Type]*jsonschema.Schema{
+			reflect.TypeFor[models.MIMEPart](): {
+				Type:        "object",
+				Description: "MIME tree node; parts nest recursively",
+			},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return schema
+}
+
+// truncateEmail caps the email's bodies and attachment text at MaxBodyBytes
+// and drops undecoded part bytes, keeping their size and other metadata.
+// It reports whether anything was removed.
+func (s *Server) truncateEmail(email *models.Email) bool {
+	max := s.opts.MaxBodyBytes
+	if max <= 0 {
+		return false
+	}
+
+	truncated := false
+	truncate := func(value *string) {
+		if len(*value) > max {
+			*value = truncateBytes(*value, max)
+			truncated = true
+		}
+	}
+	truncate(&email.Body)
+	truncate(&email.HTMLBody)
+
+	var walk func(part *models.MIMEPart)
+	walk = func(part *models.MIMEPart) {
+		truncate(&part.Text)
+		if part.EncodedBody != nil {
+			part.EncodedBody = nil
+			truncated = true
+		}
+		for _, child := range part.Parts {
+			walk(child)
+		}
+	}
+	if email.Structure != nil {
+		walk(email.Structure)
+	}
+
+	return truncated
+}
+
+// truncateBytes shortens s to at most n bytes without splitting a UTF-8 sequence
+func truncateBytes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
 }
 
 // searchEmails tool implementation
@@ -248,14 +371,9 @@ func (s *Server) searchEmails(ctx context.Context, req *mcp.CallToolRequest, inp
 
 	for _, email := range emails {
 		if strings.Contains(strings.ToLower(email.Subject), query) ||
-			strings.Contains(strings.ToLower(email.Body), query) {
-			results = append(results, EmailSummary{
-				ID:         email.ID,
-				From:       email.From,
-				To:         strings.Join(email.To, ", "),
-				Subject:    email.Subject,
-				ReceivedAt: email.ReceivedAt.Format(time.RFC3339),
-			})
+			strings.Contains(strings.ToLower(email.Body), query) ||
+			(input.Attachments && attachmentsContain(email.Structure, query)) {
+			results = append(results, summarize(email))
 		}
 	}
 
@@ -265,6 +383,23 @@ func (s *Server) searchEmails(ctx context.Context, req *mcp.CallToolRequest, inp
 	}, nil
 }
 
+// attachmentsContain reports whether the text of any attachment in the MIME
+// tree contains the lowercased query
+func attachmentsContain(part *models.MIMEPart, query string) bool {
+	if part == nil {
+		return false
+	}
+	if strings.Contains(strings.ToLower(part.Text), query) {
+		return true
+	}
+	for _, child := range part.Parts {
+		if attachmentsContain(child, query) {
+			return true
+		}
+	}
+	return false
+}
+
 // getStats tool implementation
 func (s *Server) getStats(ctx context.Context, req *mcp.CallToolRequest, input struct{}) (*mcp.CallToolResult, *StatsOutput, error) {
 	emails, err := s.fetchAllEmails()
@@ -286,13 +421,6 @@ func (s *Server) getStats(ctx context.Context, req *mcp.CallToolRequest, input s
 
 // deleteAllEmails tool implementation
 func (s *Server) deleteAllEmails(ctx context.Context, req *mcp.CallToolRequest, input struct{}) (*mcp.CallToolResult, *DeleteAllEmailsOutput, error) {
-	// Get count before deletion
-	emails, err := s.fetchAllEmails()
-	if err != nil {
-		return nil, nil, err
-	}
-	count := len(emails)
-
 	// Call DELETE /api/emails
 	httpReq, err := http.NewRequest(http.MethodDelete, s.apiURL+"/api/emails", nil)
 	if err != nil {
@@ -305,19 +433,48 @@ func (s *Server) deleteAllEmails(ctx context.Context, req *mcp.CallToolRequest,
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+	if resp.StatusCode != http.StatusOK {
 		return nil, nil, fmt.Errorf("API returned status %d", resp.StatusCode)
 	}
 
+	var result struct {
+		Deleted int `json:"deleted"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode delete result: %w", err)
+	}
+
 	return nil, &DeleteAllEmailsOutput{
-		DeletedCount: count,
-		Message:      fmt.Sprintf("Deleted %d email(s)", count),
+		DeletedCount: result.Deleted,
+		Message:      fmt.Sprintf("Deleted %d email(s)", result.Deleted),
 	}, nil
 }
 
+// get performs a GET request against the daemon, retrying connection errors
+// and 5xx responses with exponential backoff. Other responses, including
+// 4xx, are returned as is.
+func (s *Server) get(path string) (*http.Response, error) {
+	backoff := s.opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		resp, err := s.client.Get(s.apiURL + path)
+		if err == nil && resp.StatusCode < 500 {
+			return resp, nil
+		}
+		if attempt >= s.opts.Retries {
+			return resp, err
+		}
+
+		if err == nil {
+			resp.Body.Close()
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
 // fetchAllEmails retrieves all emails from the daemon
 func (s *Server) fetchAllEmails() ([]*models.Email, error) {
-	resp, err := s.client.Get(s.apiURL + "/api/emails")
+	resp, err := s.get("/api/emails")
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch emails: %w", err)
 	}
@@ -337,7 +494,7 @@ func (s *Server) fetchAllEmails() ([]*models.Email, error) {
 
 // fetchEmailByID retrieves a specific email from the daemon
 func (s *Server) fetchEmailByID(id int) (*models.Email, error) {
-	resp, err := s.client.Get(s.apiURL + "/api/emails/" + strconv.Itoa(id))
+	resp, err := s.get("/api/emails/" + strconv.Itoa(id))
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch email: %w", err)
 	}
@@ -367,7 +524,7 @@ type Config struct {
 
 // fetchConfig retrieves server configuration from the daemon
 func (s *Server) fetchConfig() (*Config, error) {
-	resp, err := s.client.Get(s.apiURL + "/api/config")
+	resp, err := s.get("/api/config")
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch config: %w", err)
 	}
@@ -0,0 +1,121 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"mailer/models"
+)
+
+// flakyDaemon serves /api/emails, answering the first failures requests
+// with status and counting every request
+func flakyDaemon(t *testing.T, failures int32, status int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= failures {
+			http.Error(w, "busy", status)
+			return
+		}
+		json.NewEncoder(w).Encode([]*models.Email{{ID: 1, Subject: "Hello"}})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func TestFetchRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int32
+		status   int
+		retries  int
+		requests int32
+		ok       bool
+	}{
+		{"recovers within retries", 2, http.StatusServiceUnavailable, 3, 3, true},
+		{"gives up after retries", 5, http.StatusInternalServerError, 2, 3, false},
+		{"no retries configured", 1, http.StatusBadGateway, 0, 1, false},
+		{"4xx not retried", 1, http.StatusNotFound, 3, 1, false},
+	}
+	for _, tt := range tests {
+		srv, requests := flakyDaemon(t, tt.failures, tt.status)
+		s := NewServer(srv.URL, Options{Retries: tt.retries, RetryBackoff: time.Millisecond})
+
+		emails, err := s.fetchAllEmails()
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("%s: fetchAllEmails error = %v, want success %v", tt.name, err, tt.ok)
+		}
+		if tt.ok && (len(emails) != 1 || emails[0].Subject != "Hello") {
+			t.Errorf("%s: emails = %v", tt.name, emails)
+		}
+		if n := requests.Load(); n != tt.requests {
+			t.Errorf("%s: %d requests, want %d", tt.name, n, tt.requests)
+		}
+	}
+}
+
+func TestFetchRetriesConnectionErrors(t *testing.T) {
+	// A listener that's already closed refuses every connection
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+
+	s := NewServer(url, Options{Retries: 2, RetryBackoff: 20 * time.Millisecond})
+	start := time.Now()
+	_, err := s.fetchEmailByID(1)
+	if err == nil || !strings.Contains(err.Error(), "failed to fetch email") {
+		t.Fatalf("fetchEmailByID error = %v, want a connection error", err)
+	}
+	// Two retries wait 20ms and then 40ms
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("gave up after %v, want two retries with backoff", elapsed)
+	}
+}
+
+func TestSearchAttachments(t *testing.T) {
+	emails := []*models.Email{
+		{ID: 1, Subject: "Orders", Body: "See attached", Structure: &models.MIMEPart{
+			ContentType: "multipart/mixed",
+			Parts: []*models.MIMEPart{
+				{ContentType: "text/plain"},
+				{ContentType: "text/csv", Filename: "orders.csv", Text: "id,total\nORD-42,10\n"},
+			},
+		}},
+		{ID: 2, Subject: "ORD-42 shipped", Body: "On its way"},
+		{ID: 3, Subject: "Unrelated", Body: "Nothing here"},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(emails)
+	}))
+	t.Cleanup(srv.Close)
+	s := NewServer(srv.URL, Options{})
+
+	tests := []struct {
+		input SearchEmailsInput
+		want  []int
+	}{
+		{SearchEmailsInput{Query: "ord-42"}, []int{2}},
+		{SearchEmailsInput{Query: "ord-42", Attachments: true}, []int{1, 2}},
+		{SearchEmailsInput{Query: "orders.csv", Attachments: true}, []int{}},
+	}
+	for _, tt := range tests {
+		_, out, err := s.searchEmails(context.Background(), nil, tt.input)
+		if err != nil {
+			t.Fatalf("searchEmails(%+v): %v", tt.input, err)
+		}
+		ids := []int{}
+		for _, email := range out.Emails {
+			ids = append(ids, email.ID)
+		}
+		if !slices.Equal(ids, tt.want) {
+			t.Errorf("searchEmails(%+v) = %v, want %v", tt.input, ids, tt.want)
+		}
+	}
+}
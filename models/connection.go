@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+// Connection represents an open SMTP or IMAP client session
+type Connection struct {
+	ID          int       `json:"id"`
+	Protocol    string    `json:"protocol"`
+	RemoteAddr  string    `json:"remoteAddr"`
+	ConnectedAt time.Time `json:"connectedAt"`
+}
@@ -1,16 +1,271 @@
 package models
 
-import "time"
+import (
+	"maps"
+	"net/mail"
+	"strings"
+	"time"
+)
 
 // Email represents a captured email message
 type Email struct {
-	ID          int       `json:"id"`
-	From        string    `json:"from"`
-	To          []string  `json:"to"`
-	Subject     string    `json:"subject"`
-	Body        string    `json:"body"`
-	HTMLBody    string    `json:"htmlBody"`
-	Date        time.Time `json:"date"`
-	RawHeaders  string    `json:"rawHeaders"`
-	ReceivedAt  time.Time `json:"receivedAt"`
+	ID                  int        `json:"id"`
+	From                string     `json:"from"`
+	EnvelopeFrom        string     `json:"envelopeFrom,omitempty"`
+	To                  []string   `json:"to"`
+	Subject             string     `json:"subject"`
+	MessageID           string     `json:"messageId,omitempty"`
+	Body                string     `json:"body"`
+	HTMLBody            string     `json:"htmlBody"`
+	Calendar            string     `json:"calendar,omitempty"` // iCalendar text of the first text/calendar part
+	Date                time.Time  `json:"date"`
+	RawHeaders          string     `json:"rawHeaders"`
+	RawHeaderBlock      string     `json:"rawHeaderBlock,omitempty"` // Header section byte-for-byte as received, without the final blank line
+	ReceivedAt          time.Time  `json:"receivedAt"`
+	Structure           *MIMEPart  `json:"structure,omitempty"`
+	ExpiresAt           *time.Time `json:"expiresAt,omitempty"`
+	ListUnsubscribe     []string   `json:"listUnsubscribe,omitempty"`     // URIs from the List-Unsubscribe header
+	ListUnsubscribePost string     `json:"listUnsubscribePost,omitempty"` // One-click List-Unsubscribe-Post value
+	ListID              string     `json:"listId,omitempty"`
+	SecurityFlags       []string   `json:"securityFlags,omitempty"` // Dangerous HTML found by -scan-html
+	Key                 string     `json:"-"`                       // API key partition the email belongs to ("" = shared)
+	UIDValidity         uint32     `json:"-"`                       // UID validity of the store when saved; ID and UIDValidity together are never reused
+	TrackingToken       string     `json:"-"`                       // Secret in the email's click and open tracking URLs, which browsers request without an API key
+
+	// Read reports whether the email carries the \Seen flag, set by an IMAP
+	// fetch or by the API's ?markRead=true. The flag lives in the store, so
+	// this is only filled in on API responses.
+	Read bool `json:"read"`
+
+	// Raw is the message as received, which IMAP clients are served so
+	// BODYSTRUCTURE and body sections agree. It is nil for emails created
+	// through the API and is dropped by hooks that must hide content, such
+	// as -redact; IMAP then serves a message rebuilt from the bodies.
+	Raw []byte `json:"-"`
+
+	// CustomHeaders holds the values of all X- headers by canonical name,
+	// indexed by the store for exact-match lookups
+	CustomHeaders map[string][]string `json:"customHeaders,omitempty"`
+
+	// Set when From/To were filled from the configured defaults because the
+	// message had neither envelope nor header values
+	FromSynthesized bool `json:"fromSynthesized,omitempty"`
+	ToSynthesized   bool `json:"toSynthesized,omitempty"`
+
+	// Transcript is the SMTP dialog that delivered the message, one
+	// "C: "/"S: " line each, captured with -capture-transcript
+	Transcript string `json:"transcript,omitempty"`
+
+	// Set when the message had more envelope recipients than -warn-recipients
+	HighRecipientCount bool `json:"highRecipientCount,omitempty"`
+
+	// Set when the message had no Content-Type header, so it was read as
+	// text/plain; charset=us-ascii as RFC 2045 prescribes
+	ContentTypeMissing bool `json:"contentTypeMissing,omitempty"`
+
+	// Set when HTMLBody was generated from the text body by -wrap-text
+	// because the message had no HTML part
+	GeneratedHTML bool `json:"generatedHtml,omitempty"`
+
+	// Set when the message has a multipart/signed or multipart/encrypted
+	// part (RFC 1847) or an S/MIME application/pkcs7-mime part. Signatures
+	// aren't verified and nothing is decrypted.
+	Signed    bool        `json:"signed,omitempty"`
+	Encrypted bool        `json:"encrypted,omitempty"`
+	Crypto    *CryptoInfo `json:"crypto,omitempty"`
+
+	// Set when attachment limits kept only the metadata of some
+	// attachments, see MIMEPart.Truncated
+	AttachmentsTruncated bool `json:"attachmentsTruncated,omitempty"`
+
+	// Redactions counts the matches of each -redact pattern replaced in
+	// the email's text, see hooks.Redactor
+	Redactions map[string]int `json:"redactions,omitempty"`
+
+	// Set when -normalize-newlines changed the line endings of Body or
+	// HTMLBody; RawHeaderBlock keeps the original bytes
+	NewlinesNormalized bool `json:"newlinesNormalized,omitempty"`
+}
+
+// HasRecipient reports whether address is one of the email's recipients,
+// comparing bare addresses case-insensitively
+func (e *Email) HasRecipient(address string) bool {
+	address = bareAddress(address)
+	for _, to := range e.To {
+		if bareAddress(to) == address {
+			return true
+		}
+	}
+	return false
+}
+
+// bareAddress reduces "Name <addr>" forms to the lowercased bare address
+func bareAddress(addr string) string {
+	if parsed, err := mail.ParseAddress(addr); err == nil {
+		addr = parsed.Address
+	}
+	return strings.ToLower(strings.TrimSpace(addr))
+}
+
+// NormalizeAddress returns the canonical form of an address: the bare
+// address, or `Name <addr>` with the name quoted when it contains specials
+// such as commas. Addresses that don't parse are returned trimmed.
+func NormalizeAddress(addr string) string {
+	parsed, err := mail.ParseAddress(addr)
+	if err != nil {
+		return strings.TrimSpace(addr)
+	}
+	return formatAddress(parsed)
+}
+
+// ParseAddressList splits a header-style address list into canonical
+// addresses, honoring commas inside quoted display names. Lists that don't
+// parse are split at every comma instead.
+func ParseAddressList(list string) []string {
+	var addrs []string
+	if parsed, err := mail.ParseAddressList(list); err == nil {
+		for _, addr := range parsed {
+			addrs = append(addrs, formatAddress(addr))
+		}
+		return addrs
+	}
+
+	for _, addr := range strings.Split(list, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// FormatAddressList joins addresses with ", " so that the result can be
+// split again with ParseAddressList
+func FormatAddressList(addrs []string) string {
+	formatted := make([]string, len(addrs))
+	for i, addr := range addrs {
+		formatted[i] = NormalizeAddress(addr)
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// formatAddress formats a parsed address, keeping non-ASCII display names
+// readable rather than RFC 2047 encoding them like mail.Address.String
+func formatAddress(addr *mail.Address) string {
+	// Let net/mail quote the local part where needed
+	bare := (&mail.Address{Address: addr.Address}).String()
+	bare = strings.TrimSuffix(strings.TrimPrefix(bare, "<"), ">")
+	if addr.Name == "" {
+		return bare
+	}
+
+	name := addr.Name
+	if strings.ContainsAny(name, `()<>[]:;@\,."`) {
+		name = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name) + `"`
+	}
+	return name + " <" + bare + ">"
+}
+
+// Clone returns a copy of the email that can be modified and saved as a new
+// capture without affecting the original. The MIME structure is shared since
+// it is never modified after parsing.
+func (e *Email) Clone() *Email {
+	clone := *e
+	clone.To = append([]string(nil), e.To...)
+	clone.CustomHeaders = maps.Clone(e.CustomHeaders)
+	if e.ExpiresAt != nil {
+		expiresAt := *e.ExpiresAt
+		clone.ExpiresAt = &expiresAt
+	}
+	return &clone
+}
+
+// EmailComparator returns a comparison function for sorting emails by key:
+// "date" (receive time), "from" or "subject", the latter two compared
+// case-insensitively. A "-" prefix sorts descending. Ties are broken by ID
+// in the same direction. ok is false for unknown keys.
+func EmailComparator(key string) (cmp func(a, b *Email) int, ok bool) {
+	descending := strings.HasPrefix(key, "-")
+	var compare func(a, b *Email) int
+	switch strings.TrimPrefix(key, "-") {
+	case "date":
+		compare = func(a, b *Email) int { return a.ReceivedAt.Compare(b.ReceivedAt) }
+	case "from":
+		compare = func(a, b *Email) int { return strings.Compare(strings.ToLower(a.From), strings.ToLower(b.From)) }
+	case "subject":
+		compare = func(a, b *Email) int { return strings.Compare(strings.ToLower(a.Subject), strings.ToLower(b.Subject)) }
+	default:
+		return nil, false
+	}
+
+	return func(a, b *Email) int {
+		c := compare(a, b)
+		if c == 0 {
+			c = a.ID - b.ID
+		}
+		if descending {
+			return -c
+		}
+		return c
+	}, true
+}
+
+// CryptoInfo describes the first signed or encrypted part of a message
+type CryptoInfo struct {
+	Format    string `json:"format"`              // "pgp" or "smime"
+	Protocol  string `json:"protocol,omitempty"`  // protocol parameter of multipart/signed or multipart/encrypted
+	Micalg    string `json:"micalg,omitempty"`    // Digest algorithm of a multipart/signed signature, e.g. pgp-sha256
+	SMIMEType string `json:"smimeType,omitempty"` // smime-type of an application/pkcs7-mime part, e.g. enveloped-data
+}
+
+// MIMEPart represents a node in the parsed MIME tree of a message
+type MIMEPart struct {
+	ContentType     string            `json:"contentType"`
+	Params          map[string]string `json:"params,omitempty"`
+	Encoding        string            `json:"encoding,omitempty"`
+	EncodingNote    string            `json:"encodingNote,omitempty"` // Problem found decoding the part, e.g. 8-bit bytes declared 7bit
+	ContentEncoding string            `json:"contentEncoding,omitempty"`
+	Charset         string            `json:"charset,omitempty"`
+	Disposition     string            `json:"disposition,omitempty"`
+	Filename        string            `json:"filename,omitempty"`
+	Size            int               `json:"size"`
+	Parts           []*MIMEPart       `json:"parts,omitempty"`
+
+	// Set on attachments past -max-attachment-size or
+	// -max-attachments-per-email, which keep their metadata and Size but
+	// no Text or EncodedBody; LimitNote says which limit applied
+	Truncated bool   `json:"truncated,omitempty"`
+	LimitNote string `json:"limitNote,omitempty"`
+
+	// Text holds the decoded content of a text-like attachment, truncated
+	// to -attachment-text-bytes, so attachments can be searched
+	Text string `json:"text,omitempty"`
+
+	// EncodedBody holds the undecoded bytes of a leaf part as received.
+	// Only populated when the server runs with -keep-encoded.
+	EncodedBody []byte `json:"encodedBody,omitempty"`
+}
+
+// AddressCount aggregates the emails seen for a single address
+type AddressCount struct {
+	Address  string    `json:"address"`
+	Count    int       `json:"count"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// OpenStats aggregates the tracked opens of a single email
+type OpenStats struct {
+	Count         int        `json:"count"`
+	FirstOpenedAt *time.Time `json:"firstOpenedAt,omitempty"`
+	LastOpenedAt  *time.Time `json:"lastOpenedAt,omitempty"`
+}
+
+// AuditEntry records the metadata of a removed email. The content itself is
+// not kept.
+type AuditEntry struct {
+	DeletedAt time.Time `json:"deletedAt"`
+	EmailID   int       `json:"emailId"`
+	From      string    `json:"from"`
+	Subject   string    `json:"subject"`
+	Reason    string    `json:"reason"` // See the storage package's deletion and eviction reasons
+	Key       string    `json:"-"`      // Partition of the removed email
 }
@@ -0,0 +1,214 @@
+package smtp
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mailer/models"
+	"mailer/storage"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// AutoReplier answers captured messages like a vacation responder or
+// confirmation mailer would, so reply handling can be tested end to end.
+// Replies are stored like captured mail, or sent to a relay instead.
+type AutoReplier struct {
+	store *storage.Store
+	body  *template.Template
+	match []string // Lowercased recipient substrings, empty for all
+	relay string   // SMTP address replies are sent to instead of being stored
+	opts  ParseOptions
+}
+
+// NewAutoReplier creates a responder answering messages with a recipient
+// containing any of match (case-insensitive, all when empty). The reply
+// text is body rendered with the original *models.Email as data. With a
+// relay address, replies are sent there over SMTP rather than stored.
+func NewAutoReplier(store *storage.Store, body *template.Template, match []string, relay string, opts ParseOptions) *AutoReplier {
+	r := &AutoReplier{store: store, body: body, relay: relay, opts: opts}
+	for _, m := range match {
+		r.match = append(r.match, strings.ToLower(m))
+	}
+	return r
+}
+
+// Handle replies to the email if one of its recipients matches. Its
+// signature matches Store.OnSave listeners. Failures are logged and never
+// affect the capture.
+func (r *AutoReplier) Handle(email *models.Email) {
+	responder := r.responder(email)
+	if responder == "" {
+		return
+	}
+
+	header := originalHeader(email)
+	if reason := noAutoReplyReason(email, header, responder); reason != "" {
+		log.Printf("Not auto-replying to email %d: %s", email.ID, reason)
+		return
+	}
+
+	to := replyAddress(email)
+	raw, err := r.build(email, header, responder, to)
+	if err != nil {
+		log.Printf("Auto-reply to email %d failed: %v", email.ID, err)
+		return
+	}
+	from := addressOf(responder)
+
+	if r.relay != "" {
+		go func() {
+			if err := relayMessage(r.relay, from, to, raw); err != nil {
+				log.Printf("Auto-reply to email %d failed: %v", email.ID, err)
+				return
+			}
+			log.Printf("Auto-reply to email %d sent to %s via %s", email.ID, to, r.relay)
+		}()
+		return
+	}
+
+	reply, err := ParseMessage(bytes.NewReader(raw), from, []string{to}, r.opts)
+	if err != nil {
+		log.Printf("Auto-reply to email %d failed: %v", email.ID, err)
+		return
+	}
+	reply.Key = email.Key
+	id := r.store.Save(reply)
+	log.Printf("Auto-reply to email %d stored with ID: %d (From: %s, To: %s)", email.ID, id, from, to)
+}
+
+// relayMessage sends one message over a plain SMTP connection to addr
+func relayMessage(addr string, from string, to string, raw []byte) error {
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.SendMail(from, []string{to}, bytes.NewReader(raw)); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// responder returns the first recipient the rule matches, which the reply
+// is sent from, or "" if none does
+func (r *AutoReplier) responder(email *models.Email) string {
+	for _, recipient := range email.To {
+		if len(r.match) == 0 {
+			return recipient
+		}
+		for _, m := range r.match {
+			if strings.Contains(strings.ToLower(recipient), m) {
+				return recipient
+			}
+		}
+	}
+	return ""
+}
+
+// noAutoReplyReason returns why a message must not be answered
+// automatically (RFC 3834 2), which keeps responders, including mailer
+// itself, from replying to each other in a loop, or "" if it may be
+func noAutoReplyReason(email *models.Email, header mail.Header, responder string) string {
+	if value := strings.TrimSpace(header.Get("Auto-Submitted")); value != "" && !strings.EqualFold(value, "no") {
+		return "it is itself automatic (Auto-Submitted: " + value + ")"
+	}
+	switch precedence := strings.ToLower(strings.TrimSpace(header.Get("Precedence"))); precedence {
+	case "bulk", "list", "junk":
+		return "it has Precedence: " + precedence
+	}
+	if email.ListID != "" {
+		return "it was sent to a mailing list"
+	}
+	if email.FromSynthesized {
+		return "it has no sender"
+	}
+
+	sender := addressOf(replyAddress(email))
+	local, _, _ := strings.Cut(sender, "@")
+	switch {
+	case sender == "":
+		return "it has no sender"
+	case strings.EqualFold(local, "mailer-daemon"), strings.EqualFold(local, "postmaster"):
+		return "it comes from " + sender
+	case strings.EqualFold(sender, addressOf(responder)):
+		return "it was sent by the responding address"
+	}
+	return ""
+}
+
+// build renders the reply message: from the responder to the sender,
+// threaded with In-Reply-To and References and marked Auto-Submitted
+func (r *AutoReplier) build(email *models.Email, header mail.Header, responder string, to string) ([]byte, error) {
+	var text strings.Builder
+	if err := r.body.Execute(&text, email); err != nil {
+		return nil, err
+	}
+
+	subject := email.Subject
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", responder)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", r.store.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <auto-reply.%d.%d@mailer>\r\n", email.ID, r.store.Now().UnixNano())
+	if email.MessageID != "" {
+		messageID := "<" + strings.Trim(email.MessageID, "<>") + ">"
+		references := strings.Join(strings.Fields(header.Get("References")+" "+messageID), " ")
+		fmt.Fprintf(&buf, "In-Reply-To: %s\r\n", messageID)
+		fmt.Fprintf(&buf, "References: %s\r\n", references)
+	}
+	buf.WriteString("Auto-Submitted: auto-replied\r\n")
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	qp := quotedprintable.NewWriter(&buf)
+	body := strings.ReplaceAll(text.String(), "\r\n", "\n")
+	qp.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n")))
+	qp.Close()
+	buf.WriteString("\r\n")
+	return buf.Bytes(), nil
+}
+
+// replyAddress returns where automatic replies go: the envelope sender
+// (the Return-Path, RFC 3834 4), or the From header without one
+func replyAddress(email *models.Email) string {
+	if email.EnvelopeFrom != "" {
+		return email.EnvelopeFrom
+	}
+	return addressOf(email.From)
+}
+
+// addressOf returns the bare address of an address such as
+// "Jane <jane@example.com>", or the value trimmed if it doesn't parse
+func addressOf(value string) string {
+	if addr, err := mail.ParseAddress(value); err == nil {
+		return addr.Address
+	}
+	return strings.TrimSpace(value)
+}
+
+// originalHeader parses the header section the email was received with,
+// empty for emails stored without one
+func originalHeader(email *models.Email) mail.Header {
+	if email.RawHeaderBlock == "" {
+		return mail.Header{}
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(email.RawHeaderBlock + "\r\n\r\n"))
+	if err != nil {
+		return mail.Header{}
+	}
+	return msg.Header
+}
@@ -0,0 +1,116 @@
+package smtp
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// ReplayFiles connects to the SMTP server at addr and sends each message file
+// unchanged. A directory path is expanded to the .eml files it contains. The
+// envelope sender and recipients default to the message's From and
+// To/Cc/Bcc headers when from or to are empty. It returns the number of
+// messages sent.
+func ReplayFiles(addr string, path string, from string, to []string) (int, error) {
+	files, err := MessageFiles(path)
+	if err != nil {
+		return 0, err
+	}
+	if len(files) == 0 {
+		return 0, fmt.Errorf("no .eml files found in %s", path)
+	}
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		return 0, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	defer c.Close()
+
+	sent := 0
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return sent, fmt.Errorf("failed to read %s: %w", file, err)
+		}
+
+		envelopeFrom, recipients := from, to
+		if envelopeFrom == "" || len(recipients) == 0 {
+			headerFrom, headerTo := headerEnvelope(data)
+			if envelopeFrom == "" {
+				envelopeFrom = headerFrom
+			}
+			if len(recipients) == 0 {
+				recipients = headerTo
+			}
+		}
+		if len(recipients) == 0 {
+			return sent, fmt.Errorf("no recipients for %s: set -to or add a To header", file)
+		}
+
+		if err := c.SendMail(envelopeFrom, recipients, bytes.NewReader(data)); err != nil {
+			return sent, fmt.Errorf("failed to send %s: %w", file, err)
+		}
+		sent++
+	}
+
+	return sent, c.Quit()
+}
+
+// headerEnvelope returns the sender and recipient addresses named in a raw
+// message's From and To/Cc/Bcc headers
+func headerEnvelope(data []byte) (string, []string) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return "", nil
+	}
+
+	var from string
+	if addr, err := mail.ParseAddress(msg.Header.Get("From")); err == nil {
+		from = addr.Address
+	}
+
+	var to []string
+	for _, key := range []string{"To", "Cc", "Bcc"} {
+		addrs, err := msg.Header.AddressList(key)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			to = append(to, addr.Address)
+		}
+	}
+
+	return from, to
+}
+
+// MessageFiles returns path itself, or the sorted .eml files in it if path is
+// a directory
+func MessageFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.EqualFold(filepath.Ext(entry.Name()), ".eml") {
+			continue
+		}
+		files = append(files, filepath.Join(path, entry.Name()))
+	}
+
+	return files, nil
+}
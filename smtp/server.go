@@ -1,7 +1,12 @@
 package smtp
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -10,37 +15,184 @@ import (
 	"mime"
 	"mime/multipart"
 	"mime/quotedprintable"
+	"net"
 	"net/mail"
+	"net/textproto"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
+	"unicode/utf8"
 
+	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
 )
 
+// defaultMaxMessageBytes is the raw message size limit when none is configured
+const defaultMaxMessageBytes = 10 * 1024 * 1024 // 10MB
+
+// serverDomain is the name the server announces and stamps into Received headers
+const serverDomain = "localhost"
+
+// readTimeout bounds the wait for each command line from a client
+const readTimeout = 10 * time.Second
+
+// MaxRecipients is the hard limit of RCPT commands per message; further
+// recipients are rejected with 452
+const MaxRecipients = 50
+
+// defaultMaxLineLength is the line length limit when none is configured,
+// matching go-smtp's own default for command lines
+const defaultMaxLineLength = 2000
+
+// ParseOptions configures how raw messages are turned into emails
+type ParseOptions struct {
+	KeepEncoded bool   // Retain each leaf part's undecoded body in the MIME tree
+	MaxRawBytes int    // Largest message whose received bytes are kept as Raw for IMAP (0 = unlimited)
+	DefaultFrom string // Sender used when neither envelope nor headers name one ("" = leave empty)
+	DefaultTo   string // Recipient used when neither envelope nor headers name one ("" = leave empty)
+
+	AttachmentTextBytes int // Decoded text kept per text-like attachment for search (0 = none)
+	MaxAttachmentSize   int // Decoded size above which an attachment keeps only its metadata (0 = unlimited)
+	MaxAttachments      int // Attachments per email whose content is kept; later ones keep only metadata (0 = unlimited)
+
+	// AllowTimeOverride lets an RFC3339 X-Mailer-Received-At header replace
+	// the wall clock as the email's receive time
+	AllowTimeOverride bool
+
+	// Clock supplies receive times (nil = storage.SystemClock)
+	Clock storage.Clock
+}
+
+// now returns the current time of the configured clock
+func (o ParseOptions) now() time.Time {
+	if o.Clock == nil {
+		return storage.SystemClock.Now()
+	}
+	return o.Clock.Now()
+}
+
+// Options configures how captured messages are parsed and validated
+type Options struct {
+	Parse ParseOptions
+
+	MaxSubjectLen   int  // Maximum subject length in characters (0 = unlimited)
+	MaxBodyBytes    int  // Maximum plain text or HTML body size in bytes (0 = unlimited)
+	RejectOversize  bool // Reject oversize messages with 552 instead of truncating them
+	MaxMessageBytes int  // Maximum raw message size in bytes (0 = defaultMaxMessageBytes)
+	MaxLineLength   int  // Maximum command or message line length in bytes (0 = defaultMaxLineLength)
+	ParseWorkers    int  // Maximum messages parsed concurrently; others wait for a slot (0 = unlimited)
+	AddReceived     bool // Prepend a Received header documenting the SMTP hop to each message
+	WarnRecipients  int  // Recipient count above which messages are accepted but tagged HighRecipientCount (0 = off)
+
+	// MaxMessagesPerConn is the number of messages accepted per connection
+	// before DATA is answered with 421 and the connection closed (0 = unlimited)
+	MaxMessagesPerConn int
+
+	// ReadRate throttles reading message content to this many bytes per
+	// second to simulate a slow server (0 = unthrottled)
+	ReadRate int
+
+	// CaptureTranscript stores each message's SMTP dialog, minus its
+	// content, as the email's Transcript
+	CaptureTranscript bool
+
+	// DisableVRFY answers VRFY and EXPN with 502. ValidRecipients answers
+	// them with 250 for the listed addresses (case-insensitive) and 550 for
+	// any other. With neither, go-smtp's replies stand: 252 to VRFY and 502
+	// to EXPN.
+	DisableVRFY     bool
+	ValidRecipients []string
+
+	// Messages whose sender or subject contains any of these substrings
+	// (case-insensitive) are accepted but not stored
+	IgnoreFrom    []string
+	IgnoreSubject []string
+
+	// Keys are the API keys clients may authenticate with as their AUTH
+	// username to store messages in that key's partition
+	Keys []string
+
+	// AcceptMessage renders the 250 reply text sent after a message is
+	// stored, with the stored *models.Email as data (nil = library default)
+	AcceptMessage *template.Template
+}
+
 // Backend implements SMTP server backend
 type Backend struct {
-	store *storage.Store
+	store       *storage.Store
+	connections *storage.ConnectionRegistry
+	opts        Options
+	parseSlots  chan struct{} // Semaphore bounding concurrent parses, nil if unbounded
+	receivedIDs atomic.Uint64 // Last id stamped into a Received header
+
+	mu       sync.Mutex
+	draining bool           // Set on shutdown; new DATA commands are refused
+	inflight sync.WaitGroup // DATA commands being received or stored
 }
 
 // NewBackend creates a new SMTP backend
-func NewBackend(store *storage.Store) *Backend {
-	return &Backend{store: store}
+func NewBackend(store *storage.Store, connections *storage.ConnectionRegistry, opts Options) *Backend {
+	b := &Backend{store: store, connections: connections, opts: opts}
+	if opts.ParseWorkers > 0 {
+		b.parseSlots = make(chan struct{}, opts.ParseWorkers)
+	}
+	return b
 }
 
 // NewSession creates a new SMTP session
-func (b *Backend) NewSession(_ *smtp.Conn) (smtp.Session, error) {
-	return &Session{store: b.store}, nil
+func (b *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	remoteAddr := c.Conn().RemoteAddr().String()
+	connID := b.connections.Add("smtp", remoteAddr)
+	log.Printf("SMTP connection opened from %s", remoteAddr)
+
+	session := &Session{
+		backend:    b,
+		conn:       c,
+		connID:     connID,
+		remoteAddr: remoteAddr,
+	}
+	if tc, ok := c.Conn().(*transcriptConn); ok {
+		session.transcript = tc.transcript
+	}
+	return session, nil
 }
 
 // Session represents an SMTP session
 type Session struct {
-	store *storage.Store
-	from  string
-	to    []string
+	backend    *Backend
+	conn       *smtp.Conn
+	connID     int
+	transcript *transcript // Set with CaptureTranscript
+	remoteAddr string
+	key        string
+	from       string
+	to         []string
+	accepted   int  // Messages accepted on this connection; RSET doesn't reset it
+	closing    bool // A 421 was returned, close the connection once it is sent
+}
+
+// AuthMechanisms returns the supported SASL mechanisms
+func (s *Session) AuthMechanisms() []string {
+	return []string{sasl.Plain}
 }
 
-// AuthPlain handles PLAIN authentication (accept all)
+// Auth returns the SASL server for a mechanism
+func (s *Session) Auth(mech string) (sasl.Server, error) {
+	return sasl.NewPlainServer(func(identity, username, password string) error {
+		return s.AuthPlain(username, password)
+	}), nil
+}
+
+// AuthPlain handles PLAIN authentication (accept all). A username matching
+// a configured API key selects that key's partition.
 func (s *Session) AuthPlain(username, password string) error {
+	if slices.Contains(s.backend.opts.Keys, username) {
+		s.key = username
+	}
 	return nil
 }
 
@@ -58,11 +210,198 @@ func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 
 // Data receives the email data
 func (s *Session) Data(r io.Reader) error {
-	// Parse the email
-	msg, err := mail.ReadMessage(r)
+	if max := s.backend.opts.MaxMessagesPerConn; max > 0 && s.accepted >= max {
+		log.Printf("Rejecting message from %s: connection already sent %d message(s)", s.remoteAddr, s.accepted)
+		s.closing = true
+		return &smtp.SMTPError{
+			Code:         421,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+			Message:      fmt.Sprintf("Too many messages on this connection (maximum %d), reconnect to send more", max),
+		}
+	}
+
+	if !s.backend.startData() {
+		return &smtp.SMTPError{
+			Code:         421,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+			Message:      "Service shutting down",
+		}
+	}
+	defer s.backend.inflight.Done()
+
+	// Parse the email, waiting for a free slot when parsing is bounded
+	if slots := s.backend.parseSlots; slots != nil {
+		slots <- struct{}{}
+		defer func() { <-slots }()
+	}
+	// Simulate a slow server by ingesting the message at a fixed rate
+	if rate := s.backend.opts.ReadRate; rate > 0 {
+		r = &throttledReader{r: r, conn: s.conn.Conn(), rate: rate}
+	}
+	// Never read past the size limit, even where parsing buffers parts
+	limited := &sizeLimitReader{r: r, remaining: int64(s.backend.maxMessageBytes())}
+	// Nor buffer a single line past the line limit, which go-smtp only
+	// enforces for DATA and not for BDAT chunks
+	lines := &lineLengthReader{r: limited, max: s.backend.maxLineLength()}
+	var msg io.Reader = lines
+	if s.backend.opts.AddReceived {
+		msg = io.MultiReader(strings.NewReader(s.receivedHeader()), lines)
+	}
+	// Copy the recipients so the stored email never shares the session's
+	// slice, which is reused for the next message on the connection
+	email, err := ParseMessage(msg, s.from, slices.Clone(s.to), s.backend.opts.Parse)
+
+	// Take the dialog now, so a message rejected or ignored below doesn't
+	// leave it to the next one on the connection
+	var transcript string
+	if s.transcript != nil {
+		transcript = s.transcript.take()
+	}
+	if lines.exceeded {
+		log.Printf("Rejecting message from %s: line exceeds %d bytes", s.from, s.backend.maxLineLength())
+		return &smtp.SMTPError{
+			Code:         500,
+			EnhancedCode: smtp.EnhancedCode{5, 5, 2},
+			Message:      fmt.Sprintf("Line too long, maximum is %d bytes", s.backend.maxLineLength()),
+		}
+	}
+	if limited.exceeded {
+		log.Printf("Rejecting message from %s: exceeds %d bytes", s.from, s.backend.maxMessageBytes())
+		return &smtp.SMTPError{
+			Code:         552,
+			EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+			Message:      fmt.Sprintf("Message exceeds maximum size of %d bytes", s.backend.maxMessageBytes()),
+		}
+	}
 	if err != nil {
 		log.Printf("Error reading message: %v", err)
-		return err
+		// Keep the library's own replies, e.g. for an aborted BDAT transfer
+		var smtpErr *smtp.SMTPError
+		if errors.As(err, &smtpErr) {
+			return smtpErr
+		}
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      fmt.Sprintf("Malformed message: %v", err),
+		}
+	}
+
+	// Accept but drop messages matching the capture filter
+	opts := s.backend.opts
+	if containsAny(email.From, opts.IgnoreFrom) || containsAny(email.EnvelopeFrom, opts.IgnoreFrom) ||
+		containsAny(email.Subject, opts.IgnoreSubject) {
+		log.Printf("Ignoring message from %s (Subject: %s): matches capture filter", email.From, email.Subject)
+		s.accepted++
+		return nil
+	}
+
+	// Enforce subject and body length limits
+	if opts.MaxSubjectLen > 0 && utf8.RuneCountInString(email.Subject) > opts.MaxSubjectLen {
+		if opts.RejectOversize {
+			log.Printf("Rejecting message from %s: subject exceeds %d characters", email.From, opts.MaxSubjectLen)
+			return &smtp.SMTPError{
+				Code:         552,
+				EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+				Message:      fmt.Sprintf("Subject exceeds maximum length of %d characters", opts.MaxSubjectLen),
+			}
+		}
+		email.Subject = string([]rune(email.Subject)[:opts.MaxSubjectLen])
+	}
+	if opts.MaxBodyBytes > 0 && (len(email.Body) > opts.MaxBodyBytes || len(email.HTMLBody) > opts.MaxBodyBytes) {
+		if opts.RejectOversize {
+			log.Printf("Rejecting message from %s: body exceeds %d bytes", email.From, opts.MaxBodyBytes)
+			return &smtp.SMTPError{
+				Code:         552,
+				EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+				Message:      fmt.Sprintf("Body exceeds maximum size of %d bytes", opts.MaxBodyBytes),
+			}
+		}
+		email.Body = truncateBytes(email.Body, opts.MaxBodyBytes)
+		email.HTMLBody = truncateBytes(email.HTMLBody, opts.MaxBodyBytes)
+	}
+
+	email.Transcript = transcript
+
+	// Tag, but still accept, messages fanning out to many recipients
+	if opts.WarnRecipients > 0 && len(s.to) > opts.WarnRecipients {
+		log.Printf("Message from %s has %d recipients, above the warning threshold of %d", s.from, len(s.to), opts.WarnRecipients)
+		email.HighRecipientCount = true
+	}
+
+	// Save to store
+	email.Key = s.key
+	id := s.backend.store.Save(email)
+	log.Printf("Email received and stored with ID: %d (From: %s, Subject: %s)", id, email.From, email.Subject)
+	s.accepted++
+
+	if opts.AcceptMessage != nil {
+		var msg strings.Builder
+		if err := opts.AcceptMessage.Execute(&msg, email); err != nil {
+			log.Printf("Error rendering accept message: %v", err)
+			return nil
+		}
+		// A 250 SMTPError replaces the library's default acceptance reply
+		return &smtp.SMTPError{
+			Code:         250,
+			EnhancedCode: smtp.EnhancedCode{2, 0, 0},
+			Message:      msg.String(),
+		}
+	}
+
+	return nil
+}
+
+// receivedHeader builds the Received header (RFC 5321 4.4) recording the
+// hop from the client to this server, e.g.
+// "Received: from client.example (192.0.2.1) by localhost with SMTP id 0000002A for <to@x>; <date>"
+func (s *Session) receivedHeader() string {
+	ip := s.remoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	helo := s.conn.Hostname()
+	if helo == "" {
+		helo = "unknown"
+	}
+	id := s.backend.receivedIDs.Add(1)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Received: from %s (%s)\r\n\tby %s with SMTP id %08X", helo, ip, serverDomain, id)
+	// Like real MTAs, only name the recipient when there is exactly one
+	if len(s.to) == 1 {
+		fmt.Fprintf(&b, "\r\n\tfor <%s>", s.to[0])
+	}
+	fmt.Fprintf(&b, "; %s\r\n", s.backend.opts.Parse.now().Format(time.RFC1123Z))
+	return b.String()
+}
+
+// ParseMessage parses a raw message into an email. The envelope sender is
+// used when the message has no From header, and the To header is used when
+// no envelope recipients are given (e.g. for IMAP APPEND).
+func ParseMessage(r io.Reader, envelopeFrom string, recipients []string, opts ParseOptions) (*models.Email, error) {
+	// Keep the message as received for IMAP
+	var raw bytes.Buffer
+	br := bufio.NewReader(io.TeeReader(r, &raw))
+	headerBlock, err := readHeaderBlock(br)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := mail.ReadMessage(io.MultiReader(strings.NewReader(headerBlock), br))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(recipients) == 0 {
+		if addrs, err := msg.Header.AddressList("To"); err == nil {
+			for _, addr := range addrs {
+				recipients = append(recipients, addr.Address)
+			}
+		}
+	}
+	for i, to := range recipients {
+		recipients[i] = models.NormalizeAddress(to)
 	}
 
 	// Extract headers
@@ -70,68 +409,281 @@ func (s *Session) Data(r io.Reader) error {
 	date := msg.Header.Get("Date")
 	from := msg.Header.Get("From")
 	if from == "" {
-		from = s.from
+		from = envelopeFrom
 	}
 
 	// Parse date
-	parsedDate := time.Now()
+	now := opts.now()
+	parsedDate := now
 	if date != "" {
 		if t, err := mail.ParseDate(date); err == nil {
 			parsedDate = t
 		}
 	}
 
-	// Extract body
-	body, htmlBody := extractBody(msg)
+	// Extract body, then read what parsing skipped, such as a multipart
+	// epilogue, so the raw copy is complete
+	body, htmlBody, calendar, structure := extractBody(msg, opts)
+	if _, err := io.Copy(io.Discard, msg.Body); err != nil {
+		return nil, err
+	}
 
 	// Store raw headers
 	rawHeaders := formatHeaders(msg.Header)
 
 	// Create email object
 	email := &models.Email{
-		From:       from,
-		To:         s.to,
-		Subject:    subject,
-		Body:       body,
-		HTMLBody:   htmlBody,
-		Date:       parsedDate,
-		RawHeaders: rawHeaders,
-		ReceivedAt: time.Now(),
+		From:           from,
+		EnvelopeFrom:   envelopeFrom,
+		To:             recipients,
+		Subject:        subject,
+		MessageID:      strings.TrimSpace(msg.Header.Get("Message-Id")),
+		Body:           body,
+		HTMLBody:       htmlBody,
+		Calendar:       calendar,
+		Date:           parsedDate,
+		RawHeaders:     rawHeaders,
+		RawHeaderBlock: strings.TrimRight(headerBlock, "\r\n"),
+		ReceivedAt:     now,
+		Structure:      structure,
+		Raw:            raw.Bytes(),
+
+		ContentTypeMissing: strings.TrimSpace(msg.Header.Get("Content-Type")) == "",
+
+		ListUnsubscribe:     parseListUnsubscribe(msg.Header.Get("List-Unsubscribe")),
+		ListUnsubscribePost: strings.TrimSpace(msg.Header.Get("List-Unsubscribe-Post")),
+		ListID:              strings.TrimSpace(msg.Header.Get("List-Id")),
+		CustomHeaders:       customHeaders(msg.Header),
 	}
 
-	// Save to store
-	id := s.store.Save(email)
-	log.Printf("Email received and stored with ID: %d (From: %s, Subject: %s)", id, from, subject)
+	// The raw copy roughly doubles an email's memory; past the limit IMAP
+	// serves the message rebuilt from its bodies instead
+	if opts.MaxRawBytes > 0 && raw.Len() > opts.MaxRawBytes {
+		email.Raw = nil
+	}
 
-	return nil
+	email.Signed, email.Encrypted, email.Crypto = detectCrypto(structure)
+	email.AttachmentsTruncated = hasTruncatedPart(structure)
+
+	// Synthesize placeholders for missing sender and recipients
+	if email.From == "" && opts.DefaultFrom != "" {
+		email.From = opts.DefaultFrom
+		email.FromSynthesized = true
+	}
+	if len(email.To) == 0 && opts.DefaultTo != "" {
+		email.To = []string{opts.DefaultTo}
+		email.ToSynthesized = true
+	}
+
+	// Apply the receive time override before the TTL is based on it
+	if receivedAt := msg.Header.Get("X-Mailer-Received-At"); receivedAt != "" && opts.AllowTimeOverride {
+		if t, err := time.Parse(time.RFC3339, strings.TrimSpace(receivedAt)); err == nil {
+			email.ReceivedAt = t
+		} else {
+			log.Printf("Ignoring invalid X-Mailer-Received-At header %q: %v", receivedAt, err)
+		}
+	}
+
+	// Apply per-email retention override
+	if ttlHeader := msg.Header.Get("X-Mailer-TTL"); ttlHeader != "" {
+		if ttl, err := parseTTL(ttlHeader); err == nil {
+			expiresAt := email.ReceivedAt.Add(ttl)
+			email.ExpiresAt = &expiresAt
+		} else {
+			log.Printf("Ignoring invalid X-Mailer-TTL header %q: %v", ttlHeader, err)
+		}
+	}
+
+	return email, nil
+}
+
+// containsAny reports whether s contains any of the substrings, ignoring case
+func containsAny(s string, substrings []string) bool {
+	s = strings.ToLower(s)
+	for _, substring := range substrings {
+		if strings.Contains(s, strings.ToLower(substring)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseListUnsubscribe extracts the angle-bracketed URIs of a
+// List-Unsubscribe header (RFC 2369), e.g. "<mailto:u@x>, <https://x/u>"
+func parseListUnsubscribe(value string) []string {
+	var uris []string
+	for {
+		start := strings.Index(value, "<")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(value[start:], ">")
+		if end < 0 {
+			break
+		}
+		if uri := strings.TrimSpace(value[start+1 : start+end]); uri != "" {
+			uris = append(uris, uri)
+		}
+		value = value[start+end+1:]
+	}
+	return uris
+}
+
+// customHeaders collects the trimmed values of all X- headers, keeping
+// repeated headers as multiple values
+func customHeaders(header mail.Header) map[string][]string {
+	var custom map[string][]string
+	for name, values := range header {
+		if !strings.HasPrefix(name, "X-") {
+			continue
+		}
+		if custom == nil {
+			custom = make(map[string][]string)
+		}
+		for _, value := range values {
+			custom[name] = append(custom[name], strings.TrimSpace(value))
+		}
+	}
+	return custom
+}
+
+// readHeaderBlock returns the header section exactly as received, including
+// the blank line that ends it (if any)
+func readHeaderBlock(br *bufio.Reader) (string, error) {
+	var block strings.Builder
+	for {
+		line, err := br.ReadString('\n')
+		block.WriteString(line)
+		if err == io.EOF {
+			return block.String(), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if line == "\n" || line == "\r\n" {
+			return block.String(), nil
+		}
+	}
+}
+
+// parseTTL parses a TTL given as a Go duration (e.g. "300s") or plain seconds
+func parseTTL(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if seconds, err := strconv.Atoi(value); err == nil {
+		value = strconv.Itoa(seconds) + "s"
+	}
+
+	ttl, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if ttl <= 0 {
+		return 0, fmt.Errorf("TTL must be positive")
+	}
+	return ttl, nil
 }
 
-// Reset resets the session state
+// Reset clears the transaction state. go-smtp calls it on RSET, on a new
+// EHLO and after every DATA, so messages sent over one connection never share
+// senders or recipients. The authenticated partition is kept, as AUTH applies
+// to the whole connection.
 func (s *Session) Reset() {
 	s.from = ""
 	s.to = nil
+
+	// go-smtp resets the session after replying to DATA, so the 421 has
+	// been sent by now. Closing the socket ends the session like QUIT.
+	if s.closing {
+		s.conn.Conn().Close()
+	}
 }
 
 // Logout ends the session
 func (s *Session) Logout() error {
+	s.backend.connections.Remove(s.connID)
+	log.Printf("SMTP connection closed from %s", s.remoteAddr)
 	return nil
 }
 
-// extractBody extracts plain text and HTML body from message
-func extractBody(msg *mail.Message) (string, string) {
-	contentType := msg.Header.Get("Content-Type")
+// extractBody extracts the plain text and HTML bodies and the first
+// iCalendar part from message along with its MIME tree
+func extractBody(msg *mail.Message, opts ParseOptions) (string, string, string, *models.MIMEPart) {
+	w := &partWalker{opts: opts}
+	structure := w.walk(textproto.MIMEHeader(msg.Header), msg.Body, true)
+	return w.plain, w.html, w.calendar, structure
+}
+
+// partWalker walks a MIME tree, collecting the text bodies found along the way
+type partWalker struct {
+	opts        ParseOptions
+	plain       string
+	html        string
+	calendar    string
+	attachments int // Attachments seen so far
+}
+
+// attachmentLimitNote explains why the content of the current attachment
+// of size bytes isn't kept, or returns "" if it is within the limits
+func (w *partWalker) attachmentLimitNote(size int) string {
+	if max := w.opts.MaxAttachments; max > 0 && w.attachments > max {
+		return fmt.Sprintf("Attachment %d exceeds the limit of %d attachments per email, content not kept", w.attachments, max)
+	}
+	if max := w.opts.MaxAttachmentSize; max > 0 && size > max {
+		return fmt.Sprintf("Attachment exceeds the size limit of %d bytes, content not kept", max)
+	}
+	return ""
+}
+
+// walk parses a MIME entity, recording its structure and capturing text bodies
+func (w *partWalker) walk(header textproto.MIMEHeader, r io.Reader, root bool) *models.MIMEPart {
+	contentType := strings.TrimSpace(header.Get("Content-Type"))
 	mediaType, params, err := mime.ParseMediaType(contentType)
-	if err != nil {
-		// Simple text body
-		body, _ := io.ReadAll(msg.Body)
-		decoded := decodeBody(body, msg.Header.Get("Content-Transfer-Encoding"))
-		return decoded, ""
+	if contentType == "" {
+		// RFC 2045 5.2: an entity without a Content-Type is US-ASCII text
+		mediaType = "text/plain"
+		params = map[string]string{"charset": "us-ascii"}
+	} else if err != nil {
+		// Malformed Content-Type - treat as simple text body
+		log.Printf("Malformed Content-Type %q, reading the entity as text/plain: %v", contentType, err)
+		mediaType = "text/plain"
+		params = nil
+	}
+
+	part := &models.MIMEPart{
+		ContentType: mediaType,
+		Params:      params,
+		Encoding:    strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))),
+	}
+	if disposition, dispParams, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		part.Disposition = disposition
+		part.Filename = dispParams["filename"]
+	}
+	if part.Filename == "" {
+		part.Filename = params["name"]
+	}
+	gzipped := strings.EqualFold(strings.TrimSpace(header.Get("Content-Encoding")), "gzip")
+	if gzipped {
+		part.ContentEncoding = "gzip"
 	}
 
-	var plainText, htmlText string
+	// Without a boundary the parts can't be told apart, so the entity is
+	// read as a single text part rather than yielding an empty body
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] == "" {
+		log.Printf("Multipart entity %s has no boundary parameter, reading it as a single part", mediaType)
+		mediaType = "text/plain"
+	}
 
 	if strings.HasPrefix(mediaType, "multipart/") {
-		mr := multipart.NewReader(msg.Body, params["boundary"])
+		// A gzipped multipart entity must be inflated before its parts can be read
+		if gzipped {
+			if data, err := inflate(r); err == nil {
+				r = bytes.NewReader(data)
+			} else {
+				log.Printf("Error inflating gzip body: %v", err)
+			}
+		}
+
+		mr := multipart.NewReader(r, params["boundary"])
 		for {
 			p, err := mr.NextPart()
 			if err == io.EOF {
@@ -142,35 +694,178 @@ func extractBody(msg *mail.Message) (string, string) {
 				break
 			}
 
-			partType := p.Header.Get("Content-Type")
-			partMedia, _, _ := mime.ParseMediaType(partType)
-			encoding := p.Header.Get("Content-Transfer-Encoding")
+			child := w.walk(p.Header, p, false)
+			part.Size += child.Size
+			part.Parts = append(part.Parts, child)
+		}
+		return part
+	}
 
-			body, _ := io.ReadAll(p)
-			bodyStr := decodeBody(body, encoding)
+	body, _ := io.ReadAll(r)
+	bodyStr, note := decodeBody(body, part.Encoding)
+	part.EncodingNote = note
+	if gzipped {
+		if data, err := inflate(strings.NewReader(bodyStr)); err == nil {
+			bodyStr = string(data)
+		} else {
+			log.Printf("Error inflating gzip body: %v", err)
+		}
+	}
+	part.Size = len(bodyStr)
 
-			if strings.HasPrefix(partMedia, "text/plain") {
-				plainText = bodyStr
-			} else if strings.HasPrefix(partMedia, "text/html") {
-				htmlText = bodyStr
-			}
+	// Attachments past the limits keep only their metadata
+	attachment := part.Disposition == "attachment" && !root
+	if attachment {
+		w.attachments++
+		part.LimitNote = w.attachmentLimitNote(part.Size)
+		part.Truncated = part.LimitNote != ""
+	}
+
+	if w.opts.KeepEncoded {
+		part.Charset = params["charset"]
+		if !part.Truncated {
+			part.EncodedBody = body
 		}
-	} else if strings.HasPrefix(mediaType, "text/plain") {
-		body, _ := io.ReadAll(msg.Body)
-		plainText = decodeBody(body, msg.Header.Get("Content-Transfer-Encoding"))
-	} else if strings.HasPrefix(mediaType, "text/html") {
-		body, _ := io.ReadAll(msg.Body)
-		htmlText = decodeBody(body, msg.Header.Get("Content-Transfer-Encoding"))
-	} else {
-		body, _ := io.ReadAll(msg.Body)
-		plainText = decodeBody(body, msg.Header.Get("Content-Transfer-Encoding"))
 	}
 
-	return plainText, htmlText
+	// Invites often carry the same event inline and as an .ics attachment,
+	// either of which is captured
+	if mediaType == "text/calendar" && w.calendar == "" && !part.Truncated {
+		w.calendar = bodyStr
+	}
+
+	// Attachments are kept out of the bodies; text-like ones keep their
+	// content in the tree so they can be searched
+	if attachment {
+		if isTextLike(mediaType) && w.opts.AttachmentTextBytes > 0 && !part.Truncated {
+			part.Text = truncateBytes(bodyStr, w.opts.AttachmentTextBytes)
+		}
+		return part
+	}
+
+	// An opaque S/MIME message is binary CMS data, not a text body
+	if isPKCS7MIME(mediaType) {
+		return part
+	}
+
+	if strings.HasPrefix(mediaType, "text/html") {
+		w.html = bodyStr
+	} else if strings.HasPrefix(mediaType, "text/plain") || root {
+		w.plain = bodyStr
+	}
+
+	return part
+}
+
+// isPKCS7MIME reports whether mediaType is an S/MIME signed or enveloped
+// message (RFC 8551)
+func isPKCS7MIME(mediaType string) bool {
+	return mediaType == "application/pkcs7-mime" || mediaType == "application/x-pkcs7-mime"
+}
+
+// detectCrypto reports whether the MIME tree contains signed or encrypted
+// parts, describing the first one found. multipart/signed keeps its content
+// as the first child, so the bodies are extracted from it as usual; the
+// signature part is left in the structure.
+func detectCrypto(part *models.MIMEPart) (bool, bool, *models.CryptoInfo) {
+	if part == nil {
+		return false, false, nil
+	}
+
+	var signed, encrypted bool
+	var info *models.CryptoInfo
+	switch {
+	case part.ContentType == "multipart/signed":
+		signed = true
+		info = &models.CryptoInfo{Protocol: part.Params["protocol"], Micalg: part.Params["micalg"]}
+	case part.ContentType == "multipart/encrypted":
+		encrypted = true
+		info = &models.CryptoInfo{Protocol: part.Params["protocol"]}
+	case isPKCS7MIME(part.ContentType):
+		// signed-data wraps readable content, the enveloped types don't
+		smimeType := strings.ToLower(part.Params["smime-type"])
+		if smimeType == "signed-data" {
+			signed = true
+		} else {
+			encrypted = true
+		}
+		info = &models.CryptoInfo{Format: "smime", SMIMEType: smimeType}
+	}
+	if info != nil && info.Format == "" {
+		info.Format = "smime"
+		if strings.Contains(strings.ToLower(info.Protocol), "pgp") {
+			info.Format = "pgp"
+		}
+	}
+
+	for _, child := range part.Parts {
+		childSigned, childEncrypted, childInfo := detectCrypto(child)
+		signed = signed || childSigned
+		encrypted = encrypted || childEncrypted
+		if info == nil {
+			info = childInfo
+		}
+	}
+	return signed, encrypted, info
+}
+
+// hasTruncatedPart reports whether any part of the MIME tree was truncated
+// by the attachment limits
+func hasTruncatedPart(part *models.MIMEPart) bool {
+	if part == nil {
+		return false
+	}
+	return part.Truncated || slices.ContainsFunc(part.Parts, hasTruncatedPart)
+}
+
+// isTextLike reports whether an attachment's content is readable text
+func isTextLike(mediaType string) bool {
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case mediaType == "application/json", mediaType == "application/csv", mediaType == "application/xml":
+		return true
+	}
+	return false
+}
+
+// maxInflatedBytes caps how far a gzip Content-Encoding body may expand,
+// guarding against decompression bombs
+const maxInflatedBytes = 10 * 1024 * 1024
+
+// inflate decompresses a gzip body, refusing output beyond maxInflatedBytes
+func inflate(r io.Reader) ([]byte, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	data, err := io.ReadAll(io.LimitReader(zr, maxInflatedBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxInflatedBytes {
+		return nil, fmt.Errorf("inflated body exceeds %d bytes", maxInflatedBytes)
+	}
+	return data, nil
+}
+
+// truncateBytes shortens s to at most n bytes without splitting a UTF-8 sequence
+func truncateBytes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
 }
 
-// decodeBody decodes the body based on Content-Transfer-Encoding
-func decodeBody(body []byte, encoding string) string {
+// decodeBody decodes the body based on Content-Transfer-Encoding. The note
+// describes a problem with the encoding worth showing on the part, such as
+// 8-bit bytes in a part declared 7bit ("" = none).
+func decodeBody(body []byte, encoding string) (string, string) {
 	encoding = strings.ToLower(strings.TrimSpace(encoding))
 
 	switch encoding {
@@ -179,21 +874,31 @@ func decodeBody(body []byte, encoding string) string {
 		decoded, err := io.ReadAll(r)
 		if err != nil {
 			log.Printf("Error decoding quoted-printable: %v", err)
-			return string(body)
+			return string(body), "Invalid quoted-printable, kept as received"
 		}
-		return string(decoded)
+		return string(decoded), ""
 
 	case "base64":
 		decoded, err := base64.StdEncoding.DecodeString(string(body))
 		if err != nil {
 			log.Printf("Error decoding base64: %v", err)
-			return string(body)
+			return string(body), "Invalid base64, kept as received"
+		}
+		return string(decoded), ""
+
+	case "7bit":
+		// A common sender bug is declaring 7bit for UTF-8 or Latin-1 text
+		if i := slices.IndexFunc(body, func(b byte) bool { return b >= 0x80 }); i >= 0 {
+			return string(body), fmt.Sprintf("Declared 7bit but contains 8-bit bytes (first at offset %d)", i)
 		}
-		return string(decoded)
+		return string(body), ""
+
+	case "", "8bit", "binary":
+		// No transformation was applied, the bytes are the content
+		return string(body), ""
 
 	default:
-		// No encoding or 7bit/8bit - return as-is
-		return string(body)
+		return string(body), fmt.Sprintf("Unknown Content-Transfer-Encoding %q, kept as received", encoding)
 	}
 }
 
@@ -208,27 +913,243 @@ func formatHeaders(header mail.Header) string {
 	return sb.String()
 }
 
-// StartServer starts the SMTP server
-func StartServer(store *storage.Store, addr string) error {
-	be := NewBackend(store)
+// maxMessageBytes returns the raw message size limit
+func (b *Backend) maxMessageBytes() int {
+	if b.opts.MaxMessageBytes > 0 {
+		return b.opts.MaxMessageBytes
+	}
+	return defaultMaxMessageBytes
+}
+
+// maxLineLength returns the command and message line length limit
+func (b *Backend) maxLineLength() int {
+	if b.opts.MaxLineLength > 0 {
+		return b.opts.MaxLineLength
+	}
+	return defaultMaxLineLength
+}
+
+// errMessageTooLarge is returned by sizeLimitReader once the limit is passed
+var errMessageTooLarge = errors.New("message exceeds maximum size")
+
+// sizeLimitReader reads at most remaining bytes from r and fails, rather than
+// reporting EOF like io.LimitReader, when the input continues past them
+type sizeLimitReader struct {
+	r         io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+// Read reads from the underlying reader up to the limit
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		// Probe a single byte to tell an exact fit from an oversize message
+		var probe [1]byte
+		n, err := l.r.Read(probe[:])
+		if n > 0 {
+			l.exceeded = true
+			return 0, errMessageTooLarge
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// errLineTooLong is returned by lineLengthReader once a line passes the limit
+var errLineTooLong = errors.New("line too long")
+
+// lineLengthReader fails as soon as a line, not counting its CRLF, grows
+// past max bytes, so unterminated input is never buffered whole. go-smtp's
+// own line limit errors are reported the same way.
+type lineLengthReader struct {
+	r        io.Reader
+	max      int
+	current  int
+	exceeded bool
+}
+
+// Read reads from the underlying reader while tracking the current line length
+func (l *lineLengthReader) Read(p []byte) (int, error) {
+	if l.exceeded {
+		return 0, errLineTooLong
+	}
+
+	n, err := l.r.Read(p)
+	if errors.Is(err, smtp.ErrTooLongLine) {
+		l.exceeded = true
+	}
+	for i, b := range p[:n] {
+		switch b {
+		case '\n':
+			l.current = 0
+		case '\r':
+		default:
+			l.current++
+			if l.current > l.max {
+				l.exceeded = true
+				return i, errLineTooLong
+			}
+		}
+	}
+	return n, err
+}
+
+// throttledReader reads from r at no more than rate bytes per second on
+// average, so the client sees a slow server once socket buffers fill up
+type throttledReader struct {
+	r     io.Reader
+	conn  net.Conn // Its read deadline is extended as the throttled read progresses
+	rate  int
+	start time.Time
+	read  int
+}
+
+// Read reads at most a tenth of a second's worth of bytes and sleeps until
+// the total read so far is due
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if t.start.IsZero() {
+		t.start = time.Now()
+	}
+	if chunk := max(t.rate/10, 1); len(p) > chunk {
+		p = p[:chunk]
+	}
+
+	n, err := t.r.Read(p)
+	t.read += n
+	due := t.start.Add(time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second)))
+	time.Sleep(time.Until(due))
+
+	// go-smtp sets the read deadline per command, so a message taking
+	// longer than that to ingest would otherwise time out the server's
+	// own reads
+	t.conn.SetReadDeadline(time.Now().Add(readTimeout))
+	return n, err
+}
+
+// startData registers an in-flight DATA command, returning false once the
+// backend is draining
+func (b *Backend) startData() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.draining {
+		return false
+	}
+	b.inflight.Add(1)
+	return true
+}
+
+// drain refuses new DATA commands and waits for in-flight ones to finish or
+// ctx to expire
+func (b *Backend) drain(ctx context.Context) error {
+	b.mu.Lock()
+	b.draining = true
+	b.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		b.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Server is a running SMTP server
+type Server struct {
+	server   *smtp.Server
+	backend  *Backend
+	listener net.Listener
+}
+
+// StartServer binds the SMTP server to addr and serves it in the background.
+// Serve errors other than a shutdown are fatal.
+func StartServer(store *storage.Store, connections *storage.ConnectionRegistry, addr string, opts Options) (*Server, error) {
+	be := NewBackend(store, connections, opts)
 	s := smtp.NewServer(be)
 
 	s.Addr = addr
-	s.Domain = "localhost"
-	s.ReadTimeout = 10 * time.Second
+	s.Domain = serverDomain
+	s.ReadTimeout = readTimeout
 	s.WriteTimeout = 10 * time.Second
-	s.MaxMessageBytes = 10 * 1024 * 1024 // 10MB
-	s.MaxRecipients = 50
+	s.MaxMessageBytes = int64(be.maxMessageBytes())
+	// go-smtp counts a line's CR and the LF ending the line before it
+	s.MaxLineLength = be.maxLineLength() + 2
+	s.MaxRecipients = MaxRecipients
 	s.AllowInsecureAuth = true
+	s.EnableSMTPUTF8 = true // 8BITMIME is always advertised
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if v := newVerifier(opts); v != nil {
+		l = &vrfyListener{Listener: l, verifier: v, maxLineLength: be.maxLineLength()}
+	}
+	if opts.CaptureTranscript {
+		l = &transcriptListener{Listener: l}
+	}
 
 	log.Printf("SMTP server starting on %s", addr)
-	return s.ListenAndServe()
+	go func() {
+		// Shutdown closes the listener directly, which ends Serve with net.ErrClosed
+		if err := s.Serve(l); err != nil && err != smtp.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+			log.Fatalf("SMTP server error: %v", err)
+		}
+	}()
+
+	return &Server{server: s, backend: be, listener: l}, nil
 }
 
-// ParseEmailAddress extracts email from address (handles "Name <email>" format)
-func ParseEmailAddress(addr string) string {
-	if parsed, err := mail.ParseAddress(addr); err == nil {
-		return parsed.Address
+// Capabilities returns the ESMTP extensions advertised in reply to EHLO on
+// a plaintext connection, following go-smtp's greeting for the server's
+// configuration
+func (srv *Server) Capabilities() []string {
+	s := srv.server
+	caps := []string{"PIPELINING", "8BITMIME", "ENHANCEDSTATUSCODES", "CHUNKING"}
+	if s.TLSConfig != nil {
+		caps = append(caps, "STARTTLS")
+	}
+	if s.AllowInsecureAuth {
+		caps = append(caps, "AUTH "+strings.Join((&Session{}).AuthMechanisms(), " "))
 	}
-	return addr
+	if s.EnableSMTPUTF8 {
+		caps = append(caps, "SMTPUTF8")
+	}
+	if s.EnableBINARYMIME {
+		caps = append(caps, "BINARYMIME")
+	}
+	if s.EnableDSN {
+		caps = append(caps, "DSN")
+	}
+	if s.MaxMessageBytes > 0 {
+		caps = append(caps, fmt.Sprintf("SIZE %d", s.MaxMessageBytes))
+	} else {
+		caps = append(caps, "SIZE")
+	}
+	if s.MaxRecipients > 0 {
+		caps = append(caps, fmt.Sprintf("LIMITS RCPTMAX=%d", s.MaxRecipients))
+	}
+	return caps
+}
+
+// Shutdown stops accepting connections, waits for messages being received
+// to be stored, then closes the remaining connections. If ctx expires first
+// the connections are closed anyway and ctx's error is returned.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.listener.Close()
+	err := srv.backend.drain(ctx)
+	srv.server.Close()
+	return err
 }
@@ -0,0 +1,1061 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mailer/models"
+	"mailer/storage"
+	"maps"
+	"net/textproto"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// startTestServer runs a server with opts on a free local port and returns
+// its store and address
+func startTestServer(t *testing.T, opts Options) (*storage.Store, string) {
+	t.Helper()
+	store := storage.NewStore()
+	srv, err := StartServer(store, storage.NewConnectionRegistry(), "127.0.0.1:0", opts)
+	if err != nil {
+		t.Fatalf("StartServer: %v", err)
+	}
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+	return store, srv.listener.Addr().String()
+}
+
+// dialTestServer connects to addr and says hello
+func dialTestServer(t *testing.T, addr string) *smtp.Client {
+	t.Helper()
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if err := c.Hello("client.example"); err != nil {
+		t.Fatalf("EHLO: %v", err)
+	}
+	return c
+}
+
+// send sends one message over c and returns the reply to its content
+func send(t *testing.T, c *smtp.Client, from string, to []string, raw string) error {
+	t.Helper()
+	if err := c.Mail(from, nil); err != nil {
+		t.Fatalf("MAIL FROM: %v", err)
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt, nil); err != nil {
+			t.Fatalf("RCPT TO: %v", err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("DATA: %v", err)
+	}
+	io.WriteString(w, raw)
+	return w.Close()
+}
+
+// messageOfSize returns a message of exactly size bytes as sent over DATA
+func messageOfSize(size int) string {
+	header := "From: a@example.com\r\nTo: b@example.com\r\nSubject: Size\r\n\r\n"
+	var body strings.Builder
+	for body.Len() < size-len(header) {
+		line := strings.Repeat("x", min(76, size-len(header)-body.Len()-2))
+		body.WriteString(line + "\r\n")
+	}
+	return header + body.String()
+}
+
+func TestDataSizeLimit(t *testing.T) {
+	const limit = 4096
+	store, addr := startTestServer(t, Options{MaxMessageBytes: limit})
+	c := dialTestServer(t, addr)
+
+	err := send(t, c, "a@example.com", []string{"b@example.com"}, messageOfSize(limit+100))
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 552 {
+		t.Fatalf("sending a message over the limit = %v, want a 552 reply", err)
+	}
+	if n := len(store.GetAll()); n != 0 {
+		t.Fatalf("%d emails stored after rejecting an oversize message", n)
+	}
+
+	// The connection stays usable for messages within the limit
+	if err := send(t, c, "a@example.com", []string{"b@example.com"}, messageOfSize(limit/2)); err != nil {
+		t.Fatalf("sending a message within the limit: %v", err)
+	}
+	if n := len(store.GetAll()); n != 1 {
+		t.Errorf("%d emails stored, want 1", n)
+	}
+}
+
+// countingReader is an endless stream of bytes counting how many were read
+type countingReader struct {
+	read int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	r.read += int64(len(p))
+	return len(p), nil
+}
+
+// TestSizeLimitReaderStopsAtLimit checks an oversize message is cut off as
+// soon as it passes the limit rather than read whole
+func TestSizeLimitReaderStopsAtLimit(t *testing.T) {
+	const limit = 1000
+	src := &countingReader{}
+	limited := &sizeLimitReader{r: src, remaining: limit}
+
+	n, err := io.Copy(io.Discard, limited)
+	if !errors.Is(err, errMessageTooLarge) || !limited.exceeded {
+		t.Fatalf("reading past the limit = %v, want errMessageTooLarge", err)
+	}
+	if n != limit {
+		t.Errorf("read %d bytes through the limit, want %d", n, limit)
+	}
+	if src.read > limit+1 {
+		t.Errorf("consumed %d bytes of the input, want at most %d", src.read, limit+1)
+	}
+}
+
+func TestSizeLimitReaderExactFit(t *testing.T) {
+	limited := &sizeLimitReader{r: strings.NewReader(strings.Repeat("x", 1000)), remaining: 1000}
+	if n, err := io.Copy(io.Discard, limited); err != nil || n != 1000 || limited.exceeded {
+		t.Errorf("reading exactly the limit = %d bytes, %v, exceeded %v; want 1000, nil, false", n, err, limited.exceeded)
+	}
+}
+
+// TestSessionIsolatesMessages sends three messages over one connection,
+// with RSET and an abandoned transaction in between, and checks each is
+// stored with only its own sender and recipients
+func TestSessionIsolatesMessages(t *testing.T) {
+	store, addr := startTestServer(t, Options{})
+	c := dialTestServer(t, addr)
+
+	if ok, _ := c.Extension("PIPELINING"); !ok {
+		t.Error("PIPELINING isn't advertised")
+	}
+
+	messages := []struct {
+		from string
+		to   []string
+	}{
+		{"one@example.com", []string{"a@example.com", "b@example.com"}},
+		{"two@example.com", []string{"c@example.com"}},
+		{"three@example.com", []string{"d@example.com", "e@example.com"}},
+	}
+	for i, m := range messages {
+		if i > 0 {
+			// A transaction abandoned with RSET leaves nothing behind
+			if err := c.Mail("stray@example.com", nil); err != nil {
+				t.Fatalf("MAIL FROM: %v", err)
+			}
+			if err := c.Rcpt("stray@example.com", nil); err != nil {
+				t.Fatalf("RCPT TO: %v", err)
+			}
+			if err := c.Reset(); err != nil {
+				t.Fatalf("RSET: %v", err)
+			}
+		}
+		raw := "From: " + m.from + "\r\nSubject: Message\r\n\r\nHello\r\n"
+		if err := send(t, c, m.from, m.to, raw); err != nil {
+			t.Fatalf("message %d: %v", i+1, err)
+		}
+	}
+
+	emails := store.GetAll()
+	if len(emails) != len(messages) {
+		t.Fatalf("%d emails stored, want %d", len(emails), len(messages))
+	}
+	for i, email := range emails {
+		want := messages[i]
+		if email.EnvelopeFrom != want.from {
+			t.Errorf("email %d envelope sender = %q, want %q", i+1, email.EnvelopeFrom, want.from)
+		}
+		if !slices.Equal(email.To, want.to) {
+			t.Errorf("email %d recipients = %v, want %v", i+1, email.To, want.to)
+		}
+	}
+}
+
+// parse parses a raw message, failing the test on errors
+func parse(t *testing.T, raw string, recipients []string) *models.Email {
+	t.Helper()
+	email, err := ParseMessage(strings.NewReader(raw), "", recipients, ParseOptions{})
+	if err != nil {
+		t.Fatalf("ParseMessage: %v", err)
+	}
+	return email
+}
+
+// TestRecipientsWithQuotedCommas checks a comma inside a quoted display
+// name doesn't split the address, neither when parsed nor when the stored
+// list is joined and split again as the API and MCP layers do
+func TestRecipientsWithQuotedCommas(t *testing.T) {
+	tests := []struct {
+		name       string
+		to         string
+		recipients []string
+		want       []string
+	}{
+		{
+			name: "To header",
+			to:   `"Doe, John" <john@example.com>, jane@example.com`,
+			want: []string{"john@example.com", "jane@example.com"},
+		},
+		{
+			name:       "envelope",
+			to:         "undisclosed-recipients:;",
+			recipients: []string{`"Doe, John" <john@example.com>`, "jane@example.com"},
+			want:       []string{`"Doe, John" <john@example.com>`, "jane@example.com"},
+		},
+		{
+			name:       "escaped quote",
+			to:         "undisclosed-recipients:;",
+			recipients: []string{`"John \"JJ\", Jr" <john@example.com>`},
+			want:       []string{`"John \"JJ\", Jr" <john@example.com>`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			email := parse(t, "From: a@example.com\r\nTo: "+tt.to+"\r\nSubject: Hi\r\n\r\nHello\r\n", tt.recipients)
+			if !slices.Equal(email.To, tt.want) {
+				t.Fatalf("recipients = %q, want %q", email.To, tt.want)
+			}
+			if got := models.ParseAddressList(models.FormatAddressList(email.To)); !slices.Equal(got, tt.want) {
+				t.Errorf("recipients after joining and splitting = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestMultipartBoundary checks the boundary is found on a folded
+// Content-Type line, and that a multipart entity without one is read as a
+// single text part instead of yielding an empty body
+func TestMultipartBoundary(t *testing.T) {
+	parts := "--b1\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Plain part\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"<p>HTML part</p>\r\n" +
+		"--b1--\r\n"
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantPlain   string
+		wantHTML    string
+		wantParts   int
+	}{
+		{"on one line", "multipart/alternative; boundary=b1", parts, "Plain part", "<p>HTML part</p>", 2},
+		{"folded", "multipart/alternative;\r\n\tboundary=\"b1\"", parts, "Plain part", "<p>HTML part</p>", 2},
+		{"folded twice", "multipart/alternative;\r\n charset=utf-8;\r\n boundary=b1", parts, "Plain part", "<p>HTML part</p>", 2},
+		{"missing boundary", "multipart/mixed", "Just some text\r\n", "Just some text\r\n", "", 0},
+		{"missing boundary with parts", "multipart/alternative;\r\n charset=utf-8", parts, parts, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := "From: a@example.com\r\nTo: b@example.com\r\nSubject: Parts\r\n" +
+				"MIME-Version: 1.0\r\nContent-Type: " + tt.contentType + "\r\n\r\n" + tt.body
+			email := parse(t, raw, nil)
+
+			if strings.TrimSpace(email.Body) != strings.TrimSpace(tt.wantPlain) {
+				t.Errorf("body = %q, want %q", email.Body, tt.wantPlain)
+			}
+			if strings.TrimSpace(email.HTMLBody) != tt.wantHTML {
+				t.Errorf("HTML body = %q, want %q", email.HTMLBody, tt.wantHTML)
+			}
+			if got := len(email.Structure.Parts); got != tt.wantParts {
+				t.Errorf("structure has %d parts, want %d", got, tt.wantParts)
+			}
+		})
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	tests := []struct {
+		body     string
+		encoding string
+		want     string
+		wantNote string
+	}{
+		{"plain ascii", "7bit", "plain ascii", ""},
+		{"Gr\xc3\xbc\xc3\x9fe", "7bit", "Gr\xc3\xbc\xc3\x9fe", "Declared 7bit but contains 8-bit bytes (first at offset 2)"},
+		{"caf\xe9", " 7BIT ", "caf\xe9", "Declared 7bit but contains 8-bit bytes (first at offset 3)"},
+		{"Gr\xc3\xbc\xc3\x9fe", "8bit", "Gr\xc3\xbc\xc3\x9fe", ""},
+		{"\x00\x01\xff\r\nbinary", "binary", "\x00\x01\xff\r\nbinary", ""},
+		{"Gr\xc3\xbc\xc3\x9fe", "", "Gr\xc3\xbc\xc3\x9fe", ""},
+		{"caf=C3=A9", "quoted-printable", "caf\xc3\xa9", ""},
+		{"AAEC/w==", "base64", "\x00\x01\x02\xff", ""},
+		{"not base64!", "base64", "not base64!", "Invalid base64, kept as received"},
+		{"data", "x-uuencode", "data", `Unknown Content-Transfer-Encoding "x-uuencode", kept as received`},
+	}
+	for _, tt := range tests {
+		got, note := decodeBody([]byte(tt.body), tt.encoding)
+		if got != tt.want || note != tt.wantNote {
+			t.Errorf("decodeBody(%q, %q) = %q, %q; want %q, %q", tt.body, tt.encoding, got, note, tt.want, tt.wantNote)
+		}
+	}
+}
+
+// TestTransferEncodingNotes checks the notes end up on the parts of the
+// MIME tree, and binary parts keep their bytes
+func TestTransferEncodingNotes(t *testing.T) {
+	raw := "From: a@example.com\r\nTo: b@example.com\r\nSubject: Encodings\r\n" +
+		"MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=b1\r\n\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: 7bit\r\n" +
+		"\r\n" +
+		"Gr\xc3\xbc\xc3\x9fe\r\n" +
+		"--b1\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Transfer-Encoding: binary\r\n" +
+		"Content-Disposition: attachment; filename=data.bin\r\n" +
+		"\r\n" +
+		"\x00\x01\xff\r\n" +
+		"--b1--\r\n"
+	email := parse(t, raw, nil)
+
+	if len(email.Structure.Parts) != 2 {
+		t.Fatalf("structure has %d parts, want 2", len(email.Structure.Parts))
+	}
+	text, binary := email.Structure.Parts[0], email.Structure.Parts[1]
+	if !strings.HasPrefix(text.EncodingNote, "Declared 7bit but contains 8-bit bytes") {
+		t.Errorf("7bit part note = %q, want the 8-bit bytes note", text.EncodingNote)
+	}
+	if email.Body != "Gr\xc3\xbc\xc3\x9fe" {
+		t.Errorf("body = %q, want the 8-bit text as received", email.Body)
+	}
+	if binary.EncodingNote != "" || binary.Encoding != "binary" || binary.Size != 3 {
+		t.Errorf("binary part = encoding %q, size %d, note %q; want binary, 3, none", binary.Encoding, binary.Size, binary.EncodingNote)
+	}
+}
+
+// TestMissingContentType checks a message without Content-Type is read as
+// US-ASCII plain text and flagged, unlike a malformed one
+func TestMissingContentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		header      string
+		wantMissing bool
+		wantParams  map[string]string
+	}{
+		{"absent", "", true, map[string]string{"charset": "us-ascii"}},
+		{"empty", "Content-Type: \r\n", true, map[string]string{"charset": "us-ascii"}},
+		{"malformed", "Content-Type: text/plain; charset\r\n", false, nil},
+		{"present", "Content-Type: text/plain; charset=utf-8\r\n", false, map[string]string{"charset": "utf-8"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := "From: a@example.com\r\nTo: b@example.com\r\nSubject: Minimal\r\n" + tt.header + "\r\nLine one\r\nLine two\r\n"
+			email := parse(t, raw, nil)
+
+			if email.Body != "Line one\r\nLine two\r\n" {
+				t.Errorf("body = %q, want the whole body as plain text", email.Body)
+			}
+			if email.HTMLBody != "" {
+				t.Errorf("HTML body = %q, want none", email.HTMLBody)
+			}
+			if email.ContentTypeMissing != tt.wantMissing {
+				t.Errorf("ContentTypeMissing = %v, want %v", email.ContentTypeMissing, tt.wantMissing)
+			}
+			if email.Structure.ContentType != "text/plain" || !maps.Equal(email.Structure.Params, tt.wantParams) {
+				t.Errorf("structure = %s %v, want text/plain %v", email.Structure.ContentType, email.Structure.Params, tt.wantParams)
+			}
+		})
+	}
+}
+
+// dialText connects to addr with a raw command connection and says hello
+func dialText(t *testing.T, addr string) *textproto.Conn {
+	t.Helper()
+	c, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("greeting: %v", err)
+	}
+	expect(t, c, "EHLO client.example", 250)
+	return c
+}
+
+// expect sends cmd and checks the reply code, returning the reply text
+func expect(t *testing.T, c *textproto.Conn, cmd string, code int) string {
+	t.Helper()
+	if err := c.PrintfLine("%s", cmd); err != nil {
+		t.Fatalf("%s: %v", cmd, err)
+	}
+	got, msg, _ := c.ReadResponse(0)
+	if got != code {
+		t.Fatalf("%s = %d %s, want %d", cmd, got, msg, code)
+	}
+	return msg
+}
+
+func TestVRFYReplies(t *testing.T) {
+	known := []string{"Known@example.com"}
+	tests := []struct {
+		name string
+		opts Options
+		cmd  string
+		code int
+		text string
+	}{
+		{"default", Options{}, "VRFY anyone@example.com", 252, "Cannot VRFY user"},
+		{"default EXPN", Options{}, "EXPN list@example.com", 502, "EXPN command not implemented"},
+		{"missing argument", Options{ValidRecipients: known}, "VRFY", 501, "Missing argument"},
+		{"disabled", Options{DisableVRFY: true}, "VRFY anyone@example.com", 502, "VRFY command disabled"},
+		{"disabled EXPN", Options{DisableVRFY: true}, "expn list@example.com", 502, "EXPN command disabled"},
+		{"known", Options{ValidRecipients: known}, "VRFY known@EXAMPLE.com", 250, "<known@EXAMPLE.com>"},
+		{"known bracketed", Options{ValidRecipients: known}, "VRFY Known <known@example.com>", 250, "<known@example.com>"},
+		{"known EXPN", Options{ValidRecipients: known}, "EXPN known@example.com", 250, "<known@example.com>"},
+		{"unknown", Options{ValidRecipients: known}, "VRFY other@example.com", 550, "User unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := startTestServer(t, tt.opts)
+			c := dialText(t, addr)
+
+			if msg := expect(t, c, tt.cmd, tt.code); !strings.Contains(msg, tt.text) {
+				t.Errorf("%s = %q, want it to contain %q", tt.cmd, msg, tt.text)
+			}
+			// The session carries on after the intercepted command
+			expect(t, c, "NOOP", 250)
+		})
+	}
+}
+
+// pipeline writes raw to c in one go and checks the replies that follow
+func pipeline(t *testing.T, c *textproto.Conn, raw string, codes ...int) {
+	t.Helper()
+	c.W.WriteString(raw)
+	if err := c.W.Flush(); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	for _, want := range codes {
+		if code, msg, _ := c.ReadResponse(0); code != want {
+			t.Fatalf("reply to %q = %d %s, want %d", raw, code, msg, want)
+		}
+	}
+}
+
+// TestVRFYInMessageContent checks VRFY and EXPN lines in DATA and BDAT
+// content are stored rather than answered, also when the commands before
+// the content are pipelined, and that a VRFY pipelined behind another
+// command is answered after it
+func TestVRFYInMessageContent(t *testing.T) {
+	store, addr := startTestServer(t, Options{DisableVRFY: true, MaxMessageBytes: 1024})
+	c := dialText(t, addr)
+
+	content := "Subject: Verify\r\n\r\nVRFY someone@example.com\r\nEXPN list@example.com\r\n"
+	envelope := "MAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.com>\r\n"
+	pipeline(t, c, envelope+"DATA\r\n", 250, 250, 354)
+	pipeline(t, c, content+".\r\n", 250)
+	pipeline(t, c, envelope+fmt.Sprintf("BDAT %d LAST\r\n%s", len(content), content), 250, 250, 250)
+
+	// A refused BDAT leaves its chunk to be read as commands
+	vrfy := "VRFY someone@example.com\r\n"
+	pipeline(t, c, fmt.Sprintf("BDAT %d LAST\r\n%s", len(vrfy), vrfy), 502, 502)
+
+	// An oversize chunk is discarded after the 552
+	chunk := strings.Repeat(vrfy, 50)
+	pipeline(t, c, envelope+fmt.Sprintf("BDAT %d LAST\r\n%s", len(chunk), chunk), 250, 250, 552)
+	pipeline(t, c, "NOOP\r\n", 250)
+
+	pipeline(t, c, "RSET\r\n"+vrfy, 250, 502)
+
+	emails := store.GetAll()
+	if len(emails) != 2 {
+		t.Fatalf("%d emails stored, want 2", len(emails))
+	}
+	for i, email := range emails {
+		if email.Body != "VRFY someone@example.com\r\nEXPN list@example.com\r\n" {
+			t.Errorf("email %d body = %q, want the VRFY and EXPN lines", i+1, email.Body)
+		}
+	}
+}
+
+// TestTranscriptOfIgnoredMessage checks the dialog of a message that is
+// ignored or rejected doesn't end up in the next stored message's
+// transcript
+func TestTranscriptOfIgnoredMessage(t *testing.T) {
+	store, addr := startTestServer(t, Options{
+		CaptureTranscript: true,
+		IgnoreFrom:        []string{"ignored@"},
+		MaxMessageBytes:   4096,
+	})
+	c := dialTestServer(t, addr)
+
+	ignored := "From: ignored@example.com\r\nSubject: Ignored\r\n\r\nHello\r\n"
+	if err := send(t, c, "ignored@example.com", []string{"b@example.com"}, ignored); err != nil {
+		t.Fatalf("ignored message: %v", err)
+	}
+	if err := send(t, c, "big@example.com", []string{"b@example.com"}, messageOfSize(8192)); err == nil {
+		t.Fatal("oversize message accepted")
+	}
+	kept := "From: kept@example.com\r\nSubject: Kept\r\n\r\nHello\r\n"
+	if err := send(t, c, "kept@example.com", []string{"b@example.com"}, kept); err != nil {
+		t.Fatalf("kept message: %v", err)
+	}
+
+	emails := store.GetAll()
+	if len(emails) != 1 {
+		t.Fatalf("%d emails stored, want 1", len(emails))
+	}
+	transcript := emails[0].Transcript
+	if !strings.HasPrefix(transcript, "C: MAIL FROM:<kept@example.com>") {
+		t.Errorf("transcript = %q, want it to start with the kept message's MAIL FROM", transcript)
+	}
+	if n := strings.Count(transcript, "bytes of message content"); n != 1 {
+		t.Errorf("transcript has %d content lines, want 1:\n%s", n, transcript)
+	}
+}
+
+// TestContentLimits checks the subject and body limits at their boundaries,
+// both rejecting with 552 and truncating
+func TestContentLimits(t *testing.T) {
+	message := func(subject, body string) string {
+		return "From: a@example.com\r\nSubject: " + subject + "\r\n\r\n" + body + "\r\n"
+	}
+	// The body limit applies to the decoded body, measured the way Data sees it
+	bodyAtLimit := strings.Repeat("x", 20)
+	maxBody := len(parse(t, message("Hi", bodyAtLimit), nil).Body)
+
+	tests := []struct {
+		name    string
+		raw     string
+		subject string // Stored subject, "" when rejected
+		body    int    // Stored body length when accepted
+	}{
+		{"subject at limit", message("Grüße", "Hello"), "Grüße", 0},
+		{"subject over limit", message("Grüße!", "Hello"), "Grüße", 0},
+		{"body at limit", message("Hi", bodyAtLimit), "Hi", maxBody},
+		{"body over limit", message("Hi", bodyAtLimit+"x"), "Hi", maxBody},
+	}
+	for _, reject := range []bool{true, false} {
+		store, addr := startTestServer(t, Options{MaxSubjectLen: 5, MaxBodyBytes: maxBody, RejectOversize: reject})
+		c := dialTestServer(t, addr)
+
+		for _, tt := range tests {
+			over := strings.HasSuffix(tt.name, "over limit")
+			before := len(store.GetAll())
+			err := send(t, c, "a@example.com", []string{"b@example.com"}, tt.raw)
+
+			var smtpErr *smtp.SMTPError
+			if reject && over {
+				if !errors.As(err, &smtpErr) || smtpErr.Code != 552 {
+					t.Errorf("%s with -reject-oversize = %v, want a 552 reply", tt.name, err)
+				}
+				if n := len(store.GetAll()); n != before {
+					t.Errorf("%s with -reject-oversize: message stored", tt.name)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s (reject %v) = %v, want it accepted", tt.name, reject, err)
+				continue
+			}
+			emails := store.GetAll()
+			if len(emails) != before+1 {
+				t.Errorf("%s (reject %v): %d emails stored, want %d", tt.name, reject, len(emails), before+1)
+				continue
+			}
+			email := emails[len(emails)-1]
+			if email.Subject != tt.subject {
+				t.Errorf("%s (reject %v): subject = %q, want %q", tt.name, reject, email.Subject, tt.subject)
+			}
+			if tt.body > 0 && len(email.Body) != tt.body {
+				t.Errorf("%s (reject %v): body is %d bytes, want %d", tt.name, reject, len(email.Body), tt.body)
+			}
+		}
+	}
+}
+
+// TestSMTPUTF8 checks UTF-8 addresses sent with SMTPUTF8 are stored as
+// received
+func TestSMTPUTF8(t *testing.T) {
+	store, addr := startTestServer(t, Options{})
+	c := dialTestServer(t, addr)
+	for _, ext := range []string{"SMTPUTF8", "8BITMIME"} {
+		if ok, _ := c.Extension(ext); !ok {
+			t.Errorf("%s not advertised", ext)
+		}
+	}
+
+	const from, to = "jösé@exämple.com", "比尔@例子.测试"
+	if err := c.Mail(from, &smtp.MailOptions{UTF8: true}); err != nil {
+		t.Fatalf("MAIL FROM with SMTPUTF8: %v", err)
+	}
+	if err := c.Rcpt(to, nil); err != nil {
+		t.Fatalf("RCPT TO: %v", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("DATA: %v", err)
+	}
+	io.WriteString(w, "From: José <"+from+">\r\nTo: "+to+"\r\nSubject: Grüße\r\n\r\nHallo\r\n")
+	if err := w.Close(); err != nil {
+		t.Fatalf("sending: %v", err)
+	}
+
+	emails := store.GetAll()
+	if len(emails) != 1 {
+		t.Fatalf("%d emails stored, want 1", len(emails))
+	}
+	email := emails[0]
+	if email.EnvelopeFrom != from {
+		t.Errorf("envelope sender = %q, want %q", email.EnvelopeFrom, from)
+	}
+	if !strings.Contains(email.From, from) {
+		t.Errorf("From = %q, want it to contain %q", email.From, from)
+	}
+	if !slices.Contains(email.To, to) {
+		t.Errorf("recipients = %q, want %q", email.To, to)
+	}
+}
+
+// TestShutdownDrainsData checks a message still being received when
+// shutdown starts is stored, while new messages are refused
+func TestShutdownDrainsData(t *testing.T) {
+	store := storage.NewStore()
+	srv, err := StartServer(store, storage.NewConnectionRegistry(), "127.0.0.1:0", Options{})
+	if err != nil {
+		t.Fatalf("StartServer: %v", err)
+	}
+	addr := srv.listener.Addr().String()
+	sending := dialTestServer(t, addr)
+	idle := dialTestServer(t, addr)
+
+	if err := sending.Mail("a@example.com", nil); err != nil {
+		t.Fatalf("MAIL FROM: %v", err)
+	}
+	if err := sending.Rcpt("b@example.com", nil); err != nil {
+		t.Fatalf("RCPT TO: %v", err)
+	}
+	w, err := sending.Data()
+	if err != nil {
+		t.Fatalf("DATA: %v", err)
+	}
+	io.WriteString(w, "From: a@example.com\r\nSubject: In flight\r\n\r\n")
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- srv.Shutdown(context.Background()) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		srv.backend.mu.Lock()
+		draining := srv.backend.draining
+		srv.backend.mu.Unlock()
+		if draining {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server not draining")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// go-smtp sends the 354 itself, so the refusal answers the content
+	err = send(t, idle, "a@example.com", []string{"b@example.com"}, "Subject: Too late\r\n\r\nHello\r\n")
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 421 {
+		t.Errorf("sending while draining = %v, want a 421 reply", err)
+	}
+
+	io.WriteString(w, "Hello\r\n")
+	if err := w.Close(); err != nil {
+		t.Fatalf("finishing the message during shutdown: %v", err)
+	}
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown didn't return after the message was stored")
+	}
+
+	emails := store.GetAll()
+	if len(emails) != 1 || emails[0].Subject != "In flight" {
+		t.Fatalf("stored %d emails, want the one in flight", len(emails))
+	}
+}
+
+// TestAttachmentText checks text-like attachments keep their decoded text,
+// capped to AttachmentTextBytes, and binary ones don't
+func TestAttachmentText(t *testing.T) {
+	raw := "From: shop@example.com\r\n" +
+		"Subject: Orders\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"See attached\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/csv\r\n" +
+		"Content-Disposition: attachment; filename=orders.csv\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"aWQsdG90YWwKT1JELTQyLDEwCk9SRC00MywyMAo=\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Disposition: attachment; filename=orders.bin\r\n" +
+		"\r\n" +
+		"ORD-42\r\n" +
+		"--b--\r\n"
+
+	for _, limit := range []int{0, 16, 1024} {
+		email, err := ParseMessage(strings.NewReader(raw), "", nil, ParseOptions{AttachmentTextBytes: limit})
+		if err != nil {
+			t.Fatalf("ParseMessage: %v", err)
+		}
+		if len(email.Structure.Parts) != 3 {
+			t.Fatalf("%d parts, want 3", len(email.Structure.Parts))
+		}
+		csv, binary := email.Structure.Parts[1], email.Structure.Parts[2]
+
+		want := "id,total\nORD-42,10\nORD-43,20\n"
+		want = want[:min(limit, len(want))]
+		if csv.Text != want {
+			t.Errorf("limit %d: CSV text = %q, want %q", limit, csv.Text, want)
+		}
+		if binary.Text != "" {
+			t.Errorf("limit %d: binary attachment text = %q, want none", limit, binary.Text)
+		}
+		if email.Body != "See attached" {
+			t.Errorf("limit %d: body = %q, want only the text part", limit, email.Body)
+		}
+	}
+}
+
+// TestLineLengthReaderStopsAtLongLine checks an unterminated giant line is
+// cut off at the limit instead of buffered
+func TestLineLengthReaderStopsAtLongLine(t *testing.T) {
+	const limit = 1000
+	src := &countingReader{}
+	lines := &lineLengthReader{r: src, max: limit}
+
+	n, err := io.Copy(io.Discard, lines)
+	if !errors.Is(err, errLineTooLong) || !lines.exceeded {
+		t.Fatalf("reading an endless line = %v, want errLineTooLong", err)
+	}
+	if n != limit {
+		t.Errorf("read %d bytes through the limit, want %d", n, limit)
+	}
+	// io.Copy reads 32KB at a time
+	if src.read > 32*1024 {
+		t.Errorf("consumed %d bytes of the input, want at most one read", src.read)
+	}
+
+	exact := strings.Repeat(strings.Repeat("x", limit)+"\r\n", 3)
+	lines = &lineLengthReader{r: strings.NewReader(exact), max: limit}
+	if _, err := io.Copy(io.Discard, lines); err != nil || lines.exceeded {
+		t.Errorf("reading lines of exactly the limit = %v, exceeded %v", err, lines.exceeded)
+	}
+}
+
+// TestLongLineRejected checks an over-long line in DATA or in a BDAT chunk
+// is answered with 500
+func TestLongLineRejected(t *testing.T) {
+	const limit = 100
+	store, addr := startTestServer(t, Options{MaxLineLength: limit, MaxMessageBytes: 4 << 20})
+
+	c := dialTestServer(t, addr)
+	long := "Subject: " + strings.Repeat("x", 2*limit) + "\r\n\r\nHello\r\n"
+	var smtpErr *smtp.SMTPError
+	if err := send(t, c, "a@example.com", []string{"b@example.com"}, long); !errors.As(err, &smtpErr) || smtpErr.Code != 500 {
+		t.Errorf("DATA with a long header line = %v, want a 500 reply", err)
+	}
+	// go-smtp closes the connection after a long DATA line
+	c = dialTestServer(t, addr)
+	fits := "Subject: " + strings.Repeat("x", limit-len("Subject: ")) + "\r\n\r\nHello\r\n"
+	if err := send(t, c, "a@example.com", []string{"b@example.com"}, fits); err != nil {
+		t.Errorf("DATA with a line at the limit: %v", err)
+	}
+
+	// A BDAT chunk ending in a 1MB line without a line break. go-smtp
+	// applies its own limit to chunk bytes read along with the command and
+	// closes the connection, so the chunk starts with more short lines than
+	// it reads at once.
+	text := dialText(t, addr)
+	expect(t, text, "MAIL FROM:<a@example.com>", 250)
+	expect(t, text, "RCPT TO:<b@example.com>", 250)
+	chunk := strings.Repeat("X-Pad: x\r\n", 1000) + strings.Repeat("x", 1<<20)
+	pipeline(t, text, fmt.Sprintf("BDAT %d LAST\r\n%s", len(chunk), chunk), 500)
+	expect(t, text, "NOOP", 250)
+
+	if n := len(store.GetAll()); n != 1 {
+		t.Errorf("%d emails stored, want only the one within the limit", n)
+	}
+}
+
+// TestRejectionEnhancedCodes checks each rejection carries the enhanced
+// status code listed in the README
+func TestRejectionEnhancedCodes(t *testing.T) {
+	message := "From: a@example.com\r\nSubject: Hello\r\n\r\nHello\r\n"
+	tests := []struct {
+		name     string
+		opts     Options
+		raw      string
+		code     int
+		enhanced smtp.EnhancedCode
+	}{
+		{"message size", Options{MaxMessageBytes: 1024}, messageOfSize(2048), 552, smtp.EnhancedCode{5, 3, 4}},
+		{"subject length", Options{MaxSubjectLen: 3, RejectOversize: true}, message, 552, smtp.EnhancedCode{5, 3, 4}},
+		{"body size", Options{MaxBodyBytes: 3, RejectOversize: true}, message, 552, smtp.EnhancedCode{5, 3, 4}},
+		{"line length", Options{MaxLineLength: 100}, "Subject: " + strings.Repeat("x", 200) + "\r\n\r\nHello\r\n", 500, smtp.EnhancedCode{5, 5, 2}},
+		{"malformed header", Options{}, "From: a@example.com\r\nNot a header\r\n\r\nHello\r\n", 554, smtp.EnhancedCode{5, 6, 0}},
+	}
+	for _, tt := range tests {
+		_, addr := startTestServer(t, tt.opts)
+		c := dialTestServer(t, addr)
+
+		err := send(t, c, "a@example.com", []string{"b@example.com"}, tt.raw)
+		var smtpErr *smtp.SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr.Code != tt.code || smtpErr.EnhancedCode != tt.enhanced {
+			t.Errorf("%s: reply = %v, want %d %v", tt.name, err, tt.code, tt.enhanced)
+		}
+	}
+
+	// Recipients past the limit
+	_, addr := startTestServer(t, Options{})
+	c := dialTestServer(t, addr)
+	if err := c.Mail("a@example.com", nil); err != nil {
+		t.Fatalf("MAIL FROM: %v", err)
+	}
+	var err error
+	for i := 0; i <= MaxRecipients && err == nil; i++ {
+		err = c.Rcpt(fmt.Sprintf("r%d@example.com", i), nil)
+	}
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 452 || smtpErr.EnhancedCode != (smtp.EnhancedCode{4, 5, 3}) {
+		t.Errorf("recipient %d = %v, want 452 4.5.3", MaxRecipients+1, err)
+	}
+
+	// Messages past the per-connection limit
+	_, addr = startTestServer(t, Options{MaxMessagesPerConn: 1})
+	c = dialTestServer(t, addr)
+	if err := send(t, c, "a@example.com", []string{"b@example.com"}, message); err != nil {
+		t.Fatalf("first message: %v", err)
+	}
+	if err := c.Mail("a@example.com", nil); err != nil {
+		t.Fatalf("MAIL FROM: %v", err)
+	}
+	if err := c.Rcpt("b@example.com", nil); err != nil {
+		t.Fatalf("RCPT TO: %v", err)
+	}
+	w, err := c.Data()
+	if err == nil {
+		io.WriteString(w, message)
+		err = w.Close()
+	}
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 421 || smtpErr.EnhancedCode != (smtp.EnhancedCode{4, 7, 0}) {
+		t.Errorf("second message = %v, want 421 4.7.0", err)
+	}
+}
+
+const pgpSignedMessage = "From: jane@example.com\r\n" +
+	"Subject: Signed\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/signed; micalg=pgp-sha256;\r\n" +
+	" protocol=\"application/pgp-signature\"; boundary=\"sig\"\r\n" +
+	"\r\n" +
+	"--sig\r\n" +
+	"Content-Type: multipart/alternative; boundary=\"alt\"\r\n" +
+	"\r\n" +
+	"--alt\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"Signed text\r\n" +
+	"--alt\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p>Signed text</p>\r\n" +
+	"--alt--\r\n" +
+	"\r\n" +
+	"--sig\r\n" +
+	"Content-Type: application/pgp-signature; name=\"signature.asc\"\r\n" +
+	"Content-Disposition: attachment; filename=\"signature.asc\"\r\n" +
+	"\r\n" +
+	"-----BEGIN PGP SIGNATURE-----\r\n" +
+	"iQEzBAEBCAAdFiEE\r\n" +
+	"-----END PGP SIGNATURE-----\r\n" +
+	"--sig--\r\n"
+
+const pgpEncryptedMessage = "From: jane@example.com\r\n" +
+	"Subject: Encrypted\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\"; boundary=\"enc\"\r\n" +
+	"\r\n" +
+	"--enc\r\n" +
+	"Content-Type: application/pgp-encrypted\r\n" +
+	"\r\n" +
+	"Version: 1\r\n" +
+	"--enc\r\n" +
+	"Content-Type: application/octet-stream; name=\"encrypted.asc\"\r\n" +
+	"\r\n" +
+	"-----BEGIN PGP MESSAGE-----\r\n" +
+	"hQEMA0Xb\r\n" +
+	"-----END PGP MESSAGE-----\r\n" +
+	"--enc--\r\n"
+
+const smimeEncryptedMessage = "From: jane@example.com\r\n" +
+	"Subject: S/MIME\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: application/pkcs7-mime; smime-type=enveloped-data; name=\"smime.p7m\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"MIAGCSqGSIb3DQEHA6CAMIACAQAxggE=\r\n"
+
+func TestCryptoStructure(t *testing.T) {
+	tests := []struct {
+		name      string
+		raw       string
+		signed    bool
+		encrypted bool
+		crypto    models.CryptoInfo
+		body      string
+		html      string
+	}{
+		{
+			"PGP/MIME signed", pgpSignedMessage, true, false,
+			models.CryptoInfo{Format: "pgp", Protocol: "application/pgp-signature", Micalg: "pgp-sha256"},
+			"Signed text", "<p>Signed text</p>",
+		},
+		{
+			"PGP/MIME encrypted", pgpEncryptedMessage, false, true,
+			models.CryptoInfo{Format: "pgp", Protocol: "application/pgp-encrypted"},
+			"", "",
+		},
+		{
+			"S/MIME enveloped", smimeEncryptedMessage, false, true,
+			models.CryptoInfo{Format: "smime", SMIMEType: "enveloped-data"},
+			"", "",
+		},
+	}
+	for _, tt := range tests {
+		email := parse(t, tt.raw, nil)
+		if email.Signed != tt.signed || email.Encrypted != tt.encrypted {
+			t.Errorf("%s: signed %v encrypted %v, want %v and %v", tt.name, email.Signed, email.Encrypted, tt.signed, tt.encrypted)
+		}
+		if email.Crypto == nil || *email.Crypto != tt.crypto {
+			t.Errorf("%s: crypto = %+v, want %+v", tt.name, email.Crypto, tt.crypto)
+		}
+		if strings.TrimSpace(email.Body) != tt.body || strings.TrimSpace(email.HTMLBody) != tt.html {
+			t.Errorf("%s: body %q, HTML %q, want %q and %q", tt.name, email.Body, email.HTMLBody, tt.body, tt.html)
+		}
+	}
+}
+
+// TestMaxMessagesPerConn checks messages past the limit on one connection
+// get 421 and the connection is closed, RSET doesn't reset the count and a
+// new connection starts over
+func TestMaxMessagesPerConn(t *testing.T) {
+	store, addr := startTestServer(t, Options{MaxMessagesPerConn: 2})
+	message := "From: a@example.com\r\nSubject: Hello\r\n\r\nHello\r\n"
+
+	c := dialTestServer(t, addr)
+	for i := 1; i <= 2; i++ {
+		if err := send(t, c, "a@example.com", []string{"b@example.com"}, message); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if err := c.Reset(); err != nil {
+			t.Fatalf("RSET: %v", err)
+		}
+	}
+	err := send(t, c, "a@example.com", []string{"b@example.com"}, message)
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 421 {
+		t.Fatalf("message 3 = %v, want a 421 reply", err)
+	}
+	if err := c.Noop(); err == nil {
+		t.Error("connection still open after the 421")
+	}
+
+	c = dialTestServer(t, addr)
+	if err := send(t, c, "a@example.com", []string{"b@example.com"}, message); err != nil {
+		t.Errorf("message on a new connection: %v", err)
+	}
+	if n := len(store.GetAll()); n != 3 {
+		t.Errorf("%d emails stored, want 3", n)
+	}
+}
+
+// attachmentsMessage returns a message with a text body and one text
+// attachment of each size
+func attachmentsMessage(sizes ...int) string {
+	var b strings.Builder
+	b.WriteString("From: a@example.com\r\nSubject: Files\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nFiles attached\r\n")
+	for i, size := range sizes {
+		fmt.Fprintf(&b, "--b\r\nContent-Type: text/plain\r\nContent-Disposition: attachment; filename=file%d.txt\r\n\r\n%s\r\n",
+			i+1, strings.Repeat("x", size))
+	}
+	b.WriteString("--b--\r\n")
+	return b.String()
+}
+
+func TestAttachmentLimits(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      ParseOptions
+		sizes     []int
+		truncated []bool
+	}{
+		{"no limits", ParseOptions{}, []int{10, 100, 1000}, []bool{false, false, false}},
+		{"size at limit", ParseOptions{MaxAttachmentSize: 100}, []int{100, 101}, []bool{false, true}},
+		{"count", ParseOptions{MaxAttachments: 2}, []int{10, 10, 10, 10}, []bool{false, false, true, true}},
+		{"both", ParseOptions{MaxAttachments: 2, MaxAttachmentSize: 50}, []int{10, 60, 10}, []bool{false, true, true}},
+	}
+	for _, tt := range tests {
+		tt.opts.KeepEncoded = true
+		tt.opts.AttachmentTextBytes = 1024
+		email, err := ParseMessage(strings.NewReader(attachmentsMessage(tt.sizes...)), "", nil, tt.opts)
+		if err != nil {
+			t.Fatalf("%s: ParseMessage: %v", tt.name, err)
+		}
+		if email.Body != "Files attached" {
+			t.Errorf("%s: body = %q", tt.name, email.Body)
+		}
+
+		attachments := email.Structure.Parts[1:]
+		anyTruncated := false
+		for i, part := range attachments {
+			want := tt.truncated[i]
+			anyTruncated = anyTruncated || want
+			if part.Truncated != want || (part.LimitNote != "") != want {
+				t.Errorf("%s: attachment %d truncated %v (note %q), want %v", tt.name, i+1, part.Truncated, part.LimitNote, want)
+			}
+			// Metadata is kept either way
+			if part.Filename != fmt.Sprintf("file%d.txt", i+1) || part.Size < tt.sizes[i] {
+				t.Errorf("%s: attachment %d metadata = %q, %d bytes", tt.name, i+1, part.Filename, part.Size)
+			}
+			if kept := part.Text != "" || part.EncodedBody != nil; kept == want {
+				t.Errorf("%s: attachment %d content kept %v, want %v", tt.name, i+1, kept, !want)
+			}
+		}
+		if email.AttachmentsTruncated != anyTruncated {
+			t.Errorf("%s: AttachmentsTruncated = %v, want %v", tt.name, email.AttachmentsTruncated, anyTruncated)
+		}
+	}
+}
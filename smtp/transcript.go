@@ -0,0 +1,162 @@
+package smtp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// transcriptListener wraps accepted connections so that each session's
+// SMTP dialog can be recorded
+type transcriptListener struct {
+	net.Listener
+}
+
+// Accept returns the next connection wrapped in a transcriptConn
+func (l *transcriptListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &transcriptConn{Conn: conn, transcript: &transcript{}}, nil
+}
+
+// transcriptConn records the commands read from and the replies written to
+// a client connection
+type transcriptConn struct {
+	net.Conn
+	transcript *transcript
+}
+
+// Read records the client's commands as they are read
+func (c *transcriptConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.transcript.client(p[:n])
+	return n, err
+}
+
+// Write records the server's replies as they are written
+func (c *transcriptConn) Write(p []byte) (int, error) {
+	c.transcript.server(p)
+	return c.Conn.Write(p)
+}
+
+// transcript accumulates an SMTP dialog as "C: " and "S: " lines. Message
+// content is reduced to its size and AUTH credentials are redacted.
+type transcript struct {
+	mu      sync.Mutex
+	lines   []string
+	partial []byte // Client line read so far
+	data    bool   // Reading DATA content, up to the lone "."
+	size    int    // Bytes of message content read in the current DATA or BDAT
+	skip    int    // BDAT chunk bytes still to be read
+	auth    bool   // The server asked for an AUTH continuation (334)
+	muted   bool   // Server lines and the rest of any content are dropped; set by take until the next command
+}
+
+// client processes bytes read from the client
+func (t *transcript) client(p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for len(p) > 0 {
+		// BDAT chunks are raw bytes rather than lines
+		if t.skip > 0 {
+			n := min(t.skip, len(p))
+			t.skip -= n
+			t.size += n
+			p = p[n:]
+			if t.skip == 0 {
+				if !t.muted {
+					t.lines = append(t.lines, fmt.Sprintf("C: <%d bytes of message content>", t.size))
+				}
+				t.size = 0
+			}
+			continue
+		}
+
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			t.partial = append(t.partial, p...)
+			return
+		}
+		line := string(append(t.partial, p[:i+1]...))
+		t.partial = t.partial[:0]
+		p = p[i+1:]
+		t.clientLine(line)
+	}
+}
+
+// clientLine records a complete line read from the client
+func (t *transcript) clientLine(line string) {
+	if t.data {
+		if strings.TrimRight(line, "\r\n") == "." {
+			// Content left unread by a rejected message is drained after take
+			if !t.muted {
+				t.lines = append(t.lines, fmt.Sprintf("C: <%d bytes of message content>", t.size), "C: .")
+			}
+			t.data = false
+			t.size = 0
+			return
+		}
+		t.size += len(line)
+		return
+	}
+
+	line = strings.TrimRight(line, "\r\n")
+	t.muted = false
+	if t.auth {
+		t.auth = false
+		line = "<redacted>"
+	}
+
+	verb, arg, _ := strings.Cut(line, " ")
+	switch strings.ToUpper(verb) {
+	case "AUTH":
+		// Keep the mechanism but not an initial response
+		if mechanism, _, hasResponse := strings.Cut(arg, " "); hasResponse {
+			line = verb + " " + mechanism + " <redacted>"
+		}
+	case "BDAT":
+		size, _, _ := strings.Cut(arg, " ")
+		if n, err := strconv.Atoi(size); err == nil && n > 0 {
+			t.skip = n
+		}
+	}
+	t.lines = append(t.lines, "C: "+line)
+}
+
+// server processes bytes written to the client
+func (t *transcript) server(p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\r\n"), "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case strings.HasPrefix(line, "354"):
+			t.data = true
+		case strings.HasPrefix(line, "334"):
+			t.auth = true
+		}
+		if !t.muted {
+			t.lines = append(t.lines, "S: "+line)
+		}
+	}
+}
+
+// take returns the dialog recorded since the previous take and starts
+// over. The final reply to the message is written after it has been
+// stored, so it is left out rather than opening the next transcript.
+func (t *transcript) take() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	text := strings.Join(t.lines, "\n")
+	t.lines = nil
+	t.muted = true
+	return text
+}
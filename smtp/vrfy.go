@@ -0,0 +1,268 @@
+package smtp
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// go-smtp answers VRFY itself with 252 and EXPN with 502 and offers no way
+// to change either, so the commands are answered before it reads them
+
+// verifier decides the replies to VRFY and EXPN commands
+type verifier struct {
+	disabled   bool            // Refuse both commands with 502
+	recipients map[string]bool // Lowercased addresses that verify
+}
+
+// newVerifier returns a verifier for the options, or nil when neither
+// DisableVRFY nor ValidRecipients is set and go-smtp's replies stand
+func newVerifier(opts Options) *verifier {
+	if !opts.DisableVRFY && len(opts.ValidRecipients) == 0 {
+		return nil
+	}
+	v := &verifier{disabled: opts.DisableVRFY, recipients: make(map[string]bool, len(opts.ValidRecipients))}
+	for _, addr := range opts.ValidRecipients {
+		v.recipients[strings.ToLower(addr)] = true
+	}
+	return v
+}
+
+// reply returns the reply line to a VRFY or EXPN command with the argument
+func (v *verifier) reply(verb, arg string) string {
+	if v.disabled {
+		return "502 5.5.1 " + verb + " command disabled"
+	}
+	arg = strings.TrimSpace(arg)
+	if arg == "" {
+		return "501 5.5.4 Missing argument"
+	}
+
+	addr := addressOf(arg)
+	if !v.recipients[strings.ToLower(addr)] {
+		return "550 5.1.1 User unknown"
+	}
+	// An address expands to itself, there are no mailing lists
+	return "250 2.1.5 <" + addr + ">"
+}
+
+// vrfyListener wraps accepted connections so that VRFY and EXPN are
+// answered by the verifier
+type vrfyListener struct {
+	net.Listener
+	verifier      *verifier
+	maxLineLength int
+}
+
+// Accept returns the next connection wrapped in a vrfyConn
+func (l *vrfyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &vrfyConn{Conn: conn, verifier: l.verifier, maxLineLength: l.maxLineLength}, nil
+}
+
+// vrfyConn passes client bytes through to go-smtp except for VRFY and EXPN
+// command lines, which it answers and drops. Command lines are held back
+// until complete, go-smtp can't act on part of one anyway.
+//
+// Message content must never be taken for commands. go-smtp handles one
+// command at a time, replying before it reads on, so DATA and BDAT lines
+// are passed on by themselves and the reply that follows, read from whole
+// reply lines, tells whether content comes next.
+type vrfyConn struct {
+	net.Conn
+	verifier      *verifier
+	maxLineLength int
+
+	pending []byte // Read from the client but not yet scanned
+	out     []byte // Scanned and ready for go-smtp
+	err     error  // Read error to return once pending is delivered
+
+	mu       sync.Mutex
+	awaiting string // "DATA" or "BDAT" once passed on, until its reply or content is read
+	bdatSize int    // Chunk size of the awaited BDAT
+	reply    []byte // Reply line written so far
+	data     bool   // Passing DATA content through, up to the lone "."
+	dot      int    // Position in a possible "." line: 0 line start, 1 ".", 2 ".\r", 3 other
+	skip     int    // BDAT chunk bytes still to be passed through
+	midLine  bool   // Passing through the rest of an overlong command line
+}
+
+// Read returns client bytes with VRFY and EXPN commands answered and
+// removed. A command is only answered once go-smtp has read everything
+// before it, at which point it has replied to all earlier commands.
+func (c *vrfyConn) Read(p []byte) (int, error) {
+	for len(c.out) == 0 {
+		if line, ok := c.scan(); ok {
+			verb, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+			verb = strings.ToUpper(verb)
+			if _, err := c.Conn.Write([]byte(c.verifier.reply(verb, arg) + "\r\n")); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if len(c.out) > 0 {
+			break
+		}
+
+		if c.err != nil {
+			if len(c.pending) == 0 {
+				return 0, c.err
+			}
+			// Let go-smtp see what's left of an unfinished line
+			c.out, c.pending = c.pending, nil
+			break
+		}
+		buf := make([]byte, max(len(p), 512))
+		n, err := c.Conn.Read(buf)
+		c.pending = append(c.pending, buf[:n]...)
+		c.err = err
+	}
+
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+// Write watches go-smtp's replies for the one to an awaited DATA or BDAT
+func (c *vrfyConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.reply = append(c.reply, p...)
+	for {
+		end := bytes.IndexByte(c.reply, '\n')
+		if end < 0 {
+			break
+		}
+		c.replyLine(string(c.reply[:end]))
+		c.reply = c.reply[end+1:]
+	}
+	c.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+// replyLine handles a complete reply line. DATA content follows a 354. A
+// BDAT chunk is read before the reply unless the command was refused; a
+// chunk over the size limit is discarded after its 552.
+func (c *vrfyConn) replyLine(line string) {
+	if len(line) < 4 || line[3] == '-' {
+		return
+	}
+	switch c.awaiting {
+	case "DATA":
+		c.data = strings.HasPrefix(line, "354")
+		c.dot = 0
+	case "BDAT":
+		if strings.HasPrefix(line, "552") {
+			c.skip = c.bdatSize
+		}
+	}
+	c.awaiting = ""
+}
+
+// scan moves bytes that go-smtp should see from pending to out. It stops
+// at a VRFY or EXPN line, which it removes and returns once nothing is
+// waiting in out, and at DATA and BDAT lines, which are passed on alone.
+func (c *vrfyConn) scan() (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// go-smtp reading on after BDAT without a reply is reading the chunk
+	if c.awaiting == "BDAT" {
+		c.skip = c.bdatSize
+	}
+	c.awaiting = ""
+
+	i := 0
+	for i < len(c.pending) {
+		rest := c.pending[i:]
+		switch {
+		case c.skip > 0:
+			n := min(c.skip, len(rest))
+			c.skip -= n
+			i += n
+
+		case c.data:
+			for i < len(c.pending) && c.data {
+				c.dataByte(c.pending[i])
+				i++
+			}
+
+		case c.midLine:
+			end := bytes.IndexByte(rest, '\n')
+			if end < 0 {
+				i = len(c.pending)
+			} else {
+				i += end + 1
+				c.midLine = false
+			}
+
+		default:
+			end := bytes.IndexByte(rest, '\n')
+			if end < 0 {
+				if len(rest) > c.maxLineLength {
+					c.midLine = true
+					continue
+				}
+				c.deliver(i)
+				return "", false
+			}
+
+			line := string(rest[:end+1])
+			verb, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+			switch verb = strings.ToUpper(verb); verb {
+			case "VRFY", "EXPN":
+				if i > 0 || len(c.out) > 0 {
+					c.deliver(i)
+					return "", false
+				}
+				c.pending = c.pending[end+1:]
+				return line, true
+			case "DATA", "BDAT":
+				if i > 0 || len(c.out) > 0 {
+					c.deliver(i)
+					return "", false
+				}
+				c.awaiting = verb
+				c.bdatSize = 0
+				if size, _, _ := strings.Cut(strings.TrimSpace(arg), " "); verb == "BDAT" {
+					if n, err := strconv.ParseUint(size, 10, 32); err == nil {
+						c.bdatSize = int(n)
+					}
+				}
+				c.deliver(end + 1)
+				return "", false
+			}
+			i += end + 1
+		}
+	}
+	c.deliver(i)
+	return "", false
+}
+
+// deliver moves the first n pending bytes to out
+func (c *vrfyConn) deliver(n int) {
+	c.out = append(c.out, c.pending[:n]...)
+	c.pending = c.pending[n:]
+}
+
+// dataByte advances through DATA content by one byte, leaving data mode
+// after the lone "." line that ends it
+func (c *vrfyConn) dataByte(b byte) {
+	switch {
+	case b == '\n':
+		if c.dot == 1 || c.dot == 2 {
+			c.data = false
+		}
+		c.dot = 0
+	case b == '.' && c.dot == 0:
+		c.dot = 1
+	case b == '\r' && c.dot == 1:
+		c.dot = 2
+	default:
+		c.dot = 3
+	}
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"mailer/models"
+	"sync"
+)
+
+// AuditLog keeps the metadata of the most recently removed emails in a
+// fixed-size ring, dropping the oldest entries once full
+type AuditLog struct {
+	mu      sync.RWMutex
+	entries []models.AuditEntry
+	next    int // Index the next entry is written to once the ring is full
+	max     int
+	clock   Clock
+}
+
+// NewAuditLog creates an audit log holding up to max entries, timestamped
+// with clock
+func NewAuditLog(max int, clock Clock) *AuditLog {
+	return &AuditLog{max: max, clock: clock}
+}
+
+// Record adds an entry for a removed email. Its signature matches
+// Store.OnDelete listeners.
+func (a *AuditLog) Record(email *models.Email, reason string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entry := models.AuditEntry{
+		DeletedAt: a.clock.Now(),
+		EmailID:   email.ID,
+		From:      email.From,
+		Subject:   email.Subject,
+		Reason:    reason,
+		Key:       email.Key,
+	}
+	if len(a.entries) < a.max {
+		a.entries = append(a.entries, entry)
+		return
+	}
+	a.entries[a.next] = entry
+	a.next = (a.next + 1) % a.max
+}
+
+// GetAll returns the entries of the given partition, oldest first
+func (a *AuditLog) GetAll(key string) []models.AuditEntry {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	entries := make([]models.AuditEntry, 0, len(a.entries))
+	for i := range a.entries {
+		entry := a.entries[(a.next+i)%len(a.entries)]
+		if entry.Key == key {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
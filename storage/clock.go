@@ -0,0 +1,20 @@
+package storage
+
+import "time"
+
+// Clock tells the current time. Time-dependent code reads it instead of
+// calling time.Now directly so that tests can substitute a fake clock.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the real wall clock
+var SystemClock Clock = systemClock{}
+
+// systemClock implements Clock with time.Now
+type systemClock struct{}
+
+// Now returns the current local time
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"mailer/models"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ConnectionRegistry tracks currently open client sessions
+type ConnectionRegistry struct {
+	mu          sync.RWMutex
+	connections map[int]*models.Connection
+	nextID      int
+}
+
+// NewConnectionRegistry creates a new connection registry
+func NewConnectionRegistry() *ConnectionRegistry {
+	return &ConnectionRegistry{
+		connections: make(map[int]*models.Connection),
+		nextID:      1,
+	}
+}
+
+// Add registers a new open session and returns its ID
+func (r *ConnectionRegistry) Add(protocol, remoteAddr string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id := r.nextID
+	r.connections[id] = &models.Connection{
+		ID:          id,
+		Protocol:    protocol,
+		RemoteAddr:  remoteAddr,
+		ConnectedAt: time.Now(),
+	}
+	r.nextID++
+
+	return id
+}
+
+// Remove unregisters a session once it has disconnected
+func (r *ConnectionRegistry) Remove(id int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.connections, id)
+}
+
+// GetAll returns all open sessions sorted by ID
+func (r *ConnectionRegistry) GetAll() []models.Connection {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	connections := make([]models.Connection, 0, len(r.connections))
+	for _, conn := range r.connections {
+		connections = append(connections, *conn)
+	}
+
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].ID < connections[j].ID
+	})
+
+	return connections
+}
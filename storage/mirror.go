@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mailer/models"
+	"os"
+	"path/filepath"
+)
+
+// DirMirror writes each saved email as a JSON file to a directory and
+// removes the file again when the email is deleted, so a copy of the
+// in-memory store survives the process being killed. Reads are always
+// served by the store; the mirror is never read back.
+type DirMirror struct {
+	dir string
+}
+
+// NewDirMirror creates a mirror writing to dir, creating it if needed
+func NewDirMirror(dir string) (*DirMirror, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &DirMirror{dir: dir}, nil
+}
+
+// Dir returns the directory the mirror writes to
+func (m *DirMirror) Dir() string {
+	return m.dir
+}
+
+// Save writes the email to <uidvalidity>-<id>.json, replacing the file
+// atomically so a crash never leaves a partial copy. IDs restart after
+// DeleteAll, so the UID validity keeps a late deletion of a cleared email
+// from removing the file of a new one with the same ID. Its signature matches Store.OnSave
+// listeners. Failures are logged and don't affect the store.
+func (m *DirMirror) Save(email *models.Email) {
+	data, err := json.Marshal(email)
+	if err != nil {
+		log.Printf("Storage mirror: error encoding email %d: %v", email.ID, err)
+		return
+	}
+
+	tmp, err := os.CreateTemp(m.dir, ".tmp-*")
+	if err != nil {
+		log.Printf("Storage mirror: error writing email %d: %v", email.ID, err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), m.path(email))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("Storage mirror: error writing email %d: %v", email.ID, err)
+	}
+}
+
+// Delete removes the email's file. Its signature matches Store.OnDelete
+// listeners, so deletions, DeleteAll and evictions all reach the mirror.
+func (m *DirMirror) Delete(email *models.Email, reason string) {
+	if err := os.Remove(m.path(email)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Storage mirror: error removing email %d: %v", email.ID, err)
+	}
+}
+
+// path returns the file an email is mirrored to
+func (m *DirMirror) path(email *models.Email) string {
+	return filepath.Join(m.dir, fmt.Sprintf("%d-%d.json", email.UIDValidity, email.ID))
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"encoding/json"
+	"mailer/models"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// mirrored returns the decoded emails in the mirror directory by file name
+func mirrored(t *testing.T, dir string) map[string]*models.Email {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	emails := make(map[string]*models.Email)
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+		var email models.Email
+		if err := json.Unmarshal(data, &email); err != nil {
+			t.Fatalf("%s: %v", entry.Name(), err)
+		}
+		emails[entry.Name()] = &email
+	}
+	return emails
+}
+
+func subjects(emails map[string]*models.Email) []string {
+	var subjects []string
+	for _, email := range emails {
+		subjects = append(subjects, email.Subject)
+	}
+	slices.Sort(subjects)
+	return subjects
+}
+
+func TestDirMirrorFansOut(t *testing.T) {
+	dir := t.TempDir()
+	mirror, err := NewDirMirror(dir)
+	if err != nil {
+		t.Fatalf("NewDirMirror: %v", err)
+	}
+	store := NewStore()
+	store.SetUIDValidity(7)
+	store.OnSave(mirror.Save)
+	store.OnDelete(mirror.Delete)
+
+	first := store.Save(newTestEmail(store, "first"))
+	store.Save(newTestEmail(store, "second"))
+	if got := subjects(mirrored(t, dir)); !slices.Equal(got, []string{"first", "second"}) {
+		t.Fatalf("mirror after Save holds %v, want [first second]", got)
+	}
+
+	store.Delete(first)
+	files := mirrored(t, dir)
+	if got := subjects(files); !slices.Equal(got, []string{"second"}) {
+		t.Fatalf("mirror after Delete holds %v, want [second]", got)
+	}
+	if _, ok := files["7-2.json"]; !ok {
+		t.Errorf("mirror files = %v, want 7-2.json", files)
+	}
+
+	store.DeleteAll()
+	if got := mirrored(t, dir); len(got) != 0 {
+		t.Fatalf("mirror after DeleteAll holds %v, want nothing", subjects(got))
+	}
+}
+
+// TestDirMirrorLateDelete checks that a deletion delivered after DeleteAll
+// restarted the IDs doesn't remove the new email that reused the ID
+func TestDirMirrorLateDelete(t *testing.T) {
+	dir := t.TempDir()
+	mirror, err := NewDirMirror(dir)
+	if err != nil {
+		t.Fatalf("NewDirMirror: %v", err)
+	}
+	store := NewStore()
+	store.OnSave(mirror.Save)
+
+	id := store.Save(newTestEmail(store, "old"))
+	old, _ := store.GetByID(id)
+	store.DeleteAll()
+	mirror.Delete(old, DeleteReasonClear)
+
+	if reused := store.Save(newTestEmail(store, "new")); reused != id {
+		t.Fatalf("ID after DeleteAll = %d, want %d to be reused", reused, id)
+	}
+	mirror.Delete(old, DeleteReasonClear)
+
+	if got := subjects(mirrored(t, dir)); !slices.Equal(got, []string{"new"}) {
+		t.Errorf("mirror holds %v, want [new]", got)
+	}
+}
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"mailer/models"
+	"slices"
+)
+
+// Partition is a view of the store limited to the emails saved under a
+// single API key. The empty key is the shared partition used when no key
+// is configured or provided. IDs stay global across partitions.
+type Partition struct {
+	store *Store
+	key   string
+}
+
+// Partition returns the view of the emails saved under key
+func (s *Store) Partition(key string) *Partition {
+	return &Partition{store: s, key: key}
+}
+
+// Key returns the API key of the partition
+func (p *Partition) Key() string {
+	return p.key
+}
+
+// GetAll returns the partition's emails sorted by ID
+func (p *Partition) GetAll() []*models.Email {
+	return p.Filter(func(*models.Email) bool { return true })
+}
+
+// Filter returns the partition's emails for which match returns true,
+// sorted by ID. It reads the store's Snapshot, so it neither sorts nor
+// holds the lock while matching.
+func (p *Partition) Filter(match func(*models.Email) bool) []*models.Email {
+	filtered := make([]*models.Email, 0)
+	for _, email := range p.store.Snapshot() {
+		if email.Key == p.key && match(email) {
+			filtered = append(filtered, email)
+		}
+	}
+	return filtered
+}
+
+// CountWhere returns how many of the partition's emails match returns true for
+func (p *Partition) CountWhere(match func(*models.Email) bool) int {
+	p.store.mu.RLock()
+	defer p.store.mu.RUnlock()
+
+	count := 0
+	for id := range p.store.partitions[p.key] {
+		if match(p.store.emails[id]) {
+			count++
+		}
+	}
+	return count
+}
+
+// Latest returns the nth most recently received of the partition's emails
+// for which match returns true, in the order of the email list's default
+// "-date" sort, with n = 1 for the latest. Only the n most recent matches
+// are tracked while scanning, so the partition is never sorted as a whole.
+func (p *Partition) Latest(n int, match func(*models.Email) bool) (*models.Email, bool) {
+	newestFirst, _ := models.EmailComparator("-date")
+
+	p.store.mu.RLock()
+	defer p.store.mu.RUnlock()
+
+	var recent []*models.Email // Newest first, at most n long
+	for id := range p.store.partitions[p.key] {
+		email := p.store.emails[id]
+		if len(recent) == n && newestFirst(email, recent[n-1]) > 0 {
+			continue
+		}
+		if !match(email) {
+			continue
+		}
+		i, _ := slices.BinarySearchFunc(recent, email, newestFirst)
+		recent = slices.Insert(recent, i, email)
+		if len(recent) > n {
+			recent = recent[:n]
+		}
+	}
+
+	if len(recent) < n {
+		return nil, false
+	}
+	return recent[n-1], true
+}
+
+// GetByID returns a specific email if it belongs to the partition
+func (p *Partition) GetByID(id int) (*models.Email, bool) {
+	p.store.mu.RLock()
+	defer p.store.mu.RUnlock()
+
+	if !p.store.partitions[p.key][id] {
+		return nil, false
+	}
+	return p.store.emails[id], true
+}
+
+// Delete removes an email by ID if it belongs to the partition
+func (p *Partition) Delete(id int) bool {
+	p.store.mu.Lock()
+	email, exists := p.store.emails[id]
+	exists = exists && p.store.partitions[p.key][id]
+	if exists {
+		p.store.remove(id)
+	}
+	listeners := p.store.deletions
+	p.store.mu.Unlock()
+
+	if exists {
+		notifyDeleted(listeners, []*models.Email{email}, DeleteReasonDelete)
+	}
+	return exists
+}
+
+// DeleteAll removes the partition's emails and returns how many were removed.
+// Unlike Store.DeleteAll, IDs keep counting up since other partitions still
+// use them.
+func (p *Partition) DeleteAll() int {
+	p.store.mu.Lock()
+	var removed []*models.Email
+	for id := range p.store.partitions[p.key] {
+		removed = append(removed, p.store.emails[id])
+		p.store.remove(id)
+	}
+	listeners := p.store.deletions
+	p.store.mu.Unlock()
+
+	notifyDeleted(listeners, removed, DeleteReasonClear)
+	return len(removed)
+}
+
+// Senders returns the partition's distinct sender addresses with their
+// message counts
+func (p *Partition) Senders() []models.AddressCount {
+	return countAddresses(p.GetAll(), senderAddresses)
+}
+
+// Recipients returns the partition's distinct recipient addresses with their
+// message counts
+func (p *Partition) Recipients() []models.AddressCount {
+	return countAddresses(p.GetAll(), recipientAddresses)
+}
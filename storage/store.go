@@ -2,39 +2,267 @@ package storage
 
 import (
 	"mailer/models"
+	"maps"
+	"net/mail"
+	"net/textproto"
+	"slices"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Store manages email storage in memory
+// Store manages email storage in memory.
+//
+// Email IDs double as IMAP UIDs. An ID is never reused while the UID validity
+// stays the same: IDs only restart at 1 in DeleteAll, which also bumps the
+// UID validity so clients know to discard cached UIDs.
 type Store struct {
-	mu      sync.RWMutex
-	emails  map[int]*models.Email
-	nextID  int
+	mu          sync.RWMutex
+	emails      map[int]*models.Email
+	flags       map[int]map[string]bool            // IMAP flags shared by all sessions, keyed by email ID
+	clicks      map[int]map[string]int             // Tracked link clicks per URL, keyed by email ID
+	opens       map[int]*models.OpenStats          // Tracked pixel opens, keyed by email ID
+	partitions  map[string]map[int]bool            // Email IDs per API key, see Partition
+	headers     map[string]map[string]map[int]bool // Email IDs per custom header name and value
+	snapshot    atomic.Pointer[[]*models.Email]    // Emails sorted by ID, nil once stale, see Snapshot
+	nextID      int
+	uidValidity uint32
+	clock       Clock
+	retention   time.Duration // Maximum age of emails without their own expiry (0 = forever)
+	modified    time.Time     // Last time an email was saved or removed, see LastModified
+	transforms  []func(*models.Email)
+	listeners   []func(*models.Email)
+	evictions   []func(*models.Email, string)
+	deletions   []func(*models.Email, string)
+	openers     []func(*models.Email)
 }
 
-// NewStore creates a new email store
+// Eviction reasons passed to OnEvict and OnDelete listeners
+const (
+	EvictReasonTTL       = "ttl"       // The email's X-Mailer-TTL expired
+	EvictReasonRetention = "retention" // The email outlived the global retention
+)
+
+// Deletion reasons passed to OnDelete listeners for removals on request
+const (
+	DeleteReasonDelete = "deleted" // The email was deleted or expunged individually
+	DeleteReasonClear  = "cleared" // All emails (of a partition) were deleted at once
+)
+
+// NewStore creates a new email store. The UID validity defaults to the
+// creation time so that IDs restarting with a fresh process invalidate
+// any UIDs cached by clients.
 func NewStore() *Store {
 	return &Store{
-		emails: make(map[int]*models.Email),
-		nextID: 1,
+		emails:      make(map[int]*models.Email),
+		flags:       make(map[int]map[string]bool),
+		clicks:      make(map[int]map[string]int),
+		opens:       make(map[int]*models.OpenStats),
+		partitions:  make(map[string]map[int]bool),
+		headers:     make(map[string]map[string]map[int]bool),
+		nextID:      1,
+		uidValidity: uint32(time.Now().Unix()),
+		clock:       SystemClock,
+		modified:    time.Now(),
 	}
 }
 
+// SetClock replaces the clock used for expiry and open tracking, e.g. with
+// a fake one in tests. The store is itself a Clock, so components sharing
+// its notion of time can be handed the store.
+func (s *Store) SetClock(clock Clock) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clock = clock
+}
+
+// Now returns the current time of the store's clock
+func (s *Store) Now() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.clock.Now()
+}
+
+// SetRetention sets the maximum age of emails without an X-Mailer-TTL
+// expiry (0 = keep forever). It can be changed at any time and applies from
+// the next DeleteExpired.
+func (s *Store) SetRetention(retention time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.retention = retention
+}
+
+// Retention returns the maximum age of emails without their own expiry
+func (s *Store) Retention() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.retention
+}
+
+// LastModified returns the last time an email was saved, removed or had
+// its flags changed, or the creation time of an empty store
+func (s *Store) LastModified() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.modified
+}
+
+// changed records a change to the set of emails, invalidating the snapshot.
+// Callers must hold the write lock.
+func (s *Store) changed() {
+	s.snapshot.Store(nil)
+	s.modified = s.clock.Now()
+}
+
+// SetUIDValidity overrides the UID validity. Only a store whose IDs survive
+// restarts may keep one across them; this in-memory store restarts IDs at 1.
+func (s *Store) SetUIDValidity(uidValidity uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.uidValidity = uidValidity
+}
+
+// UIDValidity returns the current UID validity
+func (s *Store) UIDValidity() uint32 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.uidValidity
+}
+
+// NextID returns the ID the next saved email will receive
+func (s *Store) NextID() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.nextID
+}
+
+// BeforeSave registers a transform that runs once an email has been assigned
+// its ID but before it becomes visible to readers. Transforms run with the
+// store locked and must not call back into the store.
+func (s *Store) BeforeSave(transform func(*models.Email)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.transforms = append(s.transforms, transform)
+}
+
+// OnSave registers a listener that is called after each email is saved.
+// Listeners run synchronously on the saving goroutine and must not block.
+func (s *Store) OnSave(listener func(*models.Email)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.listeners = append(s.listeners, listener)
+}
+
+// OnEvict registers a listener that is called with the reason for each email
+// removed automatically rather than on request. Listeners run synchronously
+// on the evicting goroutine and must not block.
+func (s *Store) OnEvict(listener func(email *models.Email, reason string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.evictions = append(s.evictions, listener)
+}
+
+// OnDelete registers a listener that is called with the reason for each
+// removed email, whether deleted on request or evicted. Listeners run
+// synchronously on the deleting goroutine and must not block.
+func (s *Store) OnDelete(listener func(email *models.Email, reason string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deletions = append(s.deletions, listener)
+}
+
+// OnOpen registers a listener that is called after each recorded open.
+// Listeners run synchronously on the recording goroutine and must not block.
+func (s *Store) OnOpen(listener func(*models.Email)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.openers = append(s.openers, listener)
+}
+
 // Save stores a new email and returns its ID
 func (s *Store) Save(email *models.Email) int {
+	return s.SaveAll([]*models.Email{email})[0]
+}
+
+// SaveAll stores a batch of new emails under a single lock acquisition and
+// returns their IDs in order
+func (s *Store) SaveAll(emails []*models.Email) []int {
+	return s.saveAll(emails, true)
+}
+
+// SaveCopy stores a copy of an email that was already saved, e.g. a replay,
+// and returns its ID. BeforeSave transforms are skipped since the copy has
+// been through them; OnSave listeners are notified as for any new email.
+func (s *Store) SaveCopy(email *models.Email) int {
+	return s.saveAll([]*models.Email{email}, false)[0]
+}
+
+// saveAll stores emails, running the BeforeSave transforms on each when
+// transform is set
+func (s *Store) saveAll(emails []*models.Email, transform bool) []int {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	ids := make([]int, len(emails))
+	for i, email := range emails {
+		email.ID = s.nextID
+		email.UIDValidity = s.uidValidity
+		if transform {
+			for _, transform := range s.transforms {
+				transform(email)
+			}
+		}
+		s.emails[s.nextID] = email
+		s.changed()
+		if s.partitions[email.Key] == nil {
+			s.partitions[email.Key] = make(map[int]bool)
+		}
+		s.partitions[email.Key][email.ID] = true
+		s.indexHeaders(email)
+		s.nextID++
+		ids[i] = email.ID
+	}
+	listeners := s.listeners
+	s.mu.Unlock()
 
-	email.ID = s.nextID
-	s.emails[s.nextID] = email
-	s.nextID++
+	for _, email := range emails {
+		for _, listener := range listeners {
+			listener(email)
+		}
+	}
 
-	return email.ID
+	return ids
 }
 
-// GetAll returns all stored emails sorted by ID for consistent ordering
+// GetAll returns all stored emails sorted by ID for consistent ordering. The
+// slice is the caller's own; read-only callers should prefer Snapshot.
 func (s *Store) GetAll() []*models.Email {
+	return slices.Clone(s.Snapshot())
+}
+
+// Snapshot returns all stored emails sorted by ID as a point-in-time view
+// that can be iterated without holding the lock. The slice is shared with
+// other callers and must not be modified. It is built once per change to the
+// store, so repeated reads of an unchanged store neither copy nor block
+// writers.
+func (s *Store) Snapshot() []*models.Email {
+	if emails := s.snapshot.Load(); emails != nil {
+		return *emails
+	}
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -48,9 +276,45 @@ func (s *Store) GetAll() []*models.Email {
 		return emails[i].ID < emails[j].ID
 	})
 
+	// Writers invalidate the snapshot under the write lock, so one built
+	// under the read lock can't be stale when stored
+	s.snapshot.Store(&emails)
 	return emails
 }
 
+// GetByTimeRange returns emails received within [start, end] sorted by ID.
+// A zero start or end leaves that side of the range open.
+func (s *Store) GetByTimeRange(start, end time.Time) []*models.Email {
+	emails := s.Snapshot()
+
+	filtered := make([]*models.Email, 0, len(emails))
+	for _, email := range emails {
+		if !start.IsZero() && email.ReceivedAt.Before(start) {
+			continue
+		}
+		if !end.IsZero() && email.ReceivedAt.After(end) {
+			continue
+		}
+		filtered = append(filtered, email)
+	}
+
+	return filtered
+}
+
+// CountWhere returns how many stored emails match returns true for
+func (s *Store) CountWhere(match func(*models.Email) bool) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	for _, email := range s.emails {
+		if match(email) {
+			count++
+		}
+	}
+	return count
+}
+
 // GetByID returns a specific email by ID
 func (s *Store) GetByID(id int) (*models.Email, bool) {
 	s.mu.RLock()
@@ -63,22 +327,374 @@ func (s *Store) GetByID(id int) (*models.Email, bool) {
 // Delete removes an email by ID
 func (s *Store) Delete(id int) bool {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	email, exists := s.emails[id]
+	if exists {
+		s.remove(id)
+	}
+	listeners := s.deletions
+	s.mu.Unlock()
 
-	if _, exists := s.emails[id]; exists {
-		delete(s.emails, id)
-		return true
+	if exists {
+		notifyDeleted(listeners, []*models.Email{email}, DeleteReasonDelete)
 	}
-	return false
+	return exists
 }
 
-// DeleteAll removes all emails
-func (s *Store) DeleteAll() {
+// DeleteEmail removes the given email if it is still the one stored under
+// its ID. This guards callers holding a stale snapshot against removing a
+// different email that reused the ID after DeleteAll.
+func (s *Store) DeleteEmail(email *models.Email) bool {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	current, exists := s.emails[email.ID]
+	removed := exists && current == email
+	if removed {
+		s.remove(email.ID)
+	}
+	listeners := s.deletions
+	s.mu.Unlock()
+
+	if removed {
+		notifyDeleted(listeners, []*models.Email{email}, DeleteReasonDelete)
+	}
+	return removed
+}
 
+// DeleteAll removes all emails and returns how many were removed. IDs
+// restart at 1, so the UID validity is bumped.
+func (s *Store) DeleteAll() int {
+	s.mu.Lock()
+	removed := slices.Collect(maps.Values(s.emails))
+	listeners := s.deletions
 	s.emails = make(map[int]*models.Email)
+	s.changed()
+	s.flags = make(map[int]map[string]bool)
+	s.clicks = make(map[int]map[string]int)
+	s.opens = make(map[int]*models.OpenStats)
+	s.partitions = make(map[string]map[int]bool)
+	s.headers = make(map[string]map[string]map[int]bool)
 	s.nextID = 1
+	s.uidValidity++
+	s.mu.Unlock()
+
+	notifyDeleted(listeners, removed, DeleteReasonClear)
+	return len(removed)
+}
+
+// DeleteExpired removes emails past their per-email expiry, or older than
+// the retention set with SetRetention when they have none, and returns how
+// many were removed. OnEvict listeners are notified of each removal.
+func (s *Store) DeleteExpired() int {
+	type eviction struct {
+		email  *models.Email
+		reason string
+	}
+
+	s.mu.Lock()
+	now := s.clock.Now()
+	var evicted []eviction
+	for id, email := range s.emails {
+		reason := ""
+		if email.ExpiresAt != nil {
+			if now.After(*email.ExpiresAt) {
+				reason = EvictReasonTTL
+			}
+		} else if s.retention > 0 && now.Sub(email.ReceivedAt) > s.retention {
+			reason = EvictReasonRetention
+		}
+
+		if reason != "" {
+			s.remove(id)
+			evicted = append(evicted, eviction{email, reason})
+		}
+	}
+	listeners := s.evictions
+	deletions := s.deletions
+	s.mu.Unlock()
+
+	sort.Slice(evicted, func(i, j int) bool {
+		return evicted[i].email.ID < evicted[j].email.ID
+	})
+	for _, e := range evicted {
+		for _, listener := range listeners {
+			listener(e.email, e.reason)
+		}
+		for _, listener := range deletions {
+			listener(e.email, e.reason)
+		}
+	}
+
+	return len(evicted)
+}
+
+// notifyDeleted calls the OnDelete listeners for each removed email in ID
+// order. The caller must not hold the lock.
+func notifyDeleted(listeners []func(*models.Email, string), emails []*models.Email, reason string) {
+	if len(listeners) == 0 {
+		return
+	}
+	sort.Slice(emails, func(i, j int) bool {
+		return emails[i].ID < emails[j].ID
+	})
+	for _, email := range emails {
+		for _, listener := range listeners {
+			listener(email, reason)
+		}
+	}
+}
+
+// remove deletes an email and everything indexed by its ID. The caller must
+// hold the write lock.
+func (s *Store) remove(id int) {
+	if email, exists := s.emails[id]; exists {
+		delete(s.partitions[email.Key], id)
+		if len(s.partitions[email.Key]) == 0 {
+			delete(s.partitions, email.Key)
+		}
+		s.unindexHeaders(email)
+	}
+	delete(s.emails, id)
+	s.changed()
+	delete(s.flags, id)
+	delete(s.clicks, id)
+	delete(s.opens, id)
+}
+
+// indexHeaders adds an email's custom headers to the header index. The
+// caller must hold the write lock.
+func (s *Store) indexHeaders(email *models.Email) {
+	for name, values := range email.CustomHeaders {
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if s.headers[name] == nil {
+			s.headers[name] = make(map[string]map[int]bool)
+		}
+		for _, value := range values {
+			if s.headers[name][value] == nil {
+				s.headers[name][value] = make(map[int]bool)
+			}
+			s.headers[name][value][email.ID] = true
+		}
+	}
+}
+
+// unindexHeaders removes an email's custom headers from the header index.
+// The caller must hold the write lock.
+func (s *Store) unindexHeaders(email *models.Email) {
+	for name, values := range email.CustomHeaders {
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		for _, value := range values {
+			delete(s.headers[name][value], email.ID)
+			if len(s.headers[name][value]) == 0 {
+				delete(s.headers[name], value)
+			}
+		}
+		if len(s.headers[name]) == 0 {
+			delete(s.headers, name)
+		}
+	}
+}
+
+// EmailIDsWithHeader returns the IDs of the emails with a custom header
+// exactly equal to value
+func (s *Store) EmailIDsWithHeader(name string, value string) map[int]bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := make(map[int]bool)
+	maps.Copy(ids, s.headers[textproto.CanonicalMIMEHeaderKey(name)][value])
+	return ids
+}
+
+// SeenFlag marks an email as read. IMAP and the API share it, so reading
+// an email through either marks it read in both.
+const SeenFlag = `\Seen`
+
+// EmailIDsWithFlag returns the IDs of the emails carrying a flag
+func (s *Store) EmailIDsWithFlag(flag string) map[int]bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := make(map[int]bool)
+	for id, flags := range s.flags {
+		if flags[flag] {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// SetFlag sets or clears a flag on an email, returning false if the email
+// doesn't exist
+func (s *Store) SetFlag(id int, flag string, set bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.emails[id]; !exists {
+		return false
+	}
+
+	if set {
+		if s.flags[id] == nil {
+			s.flags[id] = make(map[string]bool)
+		}
+		s.flags[id][flag] = true
+	} else if s.flags[id] != nil {
+		delete(s.flags[id], flag)
+	}
+
+	// Flags such as \Seen show up in API responses, so they must defeat
+	// If-Modified-Since; the snapshot holds no flags and stays valid
+	s.modified = s.clock.Now()
+	return true
+}
+
+// HasFlag reports whether a flag is set on an email
+func (s *Store) HasFlag(id int, flag string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.flags[id][flag]
+}
+
+// Flags returns the flags set on an email, sorted
+func (s *Store) Flags(id int) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return slices.Sorted(maps.Keys(s.flags[id]))
+}
+
+// RecordClick counts a click on a tracked link, returning false if the email
+// doesn't exist
+func (s *Store) RecordClick(id int, url string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.emails[id]; !exists {
+		return false
+	}
+
+	if s.clicks[id] == nil {
+		s.clicks[id] = make(map[string]int)
+	}
+	s.clicks[id][url]++
+	return true
+}
+
+// GetClicks returns the click count per URL for an email
+func (s *Store) GetClicks(id int) map[string]int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	clicks := make(map[string]int, len(s.clicks[id]))
+	for url, count := range s.clicks[id] {
+		clicks[url] = count
+	}
+	return clicks
+}
+
+// RecordOpen counts an open of an email's tracking pixel, returning false if
+// the email doesn't exist
+func (s *Store) RecordOpen(id int) bool {
+	s.mu.Lock()
+	email, exists := s.emails[id]
+	if !exists {
+		s.mu.Unlock()
+		return false
+	}
+
+	now := s.clock.Now()
+	stats := s.opens[id]
+	if stats == nil {
+		stats = &models.OpenStats{FirstOpenedAt: &now}
+		s.opens[id] = stats
+	}
+	stats.Count++
+	stats.LastOpenedAt = &now
+	listeners := s.openers
+	s.mu.Unlock()
+
+	for _, listener := range listeners {
+		listener(email)
+	}
+	return true
+}
+
+// GetOpens returns the tracked opens of an email
+func (s *Store) GetOpens(id int) models.OpenStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if stats := s.opens[id]; stats != nil {
+		return *stats
+	}
+	return models.OpenStats{}
+}
+
+// Senders returns the distinct sender addresses with their message counts
+func (s *Store) Senders() []models.AddressCount {
+	return countAddresses(s.Snapshot(), senderAddresses)
+}
+
+// Recipients returns the distinct recipient addresses with their message counts
+func (s *Store) Recipients() []models.AddressCount {
+	return countAddresses(s.Snapshot(), recipientAddresses)
+}
+
+// senderAddresses returns the sender of an email
+func senderAddresses(email *models.Email) []string {
+	return []string{email.From}
+}
+
+// recipientAddresses returns the recipients of an email
+func recipientAddresses(email *models.Email) []string {
+	return email.To
+}
+
+// countAddresses groups emails by the bare addresses returned by addresses,
+// sorted by descending count
+func countAddresses(emails []*models.Email, addresses func(*models.Email) []string) []models.AddressCount {
+	counts := make(map[string]*models.AddressCount)
+	for _, email := range emails {
+		seen := make(map[string]bool)
+		for _, addr := range addresses(email) {
+			address := normalizeAddress(addr)
+			if address == "" || seen[address] {
+				continue
+			}
+			seen[address] = true
+
+			count, exists := counts[address]
+			if !exists {
+				count = &models.AddressCount{Address: address}
+				counts[address] = count
+			}
+			count.Count++
+			if email.ReceivedAt.After(count.LastSeen) {
+				count.LastSeen = email.ReceivedAt
+			}
+		}
+	}
+
+	result := make([]models.AddressCount, 0, len(counts))
+	for _, count := range counts {
+		result = append(result, *count)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Address < result[j].Address
+	})
+
+	return result
+}
+
+// normalizeAddress reduces "Name <addr>" forms to the lowercased bare address
+func normalizeAddress(addr string) string {
+	if parsed, err := mail.ParseAddress(addr); err == nil {
+		addr = parsed.Address
+	}
+	return strings.ToLower(strings.TrimSpace(addr))
 }
 
 // Count returns the number of stored emails
@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"fmt"
+	"mailer/models"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when advanced
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// newTestEmail returns an email received at the store's current time
+func newTestEmail(store *Store, subject string) *models.Email {
+	return &models.Email{
+		From:       "sender@example.com",
+		To:         []string{"rcpt@example.com"},
+		Subject:    subject,
+		ReceivedAt: store.Now(),
+	}
+}
+
+func TestDeleteExpiredRetention(t *testing.T) {
+	clock := newFakeClock()
+	store := NewStore()
+	store.SetClock(clock)
+	store.SetRetention(time.Hour)
+
+	var evicted []string
+	store.OnEvict(func(email *models.Email, reason string) {
+		evicted = append(evicted, reason)
+	})
+
+	id := store.Save(newTestEmail(store, "old"))
+
+	clock.Advance(time.Hour)
+	if deleted := store.DeleteExpired(); deleted != 0 {
+		t.Fatalf("DeleteExpired at exactly the retention removed %d emails, want 0", deleted)
+	}
+
+	clock.Advance(time.Second)
+	fresh := store.Save(newTestEmail(store, "fresh"))
+	if deleted := store.DeleteExpired(); deleted != 1 {
+		t.Fatalf("DeleteExpired past the retention removed %d emails, want 1", deleted)
+	}
+	if _, exists := store.GetByID(id); exists {
+		t.Errorf("email %d still stored after expiring", id)
+	}
+	if _, exists := store.GetByID(fresh); !exists {
+		t.Errorf("email %d within the retention was removed", fresh)
+	}
+	if len(evicted) != 1 || evicted[0] != EvictReasonRetention {
+		t.Errorf("eviction reasons = %v, want [%s]", evicted, EvictReasonRetention)
+	}
+}
+
+func TestDeleteExpiredTTL(t *testing.T) {
+	clock := newFakeClock()
+	store := NewStore()
+	store.SetClock(clock)
+
+	email := newTestEmail(store, "ttl")
+	expiresAt := clock.Now().Add(5 * time.Minute)
+	email.ExpiresAt = &expiresAt
+	id := store.Save(email)
+
+	clock.Advance(5*time.Minute + time.Second)
+	if deleted := store.DeleteExpired(); deleted != 1 {
+		t.Fatalf("DeleteExpired removed %d emails, want 1", deleted)
+	}
+	if _, exists := store.GetByID(id); exists {
+		t.Errorf("email %d still stored after its TTL", id)
+	}
+}
+
+func TestAuditLogUsesStoreClock(t *testing.T) {
+	clock := newFakeClock()
+	store := NewStore()
+	store.SetClock(clock)
+	audit := NewAuditLog(10, store)
+	store.OnDelete(audit.Record)
+
+	id := store.Save(newTestEmail(store, "audited"))
+	clock.Advance(time.Minute)
+	store.Delete(id)
+
+	entries := audit.GetAll("")
+	if len(entries) != 1 {
+		t.Fatalf("got %d audit entries, want 1", len(entries))
+	}
+	if !entries[0].DeletedAt.Equal(clock.Now()) {
+		t.Errorf("DeletedAt = %v, want the store clock's %v", entries[0].DeletedAt, clock.Now())
+	}
+}
+
+func TestDeleteAllBumpsUIDValidity(t *testing.T) {
+	store := NewStore()
+	store.SetUIDValidity(7)
+	first := store.Save(newTestEmail(store, "first"))
+	store.Save(newTestEmail(store, "second"))
+
+	if removed := store.DeleteAll(); removed != 2 {
+		t.Errorf("DeleteAll removed %d emails, want 2", removed)
+	}
+	if got := store.UIDValidity(); got != 8 {
+		t.Errorf("UID validity = %d after DeleteAll, want 8", got)
+	}
+
+	// The reused ID is told apart from the deleted email by its validity
+	id := store.Save(newTestEmail(store, "third"))
+	if id != first {
+		t.Errorf("first ID after DeleteAll = %d, want %d", id, first)
+	}
+	email, _ := store.GetByID(id)
+	if email.UIDValidity != 8 {
+		t.Errorf("email saved under UID validity %d, want 8", email.UIDValidity)
+	}
+}
+
+// benchmarkEmails is the store size the snapshot benchmarks run against
+const benchmarkEmails = 100_000
+
+// newBenchmarkStore returns a store holding benchmarkEmails emails
+func newBenchmarkStore(b *testing.B) *Store {
+	b.Helper()
+	store := NewStore()
+	for i := range benchmarkEmails {
+		store.Save(newTestEmail(store, fmt.Sprintf("email %d", i)))
+	}
+	return store
+}
+
+// BenchmarkSnapshot reads the snapshot of an unchanged store, which is
+// built once and then shared
+func BenchmarkSnapshot(b *testing.B) {
+	store := newBenchmarkStore(b)
+	store.Snapshot()
+	for b.Loop() {
+		store.Snapshot()
+	}
+}
+
+// BenchmarkSnapshotRebuild reads the snapshot after every change, the cost
+// GetAll used to pay on each call
+func BenchmarkSnapshotRebuild(b *testing.B) {
+	store := newBenchmarkStore(b)
+	for b.Loop() {
+		store.mu.Lock()
+		store.changed()
+		store.mu.Unlock()
+		store.Snapshot()
+	}
+}
+
+func BenchmarkGetAll(b *testing.B) {
+	store := newBenchmarkStore(b)
+	for b.Loop() {
+		store.GetAll()
+	}
+}
+
+func BenchmarkPartitionGetAll(b *testing.B) {
+	store := newBenchmarkStore(b)
+	partition := store.Partition("")
+	for b.Loop() {
+		partition.GetAll()
+	}
+}